@@ -16,6 +16,7 @@ import "C"
 import (
 	"context"
 	"fmt"
+	"log"
 	"net"
 	"sync"
 	"unsafe"
@@ -26,6 +27,10 @@ import (
 var loggerFunc unsafe.Pointer
 var loggerCtx unsafe.Pointer
 
+// logToStderr makes CLogger fall back to the standard logger when no C logger
+// is registered. It is only set by the standalone server command.
+var logToStderr bool
+
 type CLogger int
 
 func cstring(s string) *C.char {
@@ -39,6 +44,9 @@ func cstring(s string) *C.char {
 
 func (l CLogger) Printf(format string, args ...interface{}) {
 	if uintptr(loggerFunc) == 0 {
+		if logToStderr {
+			log.Printf(format, args...)
+		}
 		return
 	}
 	C.callLogger(loggerFunc, loggerCtx, C.int(l), cstring(fmt.Sprintf(format, args...)))
@@ -49,7 +57,29 @@ type UdpTlsPipeHandle struct {
 	cancel    context.CancelFunc
 	localAddr string
 	localPort int
+	stats     *pipeStats
 	wg        sync.WaitGroup
+	errMu     sync.Mutex
+	lastErr   error
+}
+
+func (h *UdpTlsPipeHandle) setError(err error) {
+	h.errMu.Lock()
+	defer h.errMu.Unlock()
+	h.lastErr = err
+}
+
+func (h *UdpTlsPipeHandle) getError() error {
+	h.errMu.Lock()
+	defer h.errMu.Unlock()
+	return h.lastErr
+}
+
+// lookupHandle returns the running handle with the given ID, or nil
+func lookupHandle(handle C.int) *UdpTlsPipeHandle {
+	handlesMu.Lock()
+	defer handlesMu.Unlock()
+	return handles[int32(handle)]
 }
 
 var (
@@ -64,17 +94,17 @@ func udptlspipeSetLogger(context unsafe.Pointer, loggerFn unsafe.Pointer) {
 	loggerFunc = loggerFn
 }
 
-// udptlspipeStart starts a udptlspipe client.
+// udptlspipeStart starts a udptlspipe client listening on 127.0.0.1.
 // Parameters:
 //   - destination: the remote server address (e.g., "server.example.com:443")
 //   - password: the password for authentication (can be empty)
 //   - tlsServerName: TLS server name for SNI (can be empty to use destination host)
 //   - secure: if 1, enables TLS certificate verification
-//   - proxy: proxy URL (can be empty)
+//   - proxy: proxy URL, "http://", "https://", "socks5://" or "socks5h://" with optional user:pass@ (can be empty)
 //   - fingerprintProfile: TLS fingerprint profile ("chrome", "firefox", "safari", "edge", "okhttp", "ios", "randomized")
 //   - listenPort: local port to listen on (0 for auto-assign)
 //
-// Returns: handle ID on success (>0), or negative error code on failure
+// Returns: handle ID on success (>0), or a negated UDPTLSPIPE_ERROR_* code on failure
 //
 //export udptlspipeStart
 func udptlspipeStart(
@@ -86,73 +116,177 @@ func udptlspipeStart(
 	fingerprintProfile *C.char,
 	listenPort C.int,
 ) C.int {
+	return udptlspipeStartOnAddress(destination, password, tlsServerName, secure, proxy, fingerprintProfile, nil, listenPort)
+}
+
+// udptlspipeStartOnAddress starts a udptlspipe client listening on the given
+// local address.
+// Parameters:
+//   - destination, password, tlsServerName, secure, proxy, fingerprintProfile: as for udptlspipeStart
+//   - listenAddress: local IP address to bind to (empty for 127.0.0.1, "::1" for
+//     IPv6 loopback, "::" for dual-stack on all interfaces, or an interface address)
+//   - listenPort: local port to listen on (0 for auto-assign)
+//
+// The call returns once the local UDP listener is bound, so bind failures are
+// reported here rather than later through the handle.
+//
+// Returns: handle ID on success (>0), or a negated UDPTLSPIPE_ERROR_* code on failure
+//
+//export udptlspipeStartOnAddress
+func udptlspipeStartOnAddress(
+	destination *C.char,
+	password *C.char,
+	tlsServerName *C.char,
+	secure C.int,
+	proxy *C.char,
+	fingerprintProfile *C.char,
+	listenAddress *C.char,
+	listenPort C.int,
+) C.int {
+	cfg := &pipeConfig{
+		Destination:        C.GoString(destination),
+		Password:           C.GoString(password),
+		TLSServerName:      C.GoString(tlsServerName),
+		Secure:             secure != 0,
+		Proxy:              C.GoString(proxy),
+		FingerprintProfile: C.GoString(fingerprintProfile),
+		ListenAddress:      C.GoString(listenAddress),
+		ListenPort:         int(listenPort),
+	}
+
+	// These entry points have always fallen back to okhttp for unknown
+	// profiles, only the JSON configuration rejects them
+	if !IsValidProfile(cfg.FingerprintProfile) {
+		cfg.FingerprintProfile = ""
+	}
+
+	if err := cfg.validate(); err != nil {
+		setLastError(err)
+		CLogger(0).Printf("udptlspipe: Failed to start: %v", err)
+		return -C.int(errorCode(err))
+	}
+	return startPipe(cfg)
+}
+
+// udptlspipeStartWithConfig starts a udptlspipe client from a JSON
+// configuration, see udptlspipe.h for the supported fields.
+// Parameters:
+//   - config: the JSON configuration object
+//
+// Invalid configurations are rejected with UDPTLSPIPE_ERROR_INVALID_CONFIG and
+// the offending field is named in the last error.
+//
+// Returns: handle ID on success (>0), or a negated UDPTLSPIPE_ERROR_* code on failure
+//
+//export udptlspipeStartWithConfig
+func udptlspipeStartWithConfig(config *C.char) C.int {
+	cfg, err := parseConfig(C.GoString(config))
+	if err != nil {
+		setLastError(err)
+		CLogger(0).Printf("udptlspipe: Failed to start: %v", err)
+		return -C.int(errorCode(err))
+	}
+	return startPipe(cfg)
+}
+
+// startPipe opens the stores of a validated configuration, binds the local
+// listener and starts the client, returning the new handle ID or a negated
+// error code.
+func startPipe(cfg *pipeConfig) C.int {
 	logger := CLogger(0)
 
-	destStr := C.GoString(destination)
-	passwordStr := C.GoString(password)
-	tlsServerNameStr := C.GoString(tlsServerName)
-	proxyStr := C.GoString(proxy)
-	fingerprintStr := C.GoString(fingerprintProfile)
-	secureMode := secure != 0
-	localPort := int(listenPort)
-
-	// Default to okhttp if not specified
-	if fingerprintStr == "" {
-		fingerprintStr = "okhttp"
+	if err := cfg.openStores(); err != nil {
+		setLastError(err)
+		logger.Printf("udptlspipe: Failed to start: %v", err)
+		return -C.int(errorCode(err))
 	}
 
-	logger.Printf("udptlspipe: Starting client to %s (fingerprint: %s)", destStr, fingerprintStr)
+	logger.Printf("udptlspipe: Starting client to %s (fingerprint: %s)", cfg.Destination, cfg.FingerprintProfile)
 
-	// Determine local listen address
-	var listenAddr string
-	if localPort > 0 {
-		listenAddr = fmt.Sprintf("127.0.0.1:%d", localPort)
-	} else {
-		// Find a free port
-		listener, err := net.ListenPacket("udp", "127.0.0.1:0")
-		if err != nil {
-			setLastError(fmt.Errorf("failed to find free port: %w", err))
-			logger.Printf("udptlspipe: Failed to find free port: %v", err)
-			return -1
-		}
-		addr := listener.LocalAddr().(*net.UDPAddr)
-		localPort = addr.Port
-		listenAddr = fmt.Sprintf("127.0.0.1:%d", localPort)
-		listener.Close()
+	// Bind the listener here and hand it to the client, so that the port can't
+	// be taken by someone else in between and bind errors reach the caller
+	udpConn, err := listenLocalUDP(cfg.ListenAddress, cfg.ListenPort)
+	if err != nil {
+		setLastError(err)
+		logger.Printf("udptlspipe: Failed to start: %v", err)
+		return -C.int(errorCode(err))
 	}
 
-	logger.Printf("udptlspipe: Listening on %s, destination %s", listenAddr, destStr)
+	localAddr := udpConn.LocalAddr().(*net.UDPAddr)
+
+	logger.Printf("udptlspipe: Listening on %s, destination %s", localAddr, cfg.Destination)
 
 	ctx, cancel := context.WithCancel(context.Background())
 
 	handle := &UdpTlsPipeHandle{
 		cancel:    cancel,
-		localAddr: listenAddr,
-		localPort: localPort,
+		localAddr: localAddr.String(),
+		localPort: localAddr.Port,
+		stats:     newPipeStats(cfg.Stripes),
+	}
+
+	handlesMu.Lock()
+	id := nextID
+	nextID++
+	handles[id] = handle
+	handlesMu.Unlock()
+
+	events := EventSink(id)
+	for _, warning := range cfg.warnings {
+		logger.Printf("udptlspipe: Warning: %s", warning)
+		events.Emit(eventConfigWarning, 0, map[string]interface{}{
+			"field":   warning.field,
+			"warning": warning.message,
+		})
 	}
 
 	// Start the udptlspipe client in a goroutine
 	handle.wg.Add(1)
 	go func() {
 		defer handle.wg.Done()
-		err := runUdpTlsPipeClient(ctx, listenAddr, destStr, passwordStr, tlsServerNameStr, secureMode, proxyStr, fingerprintStr, logger)
+		err := runUdpTlsPipeClient(ctx, udpConn, cfg, handle.stats, events, logger)
 		if err != nil && ctx.Err() == nil {
-			setLastError(err)
+			events.ReportError(err)
 			logger.Printf("udptlspipe: Client error: %v", err)
+			events.Emit(eventListenerError, int(errorCode(err)), map[string]interface{}{
+				"error": err.Error(),
+			})
 		}
 		logger.Printf("udptlspipe: Client stopped")
 	}()
 
-	handlesMu.Lock()
-	id := nextID
-	nextID++
-	handles[id] = handle
-	handlesMu.Unlock()
-
-	logger.Printf("udptlspipe: Started with handle %d, local port %d", id, localPort)
+	logger.Printf("udptlspipe: Started with handle %d, local port %d", id, localAddr.Port)
 	return C.int(id)
 }
 
+// listenLocalUDP binds the local UDP listener. An empty address means IPv4
+// loopback; the unspecified IPv6 address "::" gives a dual-stack socket.
+func listenLocalUDP(address string, port int) (*net.UDPConn, error) {
+	if address == "" {
+		address = "127.0.0.1"
+	}
+
+	ip := net.ParseIP(address)
+	if ip == nil {
+		return nil, newPipeError(errorInvalidConfig, fmt.Errorf("invalid listen address %q", address))
+	}
+
+	network := "udp6"
+	switch {
+	case ip.To4() != nil:
+		network = "udp4"
+	case ip.Equal(net.IPv6unspecified):
+		// "udp" with an unspecified address accepts both IPv4 and IPv6
+		network = "udp"
+	}
+
+	udpConn, err := net.ListenUDP(network, &net.UDPAddr{IP: ip, Port: port})
+	if err != nil {
+		return nil, newPipeError(errorBind, fmt.Errorf("failed to listen on UDP: %w", err))
+	}
+	return udpConn, nil
+}
+
 // udptlspipeStop stops a running udptlspipe client.
 // Parameters:
 //   - handle: the handle ID returned by udptlspipeStart
@@ -198,6 +332,72 @@ func udptlspipeGetLocalPort(handle C.int) C.int {
 	return C.int(h.localPort)
 }
 
+// udptlspipeGetStats returns traffic and health statistics for a running
+// client as a JSON object.
+// Parameters:
+//   - handle: the handle ID returned by udptlspipeStart
+//
+// Returns: JSON string (caller should free this), or NULL if handle is invalid
+//
+//export udptlspipeGetStats
+func udptlspipeGetStats(handle C.int) *C.char {
+	h := lookupHandle(handle)
+	if h == nil {
+		return nil
+	}
+
+	data, err := h.stats.marshalJSON()
+	if err != nil {
+		return nil
+	}
+	return C.CString(string(data))
+}
+
+// udptlspipeGetError returns the last error of a handle, if any.
+// Parameters:
+//   - handle: the handle ID returned by udptlspipeStart
+//
+// Returns: error message (caller should free this), or NULL if there's no error
+// or the handle is invalid
+//
+//export udptlspipeGetError
+func udptlspipeGetError(handle C.int) *C.char {
+	h := lookupHandle(handle)
+	if h == nil {
+		return nil
+	}
+	err := h.getError()
+	if err == nil {
+		return nil
+	}
+	return C.CString(err.Error())
+}
+
+// udptlspipeGetErrorCode returns the UDPTLSPIPE_ERROR_* code of the last
+// error of a handle.
+// Parameters:
+//   - handle: the handle ID returned by udptlspipeStart
+//
+// Returns: error code, or 0 if there's no error or the handle is invalid
+//
+//export udptlspipeGetErrorCode
+func udptlspipeGetErrorCode(handle C.int) C.int {
+	h := lookupHandle(handle)
+	if h == nil {
+		return 0
+	}
+	return C.int(errorCode(h.getError()))
+}
+
+// udptlspipeClearError clears the last error of a handle.
+//
+//export udptlspipeClearError
+func udptlspipeClearError(handle C.int) {
+	if h := lookupHandle(handle); h != nil {
+		h.setError(nil)
+	}
+}
+
 //export udptlspipeVersion
 func udptlspipeVersion() *C.char {
 	return C.CString("1.3.1")
@@ -205,7 +405,8 @@ func udptlspipeVersion() *C.char {
 
 // udptlspipeResetFingerprint resets the cached randomized fingerprint pair.
 // This should be called when reconnecting to get a fresh fingerprint.
-// Only useful when using the "randomized" fingerprint profile.
+// Only useful when using the "randomized" fingerprint profile with the
+// "process" fingerprint policy.
 //
 //export udptlspipeResetFingerprint
 func udptlspipeResetFingerprint() {
@@ -252,5 +453,3 @@ func udptlspipeGetLastError() *C.char {
 func udptlspipeClearLastError() {
 	setLastError(nil)
 }
-
-func main() {}
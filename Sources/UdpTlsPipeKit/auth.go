@@ -0,0 +1,115 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2024 AmneziaWG. All Rights Reserved.
+ */
+
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// In HMAC mode the client offers two WebSocket subprotocols: authSubprotocol,
+// which the server selects, and a token proving knowledge of the password:
+//
+//	base64url(timestamp || nonce || HMAC-SHA256(password, authTokenLabel || timestamp || nonce))
+//
+// The timestamp is in Unix seconds (8 bytes, big endian) and the nonce is
+// random. Unlike the legacy "?password=" query, the token doesn't reveal the
+// password, and the server only accepts it once and only for a short time.
+
+// authMode selects how the client authenticates to the server
+type authMode string
+
+const (
+	// authQuery sends the password in the URL query, as older servers expect
+	authQuery authMode = "query"
+	// authHMAC sends a single-use token derived from the password
+	authHMAC authMode = "hmac"
+)
+
+const (
+	authSubprotocol = "udptlspipe-hmac-v1"
+	authTokenLabel  = "udptlspipe auth v1"
+	authNonceSize   = 16
+	authTokenSize   = 8 + authNonceSize + sha256.Size
+	// Maximum difference between the token timestamp and the server clock
+	authMaxSkew = 2 * time.Minute
+)
+
+// newAuthToken creates a fresh token for password
+func newAuthToken(password string, now time.Time) string {
+	token := make([]byte, 8+authNonceSize, authTokenSize)
+	binary.BigEndian.PutUint64(token, uint64(now.Unix()))
+	rand.Read(token[8:]) // never fails since Go 1.24
+	token = append(token, authTokenMAC(password, token)...)
+	return base64.RawURLEncoding.EncodeToString(token)
+}
+
+func authTokenMAC(password string, timestampAndNonce []byte) []byte {
+	mac := hmac.New(sha256.New, []byte(password))
+	mac.Write([]byte(authTokenLabel))
+	mac.Write(timestampAndNonce)
+	return mac.Sum(nil)
+}
+
+// replayGuard verifies tokens and remembers the nonces of accepted ones until
+// they expire, so that each token is accepted at most once.
+type replayGuard struct {
+	mu     sync.Mutex
+	seen   map[[authNonceSize]byte]time.Time // nonce -> expiry
+	pruned time.Time
+}
+
+func newReplayGuard() *replayGuard {
+	return &replayGuard{seen: make(map[[authNonceSize]byte]time.Time)}
+}
+
+// verify checks a token against password and records it as used
+func (g *replayGuard) verify(password, encoded string, now time.Time) error {
+	token, err := base64.RawURLEncoding.DecodeString(encoded)
+	if err != nil || len(token) != authTokenSize {
+		return errors.New("malformed token")
+	}
+
+	body, mac := token[:8+authNonceSize], token[8+authNonceSize:]
+	if !hmac.Equal(mac, authTokenMAC(password, body)) {
+		return errors.New("invalid token")
+	}
+
+	issued := time.Unix(int64(binary.BigEndian.Uint64(body)), 0)
+	if skew := now.Sub(issued); skew > authMaxSkew || skew < -authMaxSkew {
+		return fmt.Errorf("stale token, clock skew %v", skew.Round(time.Second))
+	}
+
+	var nonce [authNonceSize]byte
+	copy(nonce[:], body[8:])
+
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	// A token can't be accepted again once it's stale, so nonces are only
+	// kept until then
+	if now.Sub(g.pruned) > authMaxSkew {
+		for n, expiry := range g.seen {
+			if now.After(expiry) {
+				delete(g.seen, n)
+			}
+		}
+		g.pruned = now
+	}
+
+	if _, ok := g.seen[nonce]; ok {
+		return errors.New("replayed token")
+	}
+	g.seen[nonce] = issued.Add(authMaxSkew)
+	return nil
+}
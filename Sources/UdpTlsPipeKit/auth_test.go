@@ -0,0 +1,90 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2024 AmneziaWG. All Rights Reserved.
+ */
+
+package main
+
+import (
+	"encoding/base64"
+	"testing"
+	"time"
+)
+
+func TestReplayGuard(t *testing.T) {
+	now := time.Unix(1700000000, 0)
+	token := newAuthToken("secret", now)
+	raw, err := base64.RawURLEncoding.DecodeString(token)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name     string
+		password string
+		token    string
+		now      time.Time
+		ok       bool
+	}{
+		{"valid", "secret", token, now, true},
+		{"skew within limit", "secret", token, now.Add(authMaxSkew), true},
+		{"clock behind within limit", "secret", token, now.Add(-authMaxSkew), true},
+		{"stale", "secret", token, now.Add(authMaxSkew + time.Second), false},
+		{"from the future", "secret", token, now.Add(-authMaxSkew - time.Second), false},
+		{"wrong password", "wrong", token, now, false},
+		{"truncated", "secret", base64.RawURLEncoding.EncodeToString(raw[:len(raw)-1]), now, false},
+		{"not base64", "secret", "!" + token[1:], now, false},
+		{"empty", "secret", "", now, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := newReplayGuard().verify(tt.password, tt.token, tt.now)
+			if tt.ok && err != nil {
+				t.Errorf("verify = %v, want nil", err)
+			}
+			if !tt.ok && err == nil {
+				t.Error("verify accepted the token")
+			}
+		})
+	}
+}
+
+func TestReplayGuardReplay(t *testing.T) {
+	now := time.Unix(1700000000, 0)
+	guard := newReplayGuard()
+	token := newAuthToken("secret", now)
+
+	if err := guard.verify("secret", token, now); err != nil {
+		t.Fatalf("first use: %v", err)
+	}
+	if err := guard.verify("secret", token, now.Add(time.Second)); err == nil {
+		t.Error("replayed token accepted")
+	}
+	// A token with a fresh nonce is still accepted
+	if err := guard.verify("secret", newAuthToken("secret", now), now.Add(time.Second)); err != nil {
+		t.Errorf("fresh token: %v", err)
+	}
+}
+
+func TestReplayGuardPrune(t *testing.T) {
+	now := time.Unix(1700000000, 0)
+	guard := newReplayGuard()
+	for range 3 {
+		if err := guard.verify("secret", newAuthToken("secret", now), now); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if len(guard.seen) != 3 {
+		t.Fatalf("%d nonces remembered, want 3", len(guard.seen))
+	}
+
+	// Once the tokens are stale, their nonces are forgotten on the next
+	// verification
+	later := now.Add(2*authMaxSkew + time.Second)
+	if err := guard.verify("secret", newAuthToken("secret", later), later); err != nil {
+		t.Fatal(err)
+	}
+	if len(guard.seen) != 1 {
+		t.Errorf("%d nonces remembered after expiry, want 1", len(guard.seen))
+	}
+}
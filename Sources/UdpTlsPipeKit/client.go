@@ -7,12 +7,15 @@ package main
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"io"
+	"math/rand/v2"
 	"net"
-	"net/http"
 	"net/url"
+	"strconv"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/gorilla/websocket"
@@ -20,63 +23,69 @@ import (
 )
 
 const (
-	// WebSocket path used by udptlspipe (root path to match reference implementation)
-	wsPath = "/"
+	// Default WebSocket path (root path to match reference implementation)
+	defaultWSPath = "/"
 	// Buffer size for UDP packets
 	bufferSize = 65535
 	// Dial timeout for connections
 	dialTimeout = 30 * time.Second
 	// Write timeout for WebSocket
 	writeTimeout = 10 * time.Second
-	// Ping interval for WebSocket keepalive
-	pingInterval = 30 * time.Second
+	// Default ping interval for WebSocket keepalive
+	defaultPingInterval = 30 * time.Second
+	// Default time a pong may take before its ping counts as missed
+	defaultPongTimeout = 10 * time.Second
+	// Default number of missed pongs in a row after which the connection is
+	// considered dead
+	defaultMaxMissedPongs = 3
+	// Initial delay before reconnecting a dropped session
+	reconnectBaseDelay = 500 * time.Millisecond
+	// Upper bound for the reconnect delay
+	reconnectMaxDelay = 30 * time.Second
+	// Consecutive failed attempts after which a session gives up
+	maxReconnectAttempts = 10
+	// Maximum time a datagram may wait in the send queue while reconnecting
+	sendHoldTimeout = 10 * time.Second
+	// Sessions without traffic in either direction for this long are closed
+	sessionIdleTimeout = 3 * time.Minute
+	// How often idle sessions are looked for
+	sessionJanitorInterval = 15 * time.Second
+	// Maximum number of concurrent sessions per handle
+	maxSessions = 64
 )
 
-// runUdpTlsPipeClient runs the udptlspipe client that listens for UDP packets
-// and forwards them over a TLS WebSocket connection to the server.
+// runUdpTlsPipeClient runs the udptlspipe client that reads UDP packets from
+// the already bound udpConn and forwards them over a TLS WebSocket connection
+// to the server. It takes ownership of udpConn and closes it on return.
+// cfg must have been validated.
 func runUdpTlsPipeClient(
 	ctx context.Context,
-	listenAddr string,
-	destination string,
-	password string,
-	tlsServerName string,
-	secure bool,
-	proxyURL string,
-	fingerprintProfile string,
+	udpConn *net.UDPConn,
+	cfg *pipeConfig,
+	stats *pipeStats,
+	events EventSink,
 	logger CLogger,
 ) error {
-	// Parse destination to get host for TLS
-	destHost, _, err := net.SplitHostPort(destination)
-	if err != nil {
-		return fmt.Errorf("invalid destination address: %w", err)
-	}
-
-	// Use provided TLS server name or destination host
-	serverName := tlsServerName
-	if serverName == "" {
-		serverName = destHost
-	}
-
-	// Start UDP listener
-	udpAddr, err := net.ResolveUDPAddr("udp", listenAddr)
-	if err != nil {
-		return fmt.Errorf("failed to resolve UDP address: %w", err)
-	}
-
-	udpConn, err := net.ListenUDP("udp", udpAddr)
-	if err != nil {
-		return fmt.Errorf("failed to listen on UDP: %w", err)
-	}
 	defer udpConn.Close()
 
-	logger.Printf("udptlspipe: UDP listener started on %s (fingerprint: %s)", listenAddr, fingerprintProfile)
+	logger.Printf("udptlspipe: UDP listener started on %s (fingerprint: %s)", udpConn.LocalAddr(), cfg.FingerprintProfile)
 
-	// Track client sessions (one WebSocket per UDP client)
+	// Track client sessions (one per UDP client)
 	sessions := &sessionManager{
-		sessions: make(map[string]*clientSession),
-		logger:   logger,
+		sessions:    make(map[string]*clientSession),
+		idleTimeout: cfg.idleTimeout,
+		maxSessions: cfg.MaxSessions,
+		events:      events,
+		logger:      logger,
 	}
 	defer sessions.closeAll()
+	go sessions.janitor(ctx)
+
+	// With multiplexing, sessions share a connection as flows of it
+	var mux *muxClient
+	if cfg.Multiplex {
+		mux = newMuxClient(ctx, cfg, stats, events, logger)
+	}
 
 	// Create a channel for stopping
 	done := make(chan struct{})
@@ -104,24 +113,16 @@ func runUdpTlsPipeClient(
 			if ctx.Err() != nil {
 				return nil
 			}
+			if errors.Is(err, net.ErrClosed) {
+				return newPipeError(errorBind, fmt.Errorf("UDP listener closed: %w", err))
+			}
 			logger.Printf("udptlspipe: UDP read error: %v", err)
 			continue
 		}
 
 		// Get or create session for this client
 		session := sessions.getOrCreate(clientAddr.String(), func() *clientSession {
-			return newClientSession(
-				ctx,
-				clientAddr,
-				udpConn,
-				destination,
-				serverName,
-				password,
-				secure,
-				proxyURL,
-				fingerprintProfile,
-				logger,
-			)
+			return newClientSession(ctx, clientAddr, udpConn, cfg, mux, stats, events, logger)
 		})
 
 		if session == nil {
@@ -137,9 +138,12 @@ func runUdpTlsPipeClient(
 
 // sessionManager manages multiple client sessions
 type sessionManager struct {
-	mu       sync.RWMutex
-	sessions map[string]*clientSession
-	logger   CLogger
+	mu          sync.RWMutex
+	sessions    map[string]*clientSession
+	idleTimeout time.Duration
+	maxSessions int
+	events      EventSink
+	logger      CLogger
 }
 
 func (m *sessionManager) getOrCreate(key string, create func() *clientSession) *clientSession {
@@ -160,6 +164,10 @@ func (m *sessionManager) getOrCreate(key string, create func() *clientSession) *
 		return session
 	}
 
+	if !ok && len(m.sessions) >= m.maxSessions {
+		m.evictLeastRecentLocked()
+	}
+
 	// Create new session
 	session = create()
 	if session != nil {
@@ -168,6 +176,75 @@ func (m *sessionManager) getOrCreate(key string, create func() *clientSession) *
 	return session
 }
 
+// janitor periodically closes and evicts sessions that saw no traffic for
+// idleTimeout, along with sessions that gave up reconnecting. Without it a
+// WireGuard source port change would leave the old WebSocket open until the
+// handle is stopped.
+func (m *sessionManager) janitor(ctx context.Context) {
+	ticker := time.NewTicker(sessionJanitorInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			m.reapIdleSessions()
+		}
+	}
+}
+
+func (m *sessionManager) reapIdleSessions() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for key, session := range m.sessions {
+		if !session.isAlive() {
+			delete(m.sessions, key)
+			continue
+		}
+		if idle := session.idleFor(); idle >= m.idleTimeout {
+			m.reapLocked(key, session, reapIdle)
+		}
+	}
+}
+
+// evictLeastRecentLocked makes room for a new session by removing a dead
+// session, or else the one that has been idle for the longest time.
+func (m *sessionManager) evictLeastRecentLocked() {
+	var victimKey string
+	var victim *clientSession
+	for key, session := range m.sessions {
+		if !session.isAlive() {
+			delete(m.sessions, key)
+			return
+		}
+		if victim == nil || session.idleFor() > victim.idleFor() {
+			victimKey, victim = key, session
+		}
+	}
+	if victim != nil {
+		m.reapLocked(victimKey, victim, reapSessionLimit)
+	}
+}
+
+// reapLocked closes and removes a live session, reporting why
+func (m *sessionManager) reapLocked(key string, session *clientSession, reason int) {
+	idle := session.idleFor()
+	session.close()
+	delete(m.sessions, key)
+
+	if reason == reapSessionLimit {
+		m.logger.Printf("udptlspipe: Session limit of %d reached, closed session for %s (idle %v)", m.maxSessions, key, idle.Round(time.Second))
+	} else {
+		m.logger.Printf("udptlspipe: Reaped idle session for %s (idle %v)", key, idle.Round(time.Second))
+	}
+	m.events.Emit(eventSessionReaped, reason, map[string]interface{}{
+		"client":       key,
+		"idle_seconds": int(idle.Seconds()),
+	})
+}
+
 func (m *sessionManager) closeAll() {
 	m.mu.Lock()
 	defer m.mu.Unlock()
@@ -178,239 +255,794 @@ func (m *sessionManager) closeAll() {
 	m.sessions = make(map[string]*clientSession)
 }
 
-// clientSession represents a single UDP client's WebSocket connection
+// transport carries the datagrams of a session to the server
+type transport interface {
+	// waitUp blocks until a connection is available, or returns false once
+	// ctx is done
+	waitUp(ctx context.Context) bool
+	// write sends one datagram
+	write(data []byte) error
+}
+
+// clientSession represents a single UDP client. Its datagrams go over a
+// WebSocket connection of its own or, when multiplexing, over a flow of the
+// connection shared by all sessions of the handle. The session survives
+// connection loss: the connection is redialed with backoff and the send queue
+// is kept, so datagrams queued during a reconnect are not lost.
 type clientSession struct {
-	ctx                context.Context
-	cancel             context.CancelFunc
-	clientAddr         *net.UDPAddr
-	udpConn            *net.UDPConn
-	wsConn             *websocket.Conn
-	wsMu               sync.Mutex
-	sendCh             chan []byte
-	logger             CLogger
-	alive              bool
-	aliveMu            sync.RWMutex
-	fingerprintProfile string
+	ctx        context.Context
+	cancel     context.CancelFunc
+	clientAddr *net.UDPAddr
+	udpConn    *net.UDPConn
+	queue      *sendQueue
+	logger     CLogger
+	alive      bool
+	aliveMu    sync.RWMutex
+	cfg        *pipeConfig
+	mux        *muxClient // nil unless multiplexing is enabled
+	stats      *pipeStats
+	events     EventSink
+	lastActive atomic.Int64 // unix nanoseconds of the last datagram in either direction
 }
 
 func newClientSession(
 	parentCtx context.Context,
 	clientAddr *net.UDPAddr,
 	udpConn *net.UDPConn,
-	destination string,
-	serverName string,
-	password string,
-	secure bool,
-	proxyURL string,
-	fingerprintProfile string,
+	cfg *pipeConfig,
+	mux *muxClient,
+	stats *pipeStats,
+	events EventSink,
 	logger CLogger,
 ) *clientSession {
 	ctx, cancel := context.WithCancel(parentCtx)
 
 	session := &clientSession{
-		ctx:                ctx,
-		cancel:             cancel,
-		clientAddr:         clientAddr,
-		udpConn:            udpConn,
-		sendCh:             make(chan []byte, 256),
-		logger:             logger,
-		alive:              true,
-		fingerprintProfile: fingerprintProfile,
+		ctx:        ctx,
+		cancel:     cancel,
+		clientAddr: clientAddr,
+		udpConn:    udpConn,
+		logger:     logger,
+		alive:      true,
+		cfg:        cfg,
+		mux:        mux,
+		stats:      stats,
+		events:     events,
 	}
+	session.queue = newSendQueue(cfg.DropPolicy, func(packet queuedPacket) {
+		stats.addDropped(packet.class)
+		logger.Printf("udptlspipe: Send queue full, dropping packet")
+	})
+	session.touch()
+	stats.sessions.Add(1)
 
 	// Connect to server in a goroutine
-	go session.run(destination, serverName, password, secure, proxyURL)
+	go session.run()
 
 	return session
 }
 
-func (s *clientSession) run(destination, serverName, password string, secure bool, proxyURL string) {
+func (s *clientSession) run() {
 	defer func() {
 		s.aliveMu.Lock()
 		s.alive = false
 		s.aliveMu.Unlock()
 		s.cancel()
+		s.stats.sessions.Add(-1)
 	}()
 
-	// Build WebSocket URL
-	wsURL := fmt.Sprintf("wss://%s%s", destination, wsPath)
-	if password != "" {
-		wsURL = fmt.Sprintf("%s?password=%s", wsURL, url.QueryEscape(password))
+	if s.mux != nil {
+		if flow := s.mux.attach(s); flow != nil {
+			defer s.mux.detach(flow)
+			go s.writer(flow)
+			select {
+			case <-s.ctx.Done():
+			case <-flow.done:
+			}
+			return
+		}
+		// The server can't multiplex, use a connection of our own
 	}
 
-	// Get the fingerprint profile's ClientHelloID and User-Agent (always in sync)
-	clientHelloID, userAgent := GetFingerprintPair(s.fingerprintProfile)
+	conn := newConnection(s.ctx, s.cfg, s.clientAddr.String(), s.deliver, s.stats, s.events, s.logger, nil)
+	go s.writer(conn)
+	conn.run()
+}
 
-	s.logger.Printf("udptlspipe: Using fingerprint profile: %s (ClientHello: %s)", s.fingerprintProfile, clientHelloID.Str())
+// deliver passes a datagram received from the server to the UDP client
+func (s *clientSession) deliver(data []byte) {
+	if _, err := s.udpConn.WriteToUDP(data, s.clientAddr); err != nil {
+		s.logger.Printf("udptlspipe: UDP write error: %v", err)
+		return
+	}
+	s.touch()
+	s.stats.addReceived(len(data))
+}
+
+// writer drains the send queue into t for the lifetime of the session. While
+// t has no connection, datagrams stay queued.
+func (s *clientSession) writer(t transport) {
+	stale := 0
+	for {
+		if !t.waitUp(s.ctx) {
+			return
+		}
+
+		packet, ok := s.queue.pop(s.ctx)
+		if !ok {
+			return
+		}
 
-	// Create custom dialer with utls support
+		// Don't flush datagrams that sat in the queue through a long reconnect
+		if time.Since(packet.queuedAt) > sendHoldTimeout {
+			stale++
+			s.stats.addDropped(packet.class)
+			continue
+		}
+		if stale > 0 {
+			s.logger.Printf("udptlspipe: Discarded %d packets queued longer than %v", stale, sendHoldTimeout)
+			stale = 0
+		}
+
+		if err := t.write(packet.data); err != nil {
+			if errors.Is(err, errDatagramTooLarge) {
+				s.stats.oversizeDropped.Add(1)
+				continue
+			}
+			// The connection dropped since waitUp, the datagram is lost
+			s.stats.addDropped(packet.class)
+			if !errors.Is(err, errLinkDown) {
+				s.logger.Printf("udptlspipe: WebSocket write error: %v", err)
+			}
+			continue
+		}
+		s.stats.addSent(len(packet.data))
+	}
+}
+
+func (s *clientSession) send(data []byte) {
+	s.touch()
+	s.queue.push(queuedPacket{data: data, class: classifyPacket(data), queuedAt: time.Now()})
+}
+
+// touch marks the session as active for idle expiry
+func (s *clientSession) touch() {
+	s.lastActive.Store(time.Now().UnixNano())
+}
+
+// idleFor returns how long the session has been without traffic
+func (s *clientSession) idleFor() time.Duration {
+	return time.Duration(time.Now().UnixNano() - s.lastActive.Load())
+}
+
+func (s *clientSession) isAlive() bool {
+	s.aliveMu.RLock()
+	defer s.aliveMu.RUnlock()
+	return s.alive
+}
+
+// close stops the session, closing its connection if it has its own
+func (s *clientSession) close() {
+	s.cancel()
+}
+
+// errLinkDown is returned when writing to a link that has no connection
+var errLinkDown = errors.New("not connected")
+
+// wsLink is a WebSocket connection to the server that is redialed with
+// backoff when it drops, until too many attempts in a row fail.
+type wsLink struct {
+	ctx    context.Context
+	cancel context.CancelFunc
+	cfg    *pipeConfig
+	// label names the user of the link in logs and events: the address of the
+	// UDP client, or muxLabel for the shared multiplexed connection
+	label string
+	// offerMux offers the multiplexing subprotocol to the server
+	offerMux bool
+	// stripeSession is the ID of the stripeSet the link is a stripe of,
+	// empty if it isn't one
+	stripeSession string
+	// onConnect, if set, vets each new connection before it's used; an error
+	// closes the link for good
+	onConnect func(conn *websocket.Conn) error
+	// deliver is called with each datagram received from the server
+	deliver func(data []byte)
+	// onStateChange, if set, is called when the connection goes up or down
+	onStateChange func(up bool)
+	stats         *pipeStats
+	events        EventSink
+	logger        CLogger
+
+	mu   sync.Mutex
+	conn *websocket.Conn
+	frag *fragmenter   // framing agreed on for conn
+	up   chan struct{} // closed while conn is set
+	// lastWrite is the time a message was last sent on conn
+	lastWrite time.Time
+}
+
+func newWSLink(parentCtx context.Context, cfg *pipeConfig, label string, deliver func([]byte), stats *pipeStats, events EventSink, logger CLogger) *wsLink {
+	ctx, cancel := context.WithCancel(parentCtx)
+	return &wsLink{
+		ctx:     ctx,
+		cancel:  cancel,
+		cfg:     cfg,
+		label:   label,
+		deliver: deliver,
+		stats:   stats,
+		events:  events,
+		logger:  logger,
+		up:      make(chan struct{}),
+	}
+}
+
+// run keeps the link connected until it's closed or gives up reconnecting
+func (l *wsLink) run() {
+	defer l.cancel()
+	keepConnected(l.ctx, l.cfg, l.stats, l.logger, l.connectAndServe)
+}
+
+// keepConnected calls connectAndServe again and again, with backoff, until
+// ctx is done or too many attempts in a row fail to connect. connectAndServe
+// reports whether it was connected.
+func keepConnected(ctx context.Context, cfg *pipeConfig, stats *pipeStats, logger CLogger, connectAndServe func(attempt int) bool) {
+	failures := 0
+	for {
+		connected := connectAndServe(failures + 1)
+		if ctx.Err() != nil {
+			return
+		}
+
+		if connected {
+			failures = 0
+		} else {
+			failures++
+		}
+		if failures >= maxReconnectAttempts {
+			logger.Printf("udptlspipe: Giving up on %s after %d failed attempts", cfg.Destination, failures)
+			return
+		}
+
+		stats.reconnects.Add(1)
+		delay := reconnectDelay(failures + 1)
+		logger.Printf("udptlspipe: Reconnecting to %s in %v (attempt %d/%d)", cfg.Destination, delay, failures+1, maxReconnectAttempts)
+
+		timer := time.NewTimer(delay)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return
+		case <-timer.C:
+		}
+	}
+}
+
+// connectAndServe dials the server once and relays traffic until the
+// connection fails or the link is closed. It reports whether the WebSocket
+// connection was established.
+func (l *wsLink) connectAndServe(attempt int) bool {
+	cfg := l.cfg
+
+	// Build WebSocket URL, and authenticate with either the password in the
+	// query or a single-use token offered as a subprotocol
+	wsURL := *cfg.wsURL
+	var subprotocols []string
+	if l.offerMux {
+		subprotocols = append(subprotocols, muxSubprotocol)
+	}
+	switch {
+	case cfg.Password == "":
+	case cfg.AuthMode == authHMAC:
+		subprotocols = append(subprotocols, authSubprotocol, newAuthToken(cfg.Password, time.Now()))
+	default:
+		query := wsURL.Query()
+		query.Set("password", cfg.Password)
+		wsURL.RawQuery = query.Encode()
+	}
+	// Fragmentation and striping come after the token, which servers from
+	// before them take to be the first subprotocol they don't know
+	if l.offerMux {
+		subprotocols = append(subprotocols, muxFragmentSubprotocol)
+	}
+	subprotocols = append(subprotocols, fragmentSubprotocol)
+	if l.stripeSession != "" {
+		subprotocols = append(subprotocols, stripeSubprotocolPrefix+l.stripeSession)
+	}
+
+	// Get the fingerprint profile's ClientHelloID and User-Agent (always in
+	// sync), as picked for this connection
+	clientHelloID, userAgent := cfg.fingerprints.pick(l.logger)
+
+	l.logger.Printf("udptlspipe: Using fingerprint profile: %s (ClientHello: %s)", cfg.FingerprintProfile, clientHelloID.Str())
+
+	// Create custom dialer with utls support. A proxy, if any, is handled by
+	// dialTLSWithFingerprint so that the uTLS ClientHello goes through it.
 	dialer := websocket.Dialer{
 		HandshakeTimeout: dialTimeout,
+		Subprotocols:     subprotocols,
 		NetDialTLSContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
-			return dialTLSWithFingerprint(ctx, network, addr, serverName, secure, clientHelloID, s.logger)
+			echConfigList, err := cfg.ech.configList(ctx, offersTLS13(cfg.profiles, clientHelloID), l.logger)
+			if err != nil {
+				return nil, err
+			}
+			opts := dialOptions{
+				serverName:    cfg.serverName,
+				trust:         cfg.trust,
+				proxy:         cfg.proxy,
+				clientHelloID: clientHelloID,
+				profiles:      cfg.profiles,
+				alpn:          cfg.alpnProtocols(),
+				sessions:      cfg.utlsSessions(l.logger),
+				echConfigList: echConfigList,
+				label:         l.label,
+				stats:         l.stats,
+				events:        l.events,
+				logger:        l.logger,
+			}
+			conn, err := dialTLSWithFingerprint(ctx, network, addr, opts)
+			if retryList, retry := cfg.ech.rejected(err, echConfigList, cfg.trust, l.logger); retry {
+				opts.echConfigList = retryList
+				conn, err = dialTLSWithFingerprint(ctx, network, addr, opts)
+			}
+			if err != nil {
+				return nil, err
+			}
+
+			// Speak whatever the server selected from what we offered
+			switch protocol := conn.ConnectionState().NegotiatedProtocol; {
+			case protocol == alpnHTTP2:
+				l.logger.Printf("udptlspipe: Server selected HTTP/2, opening the WebSocket with extended CONNECT")
+				h2Conn, err := newH2ClientConn(conn, func() {
+					cfg.h2Refused.Store(true)
+				})
+				if err != nil {
+					conn.Close()
+					return nil, err
+				}
+				return h2Conn, nil
+			case cfg.HTTPVersion == httpVersion2:
+				conn.Close()
+				return nil, newPipeError(errorConnect, fmt.Errorf("server selected %q instead of h2", protocol))
+			}
+			return newHeaderOrderConn(conn, headerOrderFor(clientHelloID)), nil
 		},
 	}
 
-	// Configure proxy if specified
-	if proxyURL != "" {
-		proxyURLParsed, err := url.Parse(proxyURL)
-		if err == nil {
-			dialer.Proxy = http.ProxyURL(proxyURLParsed)
-		} else {
-			s.logger.Printf("udptlspipe: Invalid proxy URL: %v", err)
+	l.logger.Printf("udptlspipe: Connecting to %s (SNI: %s, UA: %s, attempt %d)", cfg.Destination, cfg.serverName, userAgent, attempt)
+	l.events.Emit(eventConnecting, 0, map[string]interface{}{
+		"client":      l.label,
+		"destination": cfg.Destination,
+		"attempt":     attempt,
+	})
+
+	// Connect to WebSocket server. A User-Agent from the configuration
+	// replaces the profile's.
+	headers := cfg.header.Clone()
+	if headers.Get("User-Agent") == "" {
+		headers.Set("User-Agent", userAgent)
+	}
+	l.stats.setFingerprint(clientHelloID.Str(), headers.Get("User-Agent"))
+
+	conn, resp, err := dialer.DialContext(l.ctx, wsURL.String(), headers)
+	if err != nil {
+		if l.ctx.Err() == nil {
+			err = classifyDialError(err, resp)
+			l.events.ReportError(err)
+			l.stats.handshakeFailures.Add(1)
+			l.logger.Printf("udptlspipe: Failed to connect (attempt %d): %v", attempt, err)
+			l.emitDisconnected(disconnectDialFailed, err)
 		}
+		return false
 	}
 
-	s.logger.Printf("udptlspipe: Connecting to %s (SNI: %s, UA: %s)", destination, serverName, userAgent)
+	// Only fragments keep datagrams within the sizes a padding policy other
+	// than uniform hides
+	if cfg.PaddingPolicy != paddingUniform && !fragmentsWith(conn.Subprotocol()) {
+		conn.Close()
+		err := newPipeError(errorConnect, fmt.Errorf("server doesn't support fragmentation, which padding_policy %q needs", cfg.PaddingPolicy))
+		l.events.ReportError(err)
+		l.logger.Printf("udptlspipe: Failed to connect (attempt %d): %v", attempt, err)
+		l.emitDisconnected(disconnectDialFailed, err)
+		return false
+	}
 
-	// Connect to WebSocket server
-	headers := http.Header{}
-	headers.Set("User-Agent", userAgent)
+	if l.onConnect != nil {
+		if err := l.onConnect(conn); err != nil {
+			conn.Close()
+			l.cancel()
+			l.emitDisconnected(disconnectClosed, nil)
+			return true
+		}
+	}
 
-	conn, _, err := dialer.DialContext(s.ctx, wsURL, headers)
-	if err != nil {
-		s.logger.Printf("udptlspipe: Failed to connect: %v", err)
-		return
+	frag := newFragmenter(fragmentsWith(conn.Subprotocol()))
+	frag.bodyLimit = cfg.padder.bodyLimit()
+	frag.onIncomplete = func() {
+		l.stats.reassemblyFailures.Add(1)
 	}
-	defer conn.Close()
 
-	s.wsMu.Lock()
-	s.wsConn = conn
-	s.wsMu.Unlock()
+	// Closing the link closes the connection, which ends the read loop below
+	connCtx, connCancel := context.WithCancel(l.ctx)
+	context.AfterFunc(connCtx, func() {
+		conn.Close()
+	})
+	l.stats.connectionUp()
+	defer func() {
+		l.mu.Lock()
+		l.conn = nil
+		l.frag = nil
+		l.up = make(chan struct{})
+		l.mu.Unlock()
+		connCancel()
+		l.stats.connectionDown()
+		if l.onStateChange != nil {
+			l.onStateChange(false)
+		}
+	}()
 
-	s.logger.Printf("udptlspipe: Connected to %s", destination)
+	// A connection that stalls so badly that pings can't even be written
+	// still fails reads once nothing arrived for longer than the pinger
+	// waits for pongs
+	readTimeout := cfg.pingInterval * time.Duration(cfg.MaxMissedPongs+1)
+	conn.SetReadDeadline(time.Now().Add(readTimeout))
 
-	// Start writer goroutine
-	go s.writer()
+	// Pings carry their send time, so the echoed pong yields the round-trip
+	// time and tells which ping it answers
+	var lastPong atomic.Int64 // send time of the latest ping answered
+	conn.SetPongHandler(func(appData string) error {
+		conn.SetReadDeadline(time.Now().Add(readTimeout))
+		if sentAt, err := strconv.ParseInt(appData, 10, 64); err == nil {
+			l.stats.lastRTT.Store(time.Now().UnixNano() - sentAt)
+			lastPong.Store(sentAt)
+		}
+		return nil
+	})
 
-	// Start ping goroutine
-	go s.pinger()
+	l.mu.Lock()
+	l.conn = conn
+	l.frag = frag
+	close(l.up)
+	l.mu.Unlock()
+	if l.onStateChange != nil {
+		l.onStateChange(true)
+	}
 
-	// Read from WebSocket and send to UDP client
-	for {
-		select {
-		case <-s.ctx.Done():
-			return
-		default:
-		}
+	l.logger.Printf("udptlspipe: Connected to %s (attempt %d, fragmentation: %t)", cfg.Destination, attempt, frag.enabled)
+	l.events.Emit(eventWebSocketUp, 0, map[string]interface{}{
+		"client":      l.label,
+		"destination": cfg.Destination,
+	})
 
+	// Start ping goroutine, which closes the connection if it goes dead
+	var dead atomic.Bool
+	go l.pinger(connCtx, conn, &lastPong, func() {
+		dead.Store(true)
+		connCancel()
+	})
+	if cfg.chaffInterval > 0 {
+		go l.chaffer(connCtx, cfg.chaffInterval)
+	}
+
+	// Read from WebSocket and hand the datagrams over
+	for {
 		_, framedData, err := conn.ReadMessage()
 		if err != nil {
-			if s.ctx.Err() == nil && err != io.EOF {
-				s.logger.Printf("udptlspipe: WebSocket read error: %v", err)
+			reason, cause := l.disconnectReason(err, dead.Load())
+			if reason == disconnectReadError {
+				l.logger.Printf("udptlspipe: WebSocket read error: %v", err)
 			}
-			return
+			l.emitDisconnected(reason, cause)
+			return true
 		}
 
 		// Unpack the message to extract the original UDP data
-		data, err := unpackMessage(framedData)
+		body, err := unpackMessage(framedData)
 		if err != nil {
-			s.logger.Printf("udptlspipe: Failed to unpack message: %v", err)
+			l.logger.Printf("udptlspipe: Failed to unpack message: %v", err)
 			continue
 		}
-
-		_, err = s.udpConn.WriteToUDP(data, s.clientAddr)
-		if err != nil {
-			s.logger.Printf("udptlspipe: UDP write error: %v", err)
+		if len(body) == 0 {
+			// Chaff
+			continue
+		}
+		data, ok, err := frag.join(body, time.Now())
+		switch {
+		case errors.Is(err, errDatagramTooLarge):
+			l.stats.oversizeDropped.Add(1)
+			continue
+		case err != nil:
+			l.logger.Printf("udptlspipe: Failed to reassemble message: %v", err)
+			continue
+		case ok:
+			l.deliver(data)
 		}
 	}
 }
 
-// dialTLSWithFingerprint creates a TLS connection with the specified fingerprint profile
-func dialTLSWithFingerprint(ctx context.Context, network, addr, serverName string, secure bool, clientHelloID tls.ClientHelloID, logger CLogger) (net.Conn, error) {
-	// Create a TCP connection first
-	dialer := &net.Dialer{
-		Timeout: dialTimeout,
+// disconnectReason returns the disconnect* reason code for a connection whose
+// reads failed with err, and the error to report with it. dead tells whether
+// the pinger gave up on the connection.
+func (l *wsLink) disconnectReason(err error, dead bool) (int, error) {
+	switch {
+	case l.ctx.Err() != nil:
+		return disconnectClosed, nil
+	case dead || isTimeout(err):
+		return disconnectPingTimeout, newPipeError(errorConnect, errNoPong)
+	case err == io.EOF || websocket.IsCloseError(err, websocket.CloseNormalClosure, websocket.CloseGoingAway):
+		return disconnectRemoteClosed, err
+	default:
+		return disconnectReadError, err
 	}
+}
 
-	tcpConn, err := dialer.DialContext(ctx, network, addr)
+// emitDisconnected reports the end of a connection (or connection attempt)
+// with one of the disconnect* reason codes.
+func (l *wsLink) emitDisconnected(reason int, err error) {
+	detail := map[string]interface{}{
+		"client": l.label,
+	}
 	if err != nil {
-		return nil, fmt.Errorf("failed to dial TCP: %w", err)
+		detail["error"] = err.Error()
+		detail["error_code"] = int(errorCode(err))
 	}
+	l.events.Emit(eventDisconnected, reason, detail)
+}
 
-	// Create utls config
-	tlsConfig := &tls.Config{
-		ServerName:         serverName,
-		InsecureSkipVerify: !secure,
+// waitUp blocks until the link is connected. It returns false once ctx is
+// done or the link has stopped.
+func (l *wsLink) waitUp(ctx context.Context) bool {
+	l.mu.Lock()
+	up := l.up
+	l.mu.Unlock()
+
+	select {
+	case <-up:
+		return true
+	case <-ctx.Done():
+		return false
+	case <-l.ctx.Done():
+		return false
 	}
+}
 
-	// Create utls client with the specified fingerprint
-	tlsConn := tls.UClient(tcpConn, tlsConfig, clientHelloID)
+func (l *wsLink) isUp() bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.conn != nil
+}
 
-	// Perform the TLS handshake
-	if err := tlsConn.HandshakeContext(ctx); err != nil {
-		tcpConn.Close()
-		return nil, fmt.Errorf("TLS handshake failed: %w", err)
+func (l *wsLink) write(data []byte) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.conn == nil {
+		return errLinkDown
 	}
 
-	logger.Printf("udptlspipe: TLS handshake completed with fingerprint %s", clientHelloID.Str())
+	bodies, err := l.frag.split(data)
+	if err != nil {
+		return err
+	}
+	// Pack the messages with length-prefix framing before sending
+	for _, body := range bodies {
+		l.conn.SetWriteDeadline(time.Now().Add(writeTimeout))
+		if err := l.conn.WriteMessage(websocket.BinaryMessage, packMessage(body, l.cfg.padder)); err != nil {
+			return err
+		}
+	}
+	l.lastWrite = time.Now()
+	return nil
+}
 
-	return tlsConn, nil
+// errNoPong is the reason a connection is closed after missing pongs
+var errNoPong = errors.New("server stopped answering pings")
+
+// isTimeout reports whether err comes from a missed deadline
+func isTimeout(err error) bool {
+	var netErr net.Error
+	return errors.As(err, &netErr) && netErr.Timeout()
 }
 
-func (s *clientSession) writer() {
+// pinger pings the server over conn every ping interval. A ping counts as
+// missed if lastPong doesn't reach its send time within the pong timeout;
+// after MaxMissedPongs in a row, the connection is considered dead and pinger
+// calls dead to close it. Pings are control messages, which don't wait for
+// l.mu, so a write that blocks there can't hold them up.
+func (l *wsLink) pinger(ctx context.Context, conn *websocket.Conn, lastPong *atomic.Int64, dead func()) {
+	cfg := l.cfg
+	timer := time.NewTimer(cfg.pingInterval)
+	defer timer.Stop()
+
+	missed := 0
 	for {
 		select {
-		case <-s.ctx.Done():
+		case <-ctx.Done():
 			return
-		case data := <-s.sendCh:
-			s.wsMu.Lock()
-			if s.wsConn != nil {
-				// Pack the message with length-prefix framing before sending
-				framedData := packMessage(data)
-				s.wsConn.SetWriteDeadline(time.Now().Add(writeTimeout))
-				err := s.wsConn.WriteMessage(websocket.BinaryMessage, framedData)
-				if err != nil {
-					s.logger.Printf("udptlspipe: WebSocket write error: %v", err)
-				}
+		case <-timer.C:
+		}
+
+		sentAt := time.Now().UnixNano()
+		payload := strconv.FormatInt(sentAt, 10)
+		if err := conn.WriteControl(websocket.PingMessage, []byte(payload), time.Now().Add(writeTimeout)); err != nil {
+			l.logger.Printf("udptlspipe: Ping error: %v", err)
+		}
+
+		timer.Reset(cfg.pongTimeout)
+		select {
+		case <-ctx.Done():
+			return
+		case <-timer.C:
+		}
+
+		if lastPong.Load() >= sentAt {
+			missed = 0
+		} else {
+			missed++
+			l.stats.missedPongs.Add(1)
+			l.logger.Printf("udptlspipe: No pong within %v (%d/%d)", cfg.pongTimeout, missed, cfg.MaxMissedPongs)
+			if missed >= cfg.MaxMissedPongs {
+				l.logger.Printf("udptlspipe: Connection to %s is dead, reconnecting", cfg.Destination)
+				dead()
+				return
 			}
-			s.wsMu.Unlock()
 		}
+		timer.Reset(cfg.pingInterval - cfg.pongTimeout)
 	}
 }
 
-func (s *clientSession) pinger() {
-	ticker := time.NewTicker(pingInterval)
-	defer ticker.Stop()
+// chaffer sends chaff whenever nothing was sent for interval
+func (l *wsLink) chaffer(ctx context.Context, interval time.Duration) {
+	timer := time.NewTimer(interval)
+	defer timer.Stop()
 
 	for {
 		select {
-		case <-s.ctx.Done():
+		case <-ctx.Done():
 			return
-		case <-ticker.C:
-			s.wsMu.Lock()
-			if s.wsConn != nil {
-				s.wsConn.SetWriteDeadline(time.Now().Add(writeTimeout))
-				err := s.wsConn.WriteMessage(websocket.PingMessage, nil)
-				if err != nil {
-					s.logger.Printf("udptlspipe: Ping error: %v", err)
-				}
+		case <-timer.C:
+		}
+
+		l.mu.Lock()
+		wait := interval - time.Since(l.lastWrite)
+		if wait <= 0 && l.conn != nil {
+			l.conn.SetWriteDeadline(time.Now().Add(writeTimeout))
+			if err := l.conn.WriteMessage(websocket.BinaryMessage, packMessage(nil, l.cfg.padder)); err != nil {
+				l.logger.Printf("udptlspipe: Chaff error: %v", err)
 			}
-			s.wsMu.Unlock()
+			l.lastWrite = time.Now()
+			wait = interval
 		}
+		l.mu.Unlock()
+		timer.Reset(wait)
 	}
 }
 
-func (s *clientSession) send(data []byte) {
-	select {
-	case s.sendCh <- data:
-	default:
-		// Channel full, drop packet
-		s.logger.Printf("udptlspipe: Send channel full, dropping packet")
+// close stops the link and closes its connection
+func (l *wsLink) close() {
+	l.cancel()
+}
+
+// reconnectDelay returns the jittered exponential backoff delay to wait
+// before the given reconnect attempt (1-based).
+func reconnectDelay(attempt int) time.Duration {
+	delay := reconnectBaseDelay
+	for i := 1; i < attempt && delay < reconnectMaxDelay; i++ {
+		delay *= 2
 	}
+	if delay > reconnectMaxDelay {
+		delay = reconnectMaxDelay
+	}
+	// Pick a random delay in [delay/2, delay] so that sessions dropped by the
+	// same network change don't reconnect in lockstep.
+	return delay/2 + rand.N(delay/2+1)
 }
 
-func (s *clientSession) isAlive() bool {
-	s.aliveMu.RLock()
-	defer s.aliveMu.RUnlock()
-	return s.alive
+// dialOptions are the settings of dialTLSWithFingerprint
+type dialOptions struct {
+	serverName string
+	trust      *tlsTrust
+	// proxy, if not nil, is the proxy the connection is tunneled through
+	proxy *url.URL
+	// clientHelloID is the fingerprint profile, which may be one of profiles
+	clientHelloID tls.ClientHelloID
+	profiles      customProfileSet
+	// alpn, if not nil, replaces the ALPN protocols of the profile
+	alpn []string
+	// sessions, if not nil, is where sessions are resumed from and saved to
+	sessions tls.ClientSessionCache
+	// echConfigList, if not nil, is what the ClientHello is encrypted to,
+	// and the handshake then fails rather than go without ECH
+	echConfigList []byte
+	// label identifies the link in events
+	label  string
+	stats  *pipeStats
+	events EventSink
+	logger CLogger
 }
 
-func (s *clientSession) close() {
-	s.cancel()
-	s.wsMu.Lock()
-	if s.wsConn != nil {
-		s.wsConn.Close()
+// dialTLSWithFingerprint creates a TLS connection to addr with the
+// fingerprint profile and the other settings of opts.
+func dialTLSWithFingerprint(ctx context.Context, network, addr string, opts dialOptions) (*tls.UConn, error) {
+	// Create a TCP connection first, tunneled through the proxy if there is one
+	tcpConn, err := dialTCP(ctx, network, addr, opts.proxy, opts.trust.proxyRoots)
+	if err != nil {
+		return nil, err
+	}
+
+	// uTLS builds the inner ClientHello of ECH without the pre_shared_key
+	// extension, so it can't resume; a ticket in the outer one would only
+	// link the connections
+	if opts.echConfigList != nil {
+		opts.sessions = nil
+	}
+
+	// Create utls config
+	tlsConfig := &tls.Config{
+		ServerName:         opts.serverName,
+		ClientSessionCache: opts.sessions,
+		// Only send the pre_shared_key extension with a session to resume, and
+		// do full handshakes with profiles that lack the extensions to resume
+		OmitEmptyPsk:                       true,
+		PreferSkipResumptionOnNilExtension: true,
+	}
+	opts.trust.apply(tlsConfig)
+	var publicName string
+	if opts.echConfigList != nil {
+		if publicName, err = parseECHConfigList(opts.echConfigList); err != nil {
+			tcpConn.Close()
+			return nil, newPipeError(errorTLS, fmt.Errorf("invalid ECH configuration: %w", err))
+		}
+		tlsConfig.EncryptedClientHelloConfigList = opts.echConfigList
+		// uTLS calls this before it has the certificates, which are checked
+		// below once the handshake ends in a rejection
+		tlsConfig.EncryptedClientHelloRejectionVerify = func(tls.ConnectionState) error { return nil }
+	}
+
+	// Create utls client with the specified fingerprint
+	spec, err := opts.profiles.clientHelloSpec(opts.clientHelloID)
+	if err != nil {
+		tcpConn.Close()
+		return nil, newPipeError(errorTLS, fmt.Errorf("failed to build ClientHello: %w", err))
+	}
+	if opts.alpn != nil {
+		setALPN(&spec, opts.alpn)
 	}
-	s.wsMu.Unlock()
+	if opts.echConfigList != nil {
+		addECHExtension(&spec)
+	}
+	if opts.sessions != nil {
+		addPSKExtension(&spec)
+	}
+	tlsConn := tls.UClient(tcpConn, tlsConfig, tls.HelloCustom)
+	if err := tlsConn.ApplyPreset(&spec); err != nil {
+		tcpConn.Close()
+		return nil, newPipeError(errorTLS, fmt.Errorf("failed to build ClientHello: %w", err))
+	}
+
+	// Perform the TLS handshake
+	if err := tlsConn.HandshakeContext(ctx); err != nil {
+		tcpConn.Close()
+		var rejection *tls.ECHRejectionError
+		if errors.As(err, &rejection) {
+			if verifyErr := opts.trust.verifyECHRejection(tlsConn.ConnectionState().PeerCertificates, publicName); verifyErr != nil {
+				err = verifyErr
+			}
+		}
+		return nil, newPipeError(errorTLS, fmt.Errorf("TLS handshake failed: %w", err))
+	}
+
+	state := tlsConn.ConnectionState()
+	opts.logger.Printf("udptlspipe: TLS handshake completed with fingerprint %s (resumed: %t, ECH: %t)", opts.clientHelloID.Str(), state.DidResume, state.ECHAccepted)
+	if opts.sessions != nil {
+		opts.stats.addResumption(state.DidResume)
+	}
+	opts.events.Emit(eventTLSHandshake, 0, map[string]interface{}{
+		"client":  opts.label,
+		"version": tls.VersionName(state.Version),
+		"alpn":    state.NegotiatedProtocol,
+		"resumed": state.DidResume,
+		"ech":     state.ECHAccepted,
+	})
+
+	return tlsConn, nil
 }
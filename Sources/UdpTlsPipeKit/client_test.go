@@ -0,0 +1,103 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2024 AmneziaWG. All Rights Reserved.
+ */
+
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+
+	"github.com/gorilla/websocket"
+)
+
+// TestPingTimeout connects to a server that never answers pings, which the
+// link must give up on after max_missed_pongs and reconnect to.
+func TestPingTimeout(t *testing.T) {
+	done := make(chan struct{})
+	upgrades := make(chan struct{}, 8)
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		upgrader := websocket.Upgrader{}
+		conn, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		upgrades <- struct{}{}
+		// gorilla/websocket only answers pings while reading
+		<-done
+	}))
+	t.Cleanup(func() {
+		close(done)
+		server.Close()
+	})
+
+	cfg, err := parseConfig(fmt.Sprintf(`{"destination": %q, "fingerprint_profile": "chrome", "ping_interval_seconds": 0.2, "pong_timeout_seconds": 0.1, "max_missed_pongs": 2}`, server.Listener.Addr()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	stats := newPipeStats(1)
+	link := newWSLink(context.Background(), cfg, "test", func([]byte) {}, stats, EventSink(0), CLogger(0))
+	go link.run()
+	t.Cleanup(link.close)
+
+	<-upgrades
+	eventually(t, "the link is up", link.isUp)
+	// The missed pongs close the connection well before the read deadline of
+	// three ping intervals would
+	eventually(t, "the link gave up on the connection", func() bool {
+		return !link.isUp()
+	})
+	if missed := stats.snapshot().MissedPongs; missed != 2 {
+		t.Errorf("missed_pongs = %d, want 2", missed)
+	}
+	<-upgrades
+	if stats.reconnects.Load() == 0 {
+		t.Error("link didn't reconnect")
+	}
+}
+
+func TestDisconnectReason(t *testing.T) {
+	// What reads fail with once the pinger closed the connection
+	closedErr := fmt.Errorf("read: %w", net.ErrClosed)
+	tests := []struct {
+		name    string
+		err     error
+		dead    bool
+		closed  bool
+		reason  int
+		errCode pipeErrorCode
+	}{
+		{"missed pongs", closedErr, true, false, disconnectPingTimeout, errorConnect},
+		{"read deadline", os.ErrDeadlineExceeded, false, false, disconnectPingTimeout, errorConnect},
+		{"closed by the server", io.EOF, false, false, disconnectRemoteClosed, errorNone},
+		{"close frame", &websocket.CloseError{Code: websocket.CloseGoingAway}, false, false, disconnectRemoteClosed, errorNone},
+		{"read error", errors.New("connection reset"), false, false, disconnectReadError, errorNone},
+		{"link closed", closedErr, true, true, disconnectClosed, errorNone},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			link := newWSLink(context.Background(), &pipeConfig{}, "test", nil, newPipeStats(1), EventSink(0), CLogger(0))
+			if tt.closed {
+				link.close()
+			}
+			reason, cause := link.disconnectReason(tt.err, tt.dead)
+			if reason != tt.reason {
+				t.Errorf("reason = %d, want %d", reason, tt.reason)
+			}
+			if tt.errCode != errorNone {
+				if !errors.Is(cause, errNoPong) || errorCode(cause) != tt.errCode {
+					t.Errorf("cause = %v (code %d), want errNoPong with code %d", cause, errorCode(cause), tt.errCode)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,501 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2024 AmneziaWG. All Rights Reserved.
+ */
+
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// configVersion is the current version of the JSON configuration schema.
+// Fields may be added without bumping it; incompatible changes must bump it.
+const configVersion = 1
+
+// pipeConfig is the configuration of a udptlspipe client, as accepted by
+// udptlspipeStartWithConfig. See udptlspipe.h for the documentation of the
+// JSON fields.
+type pipeConfig struct {
+	Version                  int               `json:"version"`
+	Destination              string            `json:"destination"`
+	Password                 string            `json:"password"`
+	TLSServerName            string            `json:"tls_server_name"`
+	Secure                   bool              `json:"secure"`
+	Proxy                    string            `json:"proxy"`
+	FingerprintProfile       string            `json:"fingerprint_profile"`
+	ListenAddress            string            `json:"listen_address"`
+	ListenPort               int               `json:"listen_port"`
+	PinnedSPKI               []string          `json:"pinned_spki"`
+	CAPEM                    string            `json:"ca_pem"`
+	VerifyName               string            `json:"verify_name"`
+	IdleTimeoutSeconds       float64           `json:"session_idle_timeout_seconds"`
+	PingIntervalSeconds      float64           `json:"ping_interval_seconds"`
+	PongTimeoutSeconds       float64           `json:"pong_timeout_seconds"`
+	MaxMissedPongs           int               `json:"max_missed_pongs"`
+	MaxSessions              int               `json:"max_sessions"`
+	WSPath                   string            `json:"ws_path"`
+	Host                     string            `json:"host"`
+	Headers                  map[string]string `json:"headers"`
+	AuthMode                 authMode          `json:"auth_mode"`
+	Multiplex                bool              `json:"multiplex"`
+	Stripes                  int               `json:"stripes"`
+	StripePolicy             stripePolicy      `json:"stripe_policy"`
+	HTTPVersion              httpVersion       `json:"http_version"`
+	Transport                pipeTransport     `json:"transport"`
+	PaddingPolicy            paddingPolicy     `json:"padding_policy"`
+	PaddingBuckets           []int             `json:"padding_buckets"`
+	ChaffIntervalMs          int               `json:"chaff_interval_ms"`
+	DropPolicy               dropPolicy        `json:"drop_policy"`
+	DisableSessionResumption bool              `json:"disable_session_resumption"`
+	SessionCacheFile         string            `json:"session_cache_file"`
+	ECHMode                  echMode           `json:"ech_mode"`
+	ECHConfigList            string            `json:"ech_config_list"`
+	ECHResolver              string            `json:"ech_resolver"`
+	CustomProfiles           customProfileDefs `json:"custom_profiles"`
+	FingerprintPolicy        fingerprintPolicy `json:"fingerprint_policy"`
+	FingerprintWeights       profileWeights    `json:"fingerprint_weights"`
+	FingerprintStateFile     string            `json:"fingerprint_state_file"`
+
+	// Derived by validate
+	serverName   string
+	wsURL        *url.URL // without credentials
+	header       http.Header
+	proxy        *url.URL
+	trust        *tlsTrust
+	idleTimeout  time.Duration
+	pingInterval time.Duration
+	pongTimeout  time.Duration
+	padder       padder
+	sessions     *sessionStore // nil if session resumption is disabled, set by openStores
+	ech          *echSource    // nil if ECH is off
+	// warnings are logged and reported when the pipe starts
+	warnings []configWarning
+	// profiles are the custom profiles of the handle
+	profiles customProfileSet
+	// fingerprints picks the fingerprint of each connection
+	fingerprints *fingerprintSelector
+	// chaffInterval is the idle time after which chaff is sent, 0 for never
+	chaffInterval time.Duration
+	// h2Refused is set once the server turned out to select h2 without
+	// supporting WebSockets over it; from then on only http/1.1 is offered
+	h2Refused atomic.Bool
+}
+
+// configError reports an invalid configuration field by its JSON name
+func configError(field string, format string, args ...interface{}) error {
+	return newPipeError(errorInvalidConfig, fmt.Errorf("config field %q: %s", field, fmt.Sprintf(format, args...)))
+}
+
+// parseConfig decodes and validates a JSON configuration. Unknown fields are
+// rejected so that typos don't silently fall back to defaults.
+func parseConfig(data string) (*pipeConfig, error) {
+	decoder := json.NewDecoder(strings.NewReader(data))
+	decoder.DisallowUnknownFields()
+
+	cfg := &pipeConfig{}
+	if err := decoder.Decode(cfg); err != nil {
+		var typeErr *json.UnmarshalTypeError
+		switch {
+		case errors.As(err, &typeErr):
+			return nil, configError(typeErr.Field, "expected %s, got %s", typeErr.Type, typeErr.Value)
+		case strings.HasPrefix(err.Error(), "json: unknown field "):
+			field := strings.Trim(strings.TrimPrefix(err.Error(), "json: unknown field "), `"`)
+			return nil, configError(field, "unknown field")
+		default:
+			return nil, newPipeError(errorInvalidConfig, fmt.Errorf("invalid config JSON: %w", err))
+		}
+	}
+	if _, err := decoder.Token(); err != io.EOF {
+		return nil, newPipeError(errorInvalidConfig, errors.New("invalid config JSON: trailing data after object"))
+	}
+
+	if err := cfg.validate(); err != nil {
+		return nil, err
+	}
+	return cfg, nil
+}
+
+// validate checks the configuration, applies defaults and fills in the
+// derived fields other than the stores, see openStores. It must be called
+// before the config is used, and only touches c.
+func (c *pipeConfig) validate() error {
+	switch {
+	case c.Version == 0:
+		c.Version = configVersion
+	case c.Version > configVersion:
+		return configError("version", "unsupported version %d, the latest supported is %d", c.Version, configVersion)
+	case c.Version < 0:
+		return configError("version", "invalid version %d", c.Version)
+	}
+
+	if c.Destination == "" {
+		return configError("destination", "required")
+	}
+	destHost, destPort, err := net.SplitHostPort(c.Destination)
+	if err != nil {
+		return configError("destination", "%v", err)
+	}
+
+	// Use provided TLS server name or destination host
+	c.serverName = c.TLSServerName
+	if c.serverName == "" {
+		c.serverName = destHost
+	}
+
+	c.profiles = make(customProfileSet, len(c.CustomProfiles))
+	for name, def := range c.CustomProfiles {
+		profile, err := newCustomProfile(name, def)
+		if err != nil {
+			return configError("custom_profiles."+name, "%v", err)
+		}
+		c.profiles[name] = profile
+	}
+
+	// Default to okhttp if not specified, or to randomized with a policy
+	switch {
+	case c.FingerprintProfile != "":
+	case c.FingerprintPolicy != "":
+		c.FingerprintProfile = string(ProfileRandomized)
+	default:
+		c.FingerprintProfile = "okhttp"
+	}
+	if !c.profiles.isValid(c.FingerprintProfile) {
+		return configError("fingerprint_profile", "unknown profile %q, expected one of %s, or a custom profile", c.FingerprintProfile, strings.Join(ValidProfiles(), ", "))
+	}
+	if err := c.validateFingerprintPolicy(); err != nil {
+		return err
+	}
+
+	if c.WSPath == "" {
+		c.WSPath = defaultWSPath
+	}
+	if !strings.HasPrefix(c.WSPath, "/") {
+		return configError("ws_path", "%q must start with /", c.WSPath)
+	}
+	if c.wsURL, err = url.Parse("wss://" + c.Destination + c.WSPath); err != nil {
+		return configError("ws_path", "%v", errors.Unwrap(err))
+	}
+
+	if strings.ContainsAny(c.Host, " \t\r\n/") {
+		return configError("host", "%q is not a valid host", c.Host)
+	}
+	c.header = http.Header{}
+	// Without host the destination stays the authority, even with a
+	// tls_server_name of its own, as it always was
+	if c.Host != "" {
+		c.header.Set("Host", c.Host)
+	}
+	for name, value := range c.Headers {
+		if err := validateHeader(name, value); err != nil {
+			return configError("headers."+name, "%v", err)
+		}
+		c.header.Set(name, value)
+	}
+
+	switch c.AuthMode {
+	case "":
+		c.AuthMode = authQuery
+	case authQuery:
+	case authHMAC:
+		if c.Password == "" {
+			return configError("auth_mode", "%q requires a password", c.AuthMode)
+		}
+	default:
+		return configError("auth_mode", "unknown mode %q, expected %q or %q", c.AuthMode, authQuery, authHMAC)
+	}
+
+	switch {
+	case c.Stripes < 0 || c.Stripes > maxStripes:
+		return configError("stripes", "%d is out of range, expected 1 to %d", c.Stripes, maxStripes)
+	case c.Stripes == 0:
+		c.Stripes = 1
+	}
+	switch c.StripePolicy {
+	case "":
+		c.StripePolicy = stripeRoundRobin
+	case stripeRoundRobin, stripeLeastQueued:
+	default:
+		return configError("stripe_policy", "unknown policy %q, expected %q or %q", c.StripePolicy, stripeRoundRobin, stripeLeastQueued)
+	}
+
+	switch c.HTTPVersion {
+	case "":
+		c.HTTPVersion = httpVersionAuto
+	case httpVersionAuto, httpVersion1, httpVersion2:
+	default:
+		return configError("http_version", "unknown version %q, expected %q, %q or %q", c.HTTPVersion, httpVersionAuto, httpVersion1, httpVersion2)
+	}
+
+	switch c.Transport {
+	case "":
+		c.Transport = transportWebSocket
+	case transportWebSocket:
+	case transportQUIC:
+		// A QUIC tunnel carries a single session, over UDP that the proxy can't relay
+		switch {
+		case c.Multiplex:
+			return configError("multiplex", "not supported with transport %q", c.Transport)
+		case c.Stripes > 1:
+			return configError("stripes", "not supported with transport %q", c.Transport)
+		case c.Proxy != "":
+			return configError("proxy", "not supported with transport %q", c.Transport)
+		}
+	default:
+		return configError("transport", "unknown transport %q, expected %q or %q", c.Transport, transportWebSocket, transportQUIC)
+	}
+
+	if c.PaddingPolicy == "" {
+		c.PaddingPolicy = paddingUniform
+	}
+	if len(c.PaddingBuckets) > 0 && c.PaddingPolicy != paddingBucket {
+		return configError("padding_buckets", "only used with padding_policy %q", paddingBucket)
+	}
+	if c.padder, err = newPadder(c.PaddingPolicy, c.PaddingBuckets); err != nil {
+		if len(c.PaddingBuckets) > 0 {
+			return configError("padding_buckets", "%v", err)
+		}
+		return configError("padding_policy", "%v, expected %q, %q, %q or %q", err, paddingUniform, paddingBucket, paddingHTTPS, paddingConstantRate)
+	}
+	switch {
+	case c.ChaffIntervalMs < 0:
+		return configError("chaff_interval_ms", "must not be negative")
+	case c.ChaffIntervalMs > 0 && c.PaddingPolicy != paddingConstantRate:
+		return configError("chaff_interval_ms", "only used with padding_policy %q", paddingConstantRate)
+	case c.PaddingPolicy != paddingConstantRate:
+	case c.Transport == transportQUIC:
+		return configError("padding_policy", "%q not supported with transport %q", c.PaddingPolicy, c.Transport)
+	case c.ChaffIntervalMs == 0:
+		c.chaffInterval = defaultChaffInterval
+	default:
+		c.chaffInterval = time.Duration(c.ChaffIntervalMs) * time.Millisecond
+	}
+
+	switch c.DropPolicy {
+	case "":
+		c.DropPolicy = dropData
+	case dropData, dropNewest, dropOldest:
+	default:
+		return configError("drop_policy", "unknown policy %q, expected %q, %q or %q", c.DropPolicy, dropData, dropNewest, dropOldest)
+	}
+
+	if c.ListenAddress != "" && net.ParseIP(c.ListenAddress) == nil {
+		return configError("listen_address", "%q is not an IP address", c.ListenAddress)
+	}
+	if c.ListenPort < 0 || c.ListenPort > 65535 {
+		return configError("listen_port", "%d is out of range", c.ListenPort)
+	}
+
+	if c.proxy, err = parseProxyURL(c.Proxy); err != nil {
+		return configError("proxy", "%v", errors.Unwrap(err))
+	}
+
+	for i, pin := range c.PinnedSPKI {
+		if _, err := parseSPKIPin(pin); err != nil {
+			return configError(fmt.Sprintf("pinned_spki[%d]", i), "%v", err)
+		}
+	}
+	// With the pins checked, only the CA bundle can be rejected here
+	if c.trust, err = newTLSTrust(c.Secure, c.PinnedSPKI, c.CAPEM, c.VerifyName); err != nil {
+		return configError("ca_pem", "%v", errors.Unwrap(err))
+	}
+
+	if err := c.validateECH(destPort); err != nil {
+		return err
+	}
+
+	if c.DisableSessionResumption && c.SessionCacheFile != "" {
+		return configError("session_cache_file", "not used with disable_session_resumption")
+	}
+
+	switch {
+	case c.IdleTimeoutSeconds < 0:
+		return configError("session_idle_timeout_seconds", "must not be negative")
+	case c.IdleTimeoutSeconds == 0:
+		c.idleTimeout = sessionIdleTimeout
+	default:
+		c.idleTimeout = time.Duration(c.IdleTimeoutSeconds * float64(time.Second))
+	}
+
+	switch {
+	case c.PingIntervalSeconds < 0:
+		return configError("ping_interval_seconds", "must not be negative")
+	case c.PingIntervalSeconds == 0:
+		c.pingInterval = defaultPingInterval
+	default:
+		c.pingInterval = time.Duration(c.PingIntervalSeconds * float64(time.Second))
+	}
+	switch {
+	case c.PongTimeoutSeconds < 0:
+		return configError("pong_timeout_seconds", "must not be negative")
+	case c.PongTimeoutSeconds == 0:
+		c.pongTimeout = min(defaultPongTimeout, c.pingInterval)
+	default:
+		c.pongTimeout = time.Duration(c.PongTimeoutSeconds * float64(time.Second))
+	}
+	if c.pongTimeout > c.pingInterval {
+		return configError("pong_timeout_seconds", "must not exceed the ping interval of %v", c.pingInterval)
+	}
+	switch {
+	case c.MaxMissedPongs < 0:
+		return configError("max_missed_pongs", "must not be negative")
+	case c.MaxMissedPongs == 0:
+		c.MaxMissedPongs = defaultMaxMissedPongs
+	}
+
+	switch {
+	case c.MaxSessions < 0:
+		return configError("max_sessions", "must not be negative")
+	case c.MaxSessions == 0:
+		c.MaxSessions = maxSessions
+	}
+
+	c.warnings = c.frontingWarnings(destHost)
+	return nil
+}
+
+// validateECH checks the ECH fields and sets up the ECH configuration source.
+// It needs the server name and the proxy.
+func (c *pipeConfig) validateECH(destPort string) error {
+	switch c.ECHMode {
+	case "":
+		c.ECHMode = echOff
+	case echOff, echPrefer, echStrict:
+	default:
+		return configError("ech_mode", "unknown mode %q, expected %q, %q or %q", c.ECHMode, echOff, echPrefer, echStrict)
+	}
+
+	switch {
+	case c.ECHMode == echOff && c.ECHConfigList != "":
+		return configError("ech_config_list", "only used with ech_mode %q or %q", echPrefer, echStrict)
+	case c.ECHMode == echOff && c.ECHResolver != "":
+		return configError("ech_resolver", "only used with ech_mode %q or %q", echPrefer, echStrict)
+	case c.ECHMode == echOff:
+		return nil
+	case c.ECHConfigList != "" && c.ECHResolver != "":
+		return configError("ech_resolver", "not used with ech_config_list")
+	case c.ECHConfigList == "" && c.ECHResolver == "":
+		return configError("ech_resolver", "required with ech_mode %q unless ech_config_list is set", c.ECHMode)
+	}
+	switch {
+	case c.Transport == transportQUIC:
+	case c.FingerprintPolicy == fingerprintWeighted:
+		for name := range c.FingerprintWeights {
+			if clientHelloID, _ := c.profiles.fingerprintPair(name); !offersTLS13(c.profiles, clientHelloID) {
+				return configError("fingerprint_weights."+name, "not supported with ech_mode %q, as the profile lacks TLS 1.3", c.ECHMode)
+			}
+		}
+	case FingerprintProfile(strings.ToLower(c.FingerprintProfile)) != ProfileRandomized:
+		if clientHelloID, _ := c.profiles.fingerprintPair(c.FingerprintProfile); !offersTLS13(c.profiles, clientHelloID) {
+			return configError("ech_mode", "not supported with fingerprint_profile %q, which lacks TLS 1.3", c.FingerprintProfile)
+		}
+	}
+
+	var static []byte
+	if c.ECHConfigList != "" {
+		var err error
+		static, err = base64.StdEncoding.DecodeString(c.ECHConfigList)
+		if err != nil {
+			static, err = base64.RawStdEncoding.DecodeString(c.ECHConfigList)
+		}
+		if err != nil {
+			return configError("ech_config_list", "not valid base64")
+		}
+		if _, err := parseECHConfigList(static); err != nil {
+			return configError("ech_config_list", "%v", err)
+		}
+	}
+
+	resolver := c.ECHResolver
+	if strings.HasPrefix(resolver, "https://") {
+		if u, err := url.Parse(resolver); err != nil || u.Host == "" {
+			return configError("ech_resolver", "%q is not a valid DoH URL", resolver)
+		}
+	} else if resolver != "" {
+		// Plain DNS would go around the proxy, and give the server name away
+		if c.proxy != nil {
+			return configError("ech_resolver", "must be a DoH URL with proxy, which plain DNS doesn't go through")
+		}
+		if _, _, err := net.SplitHostPort(resolver); err != nil {
+			resolver = net.JoinHostPort(strings.Trim(resolver, "[]"), "53")
+		}
+		if host, _, _ := net.SplitHostPort(resolver); host == "" || strings.Contains(resolver, "/") {
+			return configError("ech_resolver", "%q is neither a DoH URL nor a DNS server address", c.ECHResolver)
+		}
+	}
+
+	c.ech = newECHSource(c.ECHMode, static, resolver, c.serverName, destPort, c.proxy, c.trust.proxyRoots)
+	return nil
+}
+
+// validateFingerprintPolicy checks the fields that choose how the randomized
+// profile picks fingerprints, and sets up the fingerprint selector. It needs
+// the fingerprint profile, and the custom profiles registered.
+func (c *pipeConfig) validateFingerprintPolicy() error {
+	switch c.FingerprintPolicy {
+	case "":
+		c.FingerprintPolicy = fingerprintPerProcess
+	case fingerprintPerProcess, fingerprintPerConnection, fingerprintPerDestination, fingerprintWeighted:
+		if FingerprintProfile(strings.ToLower(c.FingerprintProfile)) != ProfileRandomized {
+			return configError("fingerprint_policy", "only used with fingerprint_profile %q", ProfileRandomized)
+		}
+	default:
+		return configError("fingerprint_policy", "unknown policy %q, expected %q, %q, %q or %q", c.FingerprintPolicy, fingerprintPerProcess, fingerprintPerConnection, fingerprintPerDestination, fingerprintWeighted)
+	}
+
+	switch {
+	case c.FingerprintPolicy == fingerprintWeighted && len(c.FingerprintWeights) == 0:
+		return configError("fingerprint_weights", "required with fingerprint_policy %q", fingerprintWeighted)
+	case c.FingerprintPolicy != fingerprintWeighted && len(c.FingerprintWeights) > 0:
+		return configError("fingerprint_weights", "only used with fingerprint_policy %q", fingerprintWeighted)
+	case c.FingerprintPolicy != fingerprintPerDestination && c.FingerprintStateFile != "":
+		return configError("fingerprint_state_file", "only used with fingerprint_policy %q", fingerprintPerDestination)
+	}
+
+	weights := make(profileWeights, len(c.FingerprintWeights))
+	for name, weight := range c.FingerprintWeights {
+		profile := strings.ToLower(name)
+		switch {
+		case !c.profiles.isValid(profile) || profile == "" || profile == string(ProfileDefault):
+			return configError("fingerprint_weights."+name, "unknown profile")
+		case profile == string(ProfileRandomized):
+			return configError("fingerprint_weights."+name, "must be a predefined or custom profile other than %q", ProfileRandomized)
+		case weights[profile] != 0:
+			return configError("fingerprint_weights."+name, "profile listed twice")
+		case weight < 1 || weight > maxFingerprintWeight:
+			return configError("fingerprint_weights."+name, "weight %d is out of range, expected 1 to %d", weight, maxFingerprintWeight)
+		}
+		weights[profile] = weight
+	}
+
+	c.fingerprints = newFingerprintSelector(c.FingerprintProfile, c.FingerprintPolicy, c.profiles, weights, nil, c.Destination)
+	return nil
+}
+
+// openStores opens the TLS session store and the fingerprint store the
+// configuration uses, which are shared by handles and may be read from files.
+// It's called once validate succeeded, so that validating has no side effects.
+func (c *pipeConfig) openStores() error {
+	var err error
+	if !c.DisableSessionResumption {
+		if c.sessions, err = openSessionStore(c.SessionCacheFile); err != nil {
+			return configError("session_cache_file", "%v", err)
+		}
+	}
+	if c.FingerprintPolicy == fingerprintPerDestination {
+		if c.fingerprints.store, err = openFingerprintStore(c.FingerprintStateFile); err != nil {
+			return configError("fingerprint_state_file", "%v", err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,55 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2024 AmneziaWG. All Rights Reserved.
+ */
+
+package main
+
+import (
+	"fmt"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// TestOpenStores checks that validating a configuration leaves the shared
+// stores alone, and that openStores opens them once it's valid.
+func TestOpenStores(t *testing.T) {
+	dir := t.TempDir()
+	sessionFile := filepath.Join(dir, "sessions.json")
+	fingerprintFile := filepath.Join(dir, "fingerprints.json")
+	cfg, err := parseConfig(fmt.Sprintf(`{"destination": "server.example:443", "session_cache_file": %q, "fingerprint_policy": "destination", "fingerprint_state_file": %q}`, sessionFile, fingerprintFile))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	sessionStoresMu.Lock()
+	_, sessionsOpened := sessionStores[sessionFile]
+	sessionStoresMu.Unlock()
+	fingerprintStoresMu.Lock()
+	_, fingerprintsOpened := fingerprintStores[fingerprintFile]
+	fingerprintStoresMu.Unlock()
+	if sessionsOpened || fingerprintsOpened || cfg.sessions != nil || cfg.fingerprints.store != nil {
+		t.Fatal("validation opened the stores")
+	}
+
+	if err := cfg.openStores(); err != nil {
+		t.Fatal(err)
+	}
+	if cfg.sessions == nil || cfg.sessions.path != sessionFile {
+		t.Error("session store not opened")
+	}
+	if cfg.fingerprints.store == nil {
+		t.Error("fingerprint store not opened")
+	}
+
+	// A file in a missing directory is only found out when the stores open
+	missing := filepath.Join(dir, "missing", "sessions.json")
+	cfg, err = parseConfig(fmt.Sprintf(`{"destination": "server.example:443", "session_cache_file": %q}`, missing))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := cfg.openStores(); err == nil || errorCode(err) != errorInvalidConfig || !strings.Contains(err.Error(), `"session_cache_file"`) {
+		t.Errorf("openStores = %v, want an error for session_cache_file", err)
+	}
+}
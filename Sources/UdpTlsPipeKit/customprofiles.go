@@ -0,0 +1,206 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2024 AmneziaWG. All Rights Reserved.
+ */
+
+package main
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"slices"
+	"strings"
+
+	tls "github.com/refraction-networking/utls"
+)
+
+// Custom profiles pair a ClientHello with a User-Agent, like the predefined
+// ones, but come from the configuration, so that a fingerprint can follow
+// browser releases without an update. The ClientHello is either a uTLS
+// ClientHelloSpec in JSON (the format of tlsfingerprint.io), or a captured
+// ClientHello in hex, with or without its record header.
+//
+// Custom profiles belong to the handle whose configuration defines them, and
+// can only be selected there, like the predefined ones.
+
+// customProfileVersion prefixes the name of a custom profile in the Version of
+// its ClientHelloID, which tells it apart from the presets
+const customProfileVersion = "custom-"
+
+// customProfileConfig is the definition of a custom profile in the JSON
+// configuration
+type customProfileConfig struct {
+	UserAgent      string          `json:"user_agent"`
+	ClientHello    json.RawMessage `json:"client_hello"`
+	ClientHelloHex string          `json:"client_hello_hex"`
+}
+
+// customProfileDefs are the definitions of custom profiles by name
+type customProfileDefs map[string]customProfileConfig
+
+// customProfileSet are the validated custom profiles of a handle, by name
+type customProfileSet map[string]*customProfile
+
+// customProfile is a validated custom profile
+type customProfile struct {
+	clientHelloID tls.ClientHelloID
+	userAgent     string
+	// spec returns a new copy of the ClientHelloSpec, since uTLS keeps the
+	// state of a connection in its extensions
+	spec func() (tls.ClientHelloSpec, error)
+}
+
+// newCustomProfile validates the definition of the custom profile name
+func newCustomProfile(name string, def customProfileConfig) (*customProfile, error) {
+	if name == "" || strings.Trim(name, "abcdefghijklmnopqrstuvwxyz0123456789-_.") != "" {
+		return nil, errors.New("names may only have lowercase letters, digits, '-', '_' and '.'")
+	}
+	if slices.Contains(ValidProfiles(), name) || name == string(ProfileDefault) {
+		return nil, fmt.Errorf("%q is a predefined profile", name)
+	}
+	if def.UserAgent == "" {
+		return nil, errors.New("user_agent is required")
+	}
+	if strings.ContainsAny(def.UserAgent, "\r\n\x00") {
+		return nil, errors.New("invalid user_agent")
+	}
+
+	profile := &customProfile{
+		clientHelloID: tls.ClientHelloID{Client: imitatedClient(def.UserAgent), Version: customProfileVersion + name},
+		userAgent:     def.UserAgent,
+	}
+	switch {
+	case def.ClientHello != nil && def.ClientHelloHex != "":
+		return nil, errors.New("client_hello and client_hello_hex are mutually exclusive")
+	case def.ClientHello != nil:
+		data := []byte(def.ClientHello)
+		profile.spec = func() (tls.ClientHelloSpec, error) {
+			return parseClientHelloJSON(data)
+		}
+	case def.ClientHelloHex != "":
+		raw, err := decodeClientHelloHex(def.ClientHelloHex)
+		if err != nil {
+			return nil, err
+		}
+		profile.spec = func() (tls.ClientHelloSpec, error) {
+			var spec tls.ClientHelloSpec
+			err := spec.FromRaw(raw, true, true)
+			return spec, err
+		}
+	default:
+		return nil, errors.New("client_hello or client_hello_hex is required")
+	}
+
+	spec, err := profile.spec()
+	if err != nil {
+		return nil, fmt.Errorf("invalid ClientHello: %w", err)
+	}
+	if err := checkClientHelloSpec(spec); err != nil {
+		return nil, fmt.Errorf("unusable ClientHello: %w", err)
+	}
+	return profile, nil
+}
+
+// parseClientHelloJSON decodes a ClientHelloSpec in the JSON format of uTLS,
+// which can't decode one without all of its lists
+func parseClientHelloJSON(data []byte) (tls.ClientHelloSpec, error) {
+	var u tls.ClientHelloSpecJSONUnmarshaler
+	if err := json.Unmarshal(data, &u); err != nil {
+		return tls.ClientHelloSpec{}, err
+	}
+	switch {
+	case u.CipherSuites == nil:
+		return tls.ClientHelloSpec{}, errors.New("cipher_suites is required")
+	case u.CompressionMethods == nil:
+		return tls.ClientHelloSpec{}, errors.New("compression_methods is required")
+	case u.Extensions == nil:
+		return tls.ClientHelloSpec{}, errors.New("extensions is required")
+	}
+	return u.ClientHelloSpec(), nil
+}
+
+// decodeClientHelloHex decodes a captured ClientHello, ignoring whitespace and
+// colons, and adds the record header that uTLS expects if it's missing
+func decodeClientHelloHex(s string) ([]byte, error) {
+	s = strings.Map(func(r rune) rune {
+		if r == ':' || r == ' ' || r == '\t' || r == '\r' || r == '\n' {
+			return -1
+		}
+		return r
+	}, s)
+	raw, err := hex.DecodeString(strings.TrimPrefix(s, "0x"))
+	if err != nil {
+		return nil, errors.New("client_hello_hex is not valid hex")
+	}
+	if len(raw) > 0 && raw[0] == 1 && len(raw) <= 0xffff {
+		// A bare handshake message, of type client_hello
+		raw = append([]byte{22, 3, 1, byte(len(raw) >> 8), byte(len(raw))}, raw...)
+	}
+	return raw, nil
+}
+
+// checkClientHelloSpec checks that spec can be used for the WebSocket, and
+// that uTLS can build a ClientHello from it
+func checkClientHelloSpec(spec tls.ClientHelloSpec) error {
+	if len(spec.CipherSuites) == 0 {
+		return errors.New("no cipher suites")
+	}
+	for _, ext := range spec.Extensions {
+		if alpn, ok := ext.(*tls.ALPNExtension); ok && !slices.Contains(alpn.AlpnProtocols, alpnHTTP1) && !slices.Contains(alpn.AlpnProtocols, alpnHTTP2) {
+			return fmt.Errorf("ALPN offers neither %s nor %s", alpnHTTP1, alpnHTTP2)
+		}
+	}
+
+	client, server := net.Pipe()
+	defer client.Close()
+	defer server.Close()
+	uconn := tls.UClient(client, &tls.Config{ServerName: "example.com"}, tls.HelloCustom)
+	if err := uconn.ApplyPreset(&spec); err != nil {
+		return err
+	}
+	return uconn.BuildHandshakeState()
+}
+
+// imitatedClient returns the ClientHelloID.Client of the browser, or library,
+// that userAgent names, so that headerOrderFor can match it
+func imitatedClient(userAgent string) string {
+	switch {
+	case strings.Contains(userAgent, "Chrome/"):
+		return tls.HelloChrome_Auto.Client
+	case strings.Contains(userAgent, "Firefox/"):
+		return tls.HelloFirefox_Auto.Client
+	case strings.Contains(userAgent, "Safari/"):
+		return tls.HelloSafari_Auto.Client
+	default:
+		return "Custom"
+	}
+}
+
+// isValid is IsValidProfile, including the custom profiles of the handle
+func (set customProfileSet) isValid(profile string) bool {
+	return set[strings.ToLower(profile)] != nil || IsValidProfile(profile)
+}
+
+// fingerprintPair is GetFingerprintPair, including the custom profiles of the
+// handle
+func (set customProfileSet) fingerprintPair(profile string) (tls.ClientHelloID, string) {
+	if custom := set[strings.ToLower(profile)]; custom != nil {
+		return custom.clientHelloID, custom.userAgent
+	}
+	return GetFingerprintPair(profile)
+}
+
+// clientHelloSpec returns the ClientHelloSpec of a preset or custom profile
+func (set customProfileSet) clientHelloSpec(clientHelloID tls.ClientHelloID) (tls.ClientHelloSpec, error) {
+	if name, ok := strings.CutPrefix(clientHelloID.Version, customProfileVersion); ok {
+		profile := set[name]
+		if profile == nil {
+			return tls.ClientHelloSpec{}, fmt.Errorf("unknown custom profile %q", name)
+		}
+		return profile.spec()
+	}
+	return tls.UTLSIdToSpec(clientHelloID)
+}
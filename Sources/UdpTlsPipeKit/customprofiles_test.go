@@ -0,0 +1,87 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2024 AmneziaWG. All Rights Reserved.
+ */
+
+package main
+
+import (
+	"encoding/hex"
+	"fmt"
+	"net"
+	"testing"
+
+	tls "github.com/refraction-networking/utls"
+)
+
+// capturedHello returns the ClientHello that uTLS sends for clientHelloID, as
+// a captured one would be, in hex
+func capturedHello(t *testing.T, clientHelloID tls.ClientHelloID) string {
+	t.Helper()
+	client, server := net.Pipe()
+	defer client.Close()
+	defer server.Close()
+	uconn := tls.UClient(client, &tls.Config{ServerName: "example.com"}, clientHelloID)
+	if err := uconn.BuildHandshakeState(); err != nil {
+		t.Fatal(err)
+	}
+	return hex.EncodeToString(uconn.HandshakeState.Hello.Raw)
+}
+
+// customProfileJSON is a config whose profile "mine" sends the ClientHello of
+// clientHelloID
+func customProfileJSON(t *testing.T, userAgent string, clientHelloID tls.ClientHelloID, extra string) string {
+	t.Helper()
+	return fmt.Sprintf(`{"destination": "server.example:443", "fingerprint_profile": "mine", "custom_profiles": {"mine": {"user_agent": %q, "client_hello_hex": %q}}%s}`,
+		userAgent, capturedHello(t, clientHelloID), extra)
+}
+
+func TestCustomProfilesPerHandle(t *testing.T) {
+	first, err := parseConfig(customProfileJSON(t, "Chrome/1", tls.HelloChrome_120, ""))
+	if err != nil {
+		t.Fatal(err)
+	}
+	second, err := parseConfig(customProfileJSON(t, "Firefox/2", tls.HelloFirefox_120, ""))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Each handle keeps its own definition of the name
+	for _, test := range []struct {
+		cfg       *pipeConfig
+		userAgent string
+		ciphers   int
+	}{
+		{first, "Chrome/1", len(mustSpec(t, tls.HelloChrome_120).CipherSuites)},
+		{second, "Firefox/2", len(mustSpec(t, tls.HelloFirefox_120).CipherSuites)},
+	} {
+		clientHelloID, userAgent := test.cfg.fingerprints.pick(CLogger(0))
+		if userAgent != test.userAgent {
+			t.Errorf("user agent %q, want %q", userAgent, test.userAgent)
+		}
+		spec, err := test.cfg.profiles.clientHelloSpec(clientHelloID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(spec.CipherSuites) != test.ciphers {
+			t.Errorf("%s: %d cipher suites, want %d", test.userAgent, len(spec.CipherSuites), test.ciphers)
+		}
+	}
+
+	// Nor can a handle select a profile that only another one defines
+	if IsValidProfile("mine") {
+		t.Error("custom profile visible outside its handle")
+	}
+	if _, err := parseConfig(`{"destination": "server.example:443", "fingerprint_profile": "mine"}`); err == nil {
+		t.Error("config selecting a custom profile of another handle accepted")
+	}
+}
+
+func mustSpec(t *testing.T, clientHelloID tls.ClientHelloID) tls.ClientHelloSpec {
+	t.Helper()
+	spec, err := tls.UTLSIdToSpec(clientHelloID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return spec
+}
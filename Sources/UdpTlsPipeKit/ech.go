@@ -0,0 +1,524 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2024 AmneziaWG. All Rights Reserved.
+ */
+
+package main
+
+import (
+	"bytes"
+	"context"
+	stdtls "crypto/tls"
+	"crypto/x509"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand/v2"
+	"net"
+	"net/http"
+	"net/url"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	tls "github.com/refraction-networking/utls"
+	"golang.org/x/crypto/cryptobyte"
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+// Encrypted Client Hello hides the server name, and the rest of the
+// ClientHello, from the network: the SNI that is sent in the clear is the
+// public name of the ECH configuration, typically that of a CDN, and the real
+// one is encrypted to the key in the configuration. The configuration comes
+// from the config, or from the ech parameter of the HTTPS record of the
+// server name (RFC 9460), looked up through the configured resolver since the
+// system resolver can't be asked for HTTPS records.
+//
+// A server that can't decrypt the ClientHello completes the handshake as the
+// public name instead and may send fresh configurations, which are retried
+// right away if the certificate for the public name checks out. Whether the
+// pipe may ever fall back to the plaintext SNI is up to the ECH mode.
+
+// echMode selects whether and how strictly ECH is used
+type echMode string
+
+const (
+	// echOff never uses ECH
+	echOff echMode = "off"
+	// echPrefer uses ECH when a configuration is available and the server
+	// accepts it, and falls back to the plaintext SNI for a while otherwise
+	echPrefer echMode = "prefer"
+	// echStrict never connects without ECH
+	echStrict echMode = "strict"
+)
+
+const (
+	// echConfigVersion is the version of the ECHConfigs uTLS supports
+	echConfigVersion = 0xfe0d
+	// typeHTTPS is the HTTPS resource record type, unknown to dnsmessage
+	typeHTTPS dnsmessage.Type = 65
+	// svcParamECH is the key of the ech SvcParam
+	svcParamECH = 5
+	// maxAliasHops is the number of AliasMode records followed in a lookup
+	maxAliasHops = 3
+	// Bounds on the time a looked up configuration is used, whatever its TTL
+	echMinTTL = time.Minute
+	echMaxTTL = 24 * time.Hour
+	// echFallbackPeriod is how long the prefer mode uses the plaintext SNI
+	// after ECH turned out to be unavailable
+	echFallbackPeriod = 10 * time.Minute
+	// dnsUDPSize is the EDNS(0) UDP payload size offered to resolvers
+	dnsUDPSize = 1232
+)
+
+// echSource provides the ECHConfigList for the connections of a handle
+type echSource struct {
+	mode   echMode
+	static []byte // from the config, nil if looked up
+	// resolver is a DoH URL or the address of a DNS server, and name the
+	// owner of the HTTPS record to look up
+	resolver string
+	name     string
+	client   *http.Client // for DoH
+
+	mu      sync.Mutex
+	list    []byte
+	expires time.Time // when list must be looked up again, zero if never
+	// fallbackUntil is the end of the echFallbackPeriod of the prefer mode
+	fallbackUntil time.Time
+	// lookupDone is closed when the lookup in progress ends, nil if none is
+	lookupDone chan struct{}
+}
+
+// newECHSource returns the source of ECH configurations of a handle. DoH
+// lookups go through proxy if it's set, verified against proxyRoots as
+// dialTCP does.
+func newECHSource(mode echMode, static []byte, resolver, serverName, port string, proxy *url.URL, proxyRoots *x509.CertPool) *echSource {
+	s := &echSource{
+		mode:     mode,
+		static:   static,
+		list:     static,
+		resolver: resolver,
+		name:     serverName,
+	}
+	if port != "443" {
+		s.name = "_" + port + "._https." + serverName
+	}
+	if strings.HasPrefix(resolver, "https://") {
+		s.client = &http.Client{
+			Timeout: dialTimeout,
+			Transport: &http.Transport{
+				DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+					return dialTCP(ctx, network, addr, proxy, proxyRoots)
+				},
+				ForceAttemptHTTP2: true,
+			},
+		}
+	}
+	return s
+}
+
+// configList returns the ECHConfigList to connect with. It's nil without ECH,
+// which is only the case with the prefer mode. tls13 tells whether the
+// ClientHello offers TLS 1.3, without which there's no ECH.
+func (s *echSource) configList(ctx context.Context, tls13 bool, logger CLogger) ([]byte, error) {
+	switch {
+	case s == nil:
+		return nil, nil
+	case !tls13 && s.mode == echStrict:
+		return nil, newPipeError(errorTLS, errors.New("ECH needs a fingerprint profile with TLS 1.3"))
+	case !tls13:
+		return nil, nil
+	}
+
+	// Connections wait for a lookup in progress rather than start their own,
+	// but the lock isn't held during it, so that rejected isn't held up
+	s.mu.Lock()
+	for {
+		now := time.Now()
+		if s.mode == echPrefer && now.Before(s.fallbackUntil) {
+			s.mu.Unlock()
+			return nil, nil
+		}
+		if s.list != nil && (s.expires.IsZero() || now.Before(s.expires)) {
+			list := s.list
+			s.mu.Unlock()
+			return list, nil
+		}
+		if s.lookupDone == nil {
+			break
+		}
+		done := s.lookupDone
+		s.mu.Unlock()
+		select {
+		case <-done:
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+		s.mu.Lock()
+	}
+	done := make(chan struct{})
+	s.lookupDone = done
+	s.mu.Unlock()
+
+	list, ttl, err := s.lookup(ctx, s.name, maxAliasHops)
+	if err == nil {
+		_, err = parseECHConfigList(list)
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.lookupDone = nil
+	close(done)
+	now := time.Now()
+	if err != nil {
+		err = fmt.Errorf("ECH configuration lookup for %s failed: %w", s.name, err)
+		if s.mode == echStrict {
+			return nil, newPipeError(errorDNS, err)
+		}
+		logger.Printf("udptlspipe: %v, using the plaintext SNI", err)
+		s.fallbackUntil = now.Add(echFallbackPeriod)
+		return nil, nil
+	}
+
+	s.list = list
+	s.expires = now.Add(min(max(ttl, echMinTTL), echMaxTTL))
+	return list, nil
+}
+
+// rejected takes the error of a connection attempt with list, and tells
+// whether to try again right away and with which ECHConfigList. retry is
+// false unless the server rejected ECH; trust decides whether the retry
+// configurations it sent can be believed.
+func (s *echSource) rejected(err error, list []byte, trust *tlsTrust, logger CLogger) (retryList []byte, retry bool) {
+	var rejection *tls.ECHRejectionError
+	var stdRejection *stdtls.ECHRejectionError
+	var retryConfigs []byte
+	switch {
+	case s == nil || list == nil:
+		return nil, false
+	case errors.As(err, &rejection):
+		retryConfigs = rejection.RetryConfigList
+	case errors.As(err, &stdRejection):
+		retryConfigs = stdRejection.RetryConfigList
+	default:
+		return nil, false
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	// Unless the certificate of the public name was verified, anyone on the
+	// path could have sent the retry configurations
+	if _, parseErr := parseECHConfigList(retryConfigs); parseErr == nil && trust.verifiesChain() && !bytes.Equal(retryConfigs, list) {
+		logger.Printf("udptlspipe: Server rejected ECH, retrying with the configuration it sent")
+		s.list = retryConfigs
+		return retryConfigs, true
+	}
+
+	// Look the configuration up again next time, or go back to the one from
+	// the config
+	s.list, s.expires = s.static, time.Time{}
+	if s.mode == echStrict {
+		return nil, false
+	}
+	logger.Printf("udptlspipe: Server rejected ECH, using the plaintext SNI")
+	s.fallbackUntil = time.Now().Add(echFallbackPeriod)
+	return nil, true
+}
+
+// lookup returns the ECHConfigList from the HTTPS record of name and its TTL,
+// following at most hops AliasMode records
+func (s *echSource) lookup(ctx context.Context, name string, hops int) ([]byte, time.Duration, error) {
+	if s.resolver == "" {
+		return nil, 0, errors.New("no resolver")
+	}
+	qname, err := dnsmessage.NewName(strings.TrimSuffix(name, ".") + ".")
+	if err != nil {
+		return nil, 0, err
+	}
+
+	id := uint16(rand.Uint32())
+	if s.client != nil {
+		// RFC 8484 asks for ID 0, which is friendlier to HTTP caches
+		id = 0
+	}
+	builder := dnsmessage.NewBuilder(nil, dnsmessage.Header{ID: id, RecursionDesired: true})
+	builder.EnableCompression()
+	builder.StartQuestions()
+	builder.Question(dnsmessage.Question{Name: qname, Type: typeHTTPS, Class: dnsmessage.ClassINET})
+	builder.StartAdditionals()
+	var opt dnsmessage.ResourceHeader
+	opt.SetEDNS0(dnsUDPSize, dnsmessage.RCodeSuccess, false)
+	builder.OPTResource(opt, dnsmessage.OPTResource{})
+	query, err := builder.Finish()
+	if err != nil {
+		return nil, 0, err
+	}
+
+	var response []byte
+	if s.client != nil {
+		response, err = s.exchangeDoH(ctx, query)
+	} else {
+		response, err = s.exchangeDNS(ctx, query)
+	}
+	if err != nil {
+		return nil, 0, err
+	}
+
+	list, alias, ttl, err := parseHTTPSResponse(response, id)
+	switch {
+	case err != nil:
+		return nil, 0, err
+	case list != nil:
+		return list, ttl, nil
+	case alias == "" || alias == ".":
+		return nil, 0, fmt.Errorf("no ECH configuration published")
+	case hops == 0:
+		return nil, 0, fmt.Errorf("too many HTTPS aliases")
+	}
+	list, aliasTTL, err := s.lookup(ctx, alias, hops-1)
+	return list, min(ttl, aliasTTL), err
+}
+
+// exchangeDoH sends query to the DoH resolver (RFC 8484)
+func (s *echSource) exchangeDoH(ctx context.Context, query []byte) ([]byte, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, s.resolver, bytes.NewReader(query))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/dns-message")
+	req.Header.Set("Accept", "application/dns-message")
+
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("resolver returned %s", resp.Status)
+	}
+	return io.ReadAll(io.LimitReader(resp.Body, 65535))
+}
+
+// exchangeDNS sends query to the DNS server over UDP, and over TCP if the
+// answer doesn't fit
+func (s *echSource) exchangeDNS(ctx context.Context, query []byte) ([]byte, error) {
+	ctx, cancel := context.WithTimeout(ctx, dialTimeout)
+	defer cancel()
+	var dialer net.Dialer
+
+	conn, err := dialer.DialContext(ctx, "udp", s.resolver)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+	if _, err := conn.Write(query); err != nil {
+		return nil, err
+	}
+	buf := make([]byte, dnsUDPSize)
+	for {
+		n, err := conn.Read(buf)
+		if err != nil {
+			return nil, err
+		}
+		// Skip stray datagrams, such as late answers to earlier queries
+		if n < 12 || !bytes.Equal(buf[:2], query[:2]) {
+			continue
+		}
+		if buf[2]&0x02 == 0 { // not truncated
+			return buf[:n], nil
+		}
+		break
+	}
+
+	tcpConn, err := dialer.DialContext(ctx, "tcp", s.resolver)
+	if err != nil {
+		return nil, err
+	}
+	defer tcpConn.Close()
+	if deadline, ok := ctx.Deadline(); ok {
+		tcpConn.SetDeadline(deadline)
+	}
+	if _, err := tcpConn.Write(binary.BigEndian.AppendUint16(nil, uint16(len(query)))); err != nil {
+		return nil, err
+	}
+	if _, err := tcpConn.Write(query); err != nil {
+		return nil, err
+	}
+	var length [2]byte
+	if _, err := io.ReadFull(tcpConn, length[:]); err != nil {
+		return nil, err
+	}
+	response := make([]byte, binary.BigEndian.Uint16(length[:]))
+	if _, err := io.ReadFull(tcpConn, response); err != nil {
+		return nil, err
+	}
+	return response, nil
+}
+
+// parseHTTPSResponse returns the ECHConfigList of the most preferred
+// ServiceMode HTTPS record with one, or if there are only AliasMode records,
+// the target of the first. ttl is the lowest TTL of the records.
+func parseHTTPSResponse(response []byte, id uint16) (list []byte, alias string, ttl time.Duration, err error) {
+	var parser dnsmessage.Parser
+	header, err := parser.Start(response)
+	switch {
+	case err != nil:
+		return nil, "", 0, err
+	case header.ID != id || !header.Response:
+		return nil, "", 0, errors.New("malformed DNS response")
+	case header.RCode != dnsmessage.RCodeSuccess:
+		return nil, "", 0, fmt.Errorf("resolver returned %v", header.RCode)
+	}
+	if err := parser.SkipAllQuestions(); err != nil {
+		return nil, "", 0, err
+	}
+
+	bestPriority := -1
+	ttl = echMaxTTL
+	for {
+		rh, err := parser.AnswerHeader()
+		if errors.Is(err, dnsmessage.ErrSectionDone) {
+			break
+		}
+		if err != nil {
+			return nil, "", 0, err
+		}
+		if rh.Type != typeHTTPS {
+			if err := parser.SkipAnswer(); err != nil {
+				return nil, "", 0, err
+			}
+			continue
+		}
+		record, err := parser.UnknownResource()
+		if err != nil {
+			return nil, "", 0, err
+		}
+		priority, target, ech, err := parseSVCB(record.Data)
+		if err != nil {
+			return nil, "", 0, err
+		}
+		ttl = min(ttl, time.Duration(rh.TTL)*time.Second)
+
+		switch {
+		case priority == 0:
+			if alias == "" {
+				alias = target
+			}
+		case ech != nil && (bestPriority < 0 || int(priority) < bestPriority):
+			bestPriority = int(priority)
+			list = ech
+		}
+	}
+	return list, alias, ttl, nil
+}
+
+// parseSVCB parses the RDATA of an SVCB or HTTPS record (RFC 9460)
+func parseSVCB(data []byte) (priority uint16, target string, ech []byte, err error) {
+	s := cryptobyte.String(data)
+	if !s.ReadUint16(&priority) {
+		return 0, "", nil, errors.New("malformed HTTPS record")
+	}
+
+	// The target name is never compressed
+	var labels []string
+	for {
+		var label cryptobyte.String
+		if !s.ReadUint8LengthPrefixed(&label) {
+			return 0, "", nil, errors.New("malformed HTTPS record")
+		}
+		if len(label) == 0 {
+			break
+		}
+		labels = append(labels, string(label))
+	}
+	target = strings.Join(labels, ".") + "."
+
+	for !s.Empty() {
+		var key uint16
+		var value cryptobyte.String
+		if !s.ReadUint16(&key) || !s.ReadUint16LengthPrefixed(&value) {
+			return 0, "", nil, errors.New("malformed HTTPS record")
+		}
+		if key == svcParamECH {
+			ech = value
+		}
+	}
+	return priority, target, ech, nil
+}
+
+// parseECHConfigList checks an ECHConfigList and returns the public name of
+// the first configuration of a supported version, which is the one uTLS
+// uses. Configurations of other versions are skipped, as clients must.
+func parseECHConfigList(list []byte) (publicName string, err error) {
+	s := cryptobyte.String(list)
+	var configs cryptobyte.String
+	if !s.ReadUint16LengthPrefixed(&configs) || !s.Empty() {
+		return "", errors.New("malformed ECHConfigList")
+	}
+	for !configs.Empty() {
+		var version uint16
+		var config cryptobyte.String
+		if !configs.ReadUint16(&version) || !configs.ReadUint16LengthPrefixed(&config) {
+			return "", errors.New("malformed ECHConfigList")
+		}
+		if version != echConfigVersion || publicName != "" {
+			continue
+		}
+
+		var configID, maxNameLength uint8
+		var kemID uint16
+		var publicKey, cipherSuites, name cryptobyte.String
+		if !config.ReadUint8(&configID) || !config.ReadUint16(&kemID) ||
+			!config.ReadUint16LengthPrefixed(&publicKey) || !config.ReadUint16LengthPrefixed(&cipherSuites) ||
+			!config.ReadUint8(&maxNameLength) || !config.ReadUint8LengthPrefixed(&name) || len(name) == 0 {
+			return "", errors.New("malformed ECHConfig")
+		}
+		publicName = string(name)
+	}
+	if publicName == "" {
+		return "", fmt.Errorf("no ECHConfig of version %#x", echConfigVersion)
+	}
+	return publicName, nil
+}
+
+// offersTLS13 reports whether the ClientHello of clientHelloID, which may be
+// one of profiles, offers TLS 1.3
+func offersTLS13(profiles customProfileSet, clientHelloID tls.ClientHelloID) bool {
+	spec, err := profiles.clientHelloSpec(clientHelloID)
+	if err != nil {
+		return false
+	}
+	for _, ext := range spec.Extensions {
+		if versions, ok := ext.(*tls.SupportedVersionsExtension); ok {
+			return slices.Contains(versions.Versions, tls.VersionTLS13)
+		}
+	}
+	return false
+}
+
+// addECHExtension makes sure that spec has an encrypted_client_hello
+// extension for uTLS to fill in. The Chrome and Firefox profiles have one;
+// others get a GREASE one, placed before the pre_shared_key extension if
+// there is one.
+func addECHExtension(spec *tls.ClientHelloSpec) {
+	for _, ext := range spec.Extensions {
+		if _, ok := ext.(tls.EncryptedClientHelloExtension); ok {
+			return
+		}
+	}
+
+	at := len(spec.Extensions)
+	if at > 0 {
+		if _, ok := spec.Extensions[at-1].(tls.PreSharedKeyExtension); ok {
+			at--
+		}
+	}
+	spec.Extensions = slices.Insert(spec.Extensions, at, tls.TLSExtension(&tls.GREASEEncryptedClientHelloExtension{}))
+}
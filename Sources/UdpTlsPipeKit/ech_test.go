@@ -0,0 +1,426 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2024 AmneziaWG. All Rights Reserved.
+ */
+
+package main
+
+import (
+	"context"
+	"crypto/ecdh"
+	"crypto/rand"
+	stdtls "crypto/tls"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	tls "github.com/refraction-networking/utls"
+	"golang.org/x/crypto/cryptobyte"
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+// newTestECHKey returns an ECHConfigList with a single X25519 configuration
+// for publicName, and the key a server needs for it
+func newTestECHKey(t *testing.T, id uint8, publicName string, sendAsRetry bool) ([]byte, stdtls.EncryptedClientHelloKey) {
+	t.Helper()
+	key, err := ecdh.X25519().GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var config cryptobyte.Builder
+	config.AddUint16(echConfigVersion)
+	config.AddUint16LengthPrefixed(func(b *cryptobyte.Builder) {
+		b.AddUint8(id)
+		b.AddUint16(0x0020) // DHKEM(X25519, HKDF-SHA256)
+		b.AddUint16LengthPrefixed(func(b *cryptobyte.Builder) {
+			b.AddBytes(key.PublicKey().Bytes())
+		})
+		b.AddUint16LengthPrefixed(func(b *cryptobyte.Builder) {
+			b.AddUint16(0x0001) // HKDF-SHA256
+			b.AddUint16(0x0001) // AES-128-GCM
+		})
+		b.AddUint8(0) // maximum_name_length
+		b.AddUint8LengthPrefixed(func(b *cryptobyte.Builder) {
+			b.AddBytes([]byte(publicName))
+		})
+		b.AddUint16(0) // no extensions
+	})
+	configBytes := config.BytesOrPanic()
+
+	var list cryptobyte.Builder
+	list.AddUint16LengthPrefixed(func(b *cryptobyte.Builder) {
+		b.AddBytes(configBytes)
+	})
+	return list.BytesOrPanic(), stdtls.EncryptedClientHelloKey{
+		Config:      configBytes,
+		PrivateKey:  key.Bytes(),
+		SendAsRetry: sendAsRetry,
+	}
+}
+
+// echTestServer is a TLS server for server.example that accepts ECH with its
+// keys, and answers as public.example otherwise
+type echTestServer struct {
+	addr string
+	ca   *testCert
+}
+
+func startECHServer(t *testing.T, keys ...stdtls.EncryptedClientHelloKey) *echTestServer {
+	ca := newTestCert(t, nil)
+	server := newTestCert(t, ca, "server.example").tlsCertificate()
+	public := newTestCert(t, ca, "public.example").tlsCertificate()
+	config := &stdtls.Config{
+		MinVersion: stdtls.VersionTLS13,
+		GetCertificate: func(hello *stdtls.ClientHelloInfo) (*stdtls.Certificate, error) {
+			if hello.ServerName == "public.example" {
+				return &public, nil
+			}
+			return &server, nil
+		},
+		EncryptedClientHelloKeys: keys,
+	}
+	ln := listenTest(t)
+	serveTest(stdtls.NewListener(ln, config), func(conn net.Conn) {
+		if conn.(*stdtls.Conn).Handshake() == nil {
+			io.Copy(io.Discard, conn)
+		}
+	})
+	return &echTestServer{addr: ln.Addr().String(), ca: ca}
+}
+
+// config parses a configuration for the server with ECH, extra being
+// further JSON fields
+func (s *echTestServer) config(t *testing.T, trusted bool, extra string) *pipeConfig {
+	t.Helper()
+	js := fmt.Sprintf(`{"destination": %q, "tls_server_name": "server.example", "fingerprint_profile": "chrome"`, s.addr)
+	if trusted {
+		js += fmt.Sprintf(`, "ca_pem": %q`, s.ca.pem())
+	}
+	cfg, err := parseConfig(js + ", " + extra + "}")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return cfg
+}
+
+// dialECH connects as a WebSocket link does, retrying once if the ECH source
+// says so, and reports whether ECH was accepted
+func dialECH(cfg *pipeConfig, addr string) (bool, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	clientHelloID, _ := GetFingerprintPair("chrome")
+	dial := func(list []byte) (*tls.UConn, error) {
+		return dialTLSWithFingerprint(ctx, "tcp", addr, dialOptions{
+			serverName:    cfg.serverName,
+			trust:         cfg.trust,
+			clientHelloID: clientHelloID,
+			profiles:      cfg.profiles,
+			alpn:          cfg.alpnProtocols(),
+			echConfigList: list,
+			label:         "test",
+			stats:         newPipeStats(1),
+		})
+	}
+
+	list, err := cfg.ech.configList(ctx, offersTLS13(cfg.profiles, clientHelloID), CLogger(0))
+	if err != nil {
+		return false, err
+	}
+	conn, err := dial(list)
+	if retryList, retry := cfg.ech.rejected(err, list, cfg.trust, CLogger(0)); retry {
+		conn, err = dial(retryList)
+	}
+	if err != nil {
+		return false, err
+	}
+	defer conn.Close()
+	return conn.ConnectionState().ECHAccepted, nil
+}
+
+func TestECHStaticConfig(t *testing.T) {
+	list, key := newTestECHKey(t, 1, "public.example", false)
+	server := startECHServer(t, key)
+
+	for _, mode := range []echMode{echPrefer, echStrict} {
+		cfg := server.config(t, true, fmt.Sprintf(`"ech_mode": %q, "ech_config_list": %q`, mode, base64.StdEncoding.EncodeToString(list)))
+		accepted, err := dialECH(cfg, server.addr)
+		if err != nil || !accepted {
+			t.Errorf("%s: accepted %t, %v", mode, accepted, err)
+		}
+	}
+}
+
+func TestECHRetryConfigs(t *testing.T) {
+	stale, _ := newTestECHKey(t, 1, "public.example", false)
+	_, key := newTestECHKey(t, 2, "public.example", true)
+	server := startECHServer(t, key)
+	staleField := fmt.Sprintf(`"ech_config_list": %q`, base64.StdEncoding.EncodeToString(stale))
+
+	// The retry configurations are used if the certificate of the public
+	// name checks out
+	for _, mode := range []echMode{echPrefer, echStrict} {
+		cfg := server.config(t, true, fmt.Sprintf(`"ech_mode": %q, %s`, mode, staleField))
+		if accepted, err := dialECH(cfg, server.addr); err != nil || !accepted {
+			t.Errorf("%s: accepted %t, %v", mode, accepted, err)
+		}
+		// and kept for the next connections
+		if list, _ := cfg.ech.configList(context.Background(), true, CLogger(0)); string(list) == string(stale) {
+			t.Errorf("%s: retry configurations not kept", mode)
+		}
+	}
+
+	// Without chain verification they can't be trusted: strict fails, and
+	// prefer falls back to the plaintext SNI
+	cfg := server.config(t, false, `"ech_mode": "strict", `+staleField)
+	if _, err := dialECH(cfg, server.addr); errorCode(err) != errorTLS || !strings.Contains(err.Error(), "ECH") {
+		t.Errorf("strict without verification: %v", err)
+	}
+	cfg = server.config(t, false, `"ech_mode": "prefer", `+staleField)
+	if accepted, err := dialECH(cfg, server.addr); err != nil || accepted {
+		t.Errorf("prefer without verification: accepted %t, %v", accepted, err)
+	}
+	if list, _ := cfg.ech.configList(context.Background(), true, CLogger(0)); list != nil {
+		t.Error("prefer doesn't fall back to the plaintext SNI after a rejection")
+	}
+}
+
+func TestECHModes(t *testing.T) {
+	list, key := newTestECHKey(t, 1, "public.example", false)
+	server := startECHServer(t, key)
+	published := startDNSServer(t, dnsmessage.RCodeSuccess, svcbRecord(1, ".", list))
+	missing := startDNSServer(t, dnsmessage.RCodeNameError)
+
+	tests := []struct {
+		mode     echMode
+		resolver string
+		// err is the expected error code, accepted whether ECH is used
+		err      pipeErrorCode
+		accepted bool
+	}{
+		{echStrict, published, errorNone, true},
+		{echPrefer, published, errorNone, true},
+		{echStrict, missing, errorDNS, false},
+		{echPrefer, missing, errorNone, false},
+	}
+	for _, test := range tests {
+		cfg := server.config(t, true, fmt.Sprintf(`"ech_mode": %q, "ech_resolver": %q`, test.mode, test.resolver))
+		accepted, err := dialECH(cfg, server.addr)
+		if errorCode(err) != test.err || accepted != test.accepted {
+			t.Errorf("%s with %s: accepted %t, %v", test.mode, test.resolver, accepted, err)
+		}
+	}
+
+	// A profile without TLS 1.3 can't use ECH
+	strict := newECHSource(echStrict, list, "", "server.example", "443", nil, nil)
+	if _, err := strict.configList(context.Background(), false, CLogger(0)); errorCode(err) != errorTLS {
+		t.Errorf("strict without TLS 1.3: %v", err)
+	}
+	prefer := newECHSource(echPrefer, list, "", "server.example", "443", nil, nil)
+	if got, err := prefer.configList(context.Background(), false, CLogger(0)); got != nil || err != nil {
+		t.Errorf("prefer without TLS 1.3: %x, %v", got, err)
+	}
+}
+
+// svcbRecord returns the RDATA of an HTTPS record
+func svcbRecord(priority uint16, target string, ech []byte) []byte {
+	var b cryptobyte.Builder
+	b.AddUint16(priority)
+	for _, label := range strings.Split(strings.TrimSuffix(target, "."), ".") {
+		if label != "" {
+			b.AddUint8LengthPrefixed(func(b *cryptobyte.Builder) {
+				b.AddBytes([]byte(label))
+			})
+		}
+	}
+	b.AddUint8(0)
+	if ech != nil {
+		b.AddUint16(svcParamECH)
+		b.AddUint16LengthPrefixed(func(b *cryptobyte.Builder) {
+			b.AddBytes(ech)
+		})
+	}
+	return b.BytesOrPanic()
+}
+
+// httpsResponse builds a DNS response to a query for name with id, holding
+// HTTPS records with the given RDATA and TTLs of 300 seconds and up
+func httpsResponse(t *testing.T, id uint16, rcode dnsmessage.RCode, name dnsmessage.Name, records ...[]byte) []byte {
+	t.Helper()
+	builder := dnsmessage.NewBuilder(nil, dnsmessage.Header{ID: id, Response: true, RCode: rcode})
+	builder.StartQuestions()
+	builder.Question(dnsmessage.Question{Name: name, Type: typeHTTPS, Class: dnsmessage.ClassINET})
+	builder.StartAnswers()
+	for i, record := range records {
+		header := dnsmessage.ResourceHeader{Name: name, Type: typeHTTPS, Class: dnsmessage.ClassINET, TTL: 300 + uint32(i)*100}
+		if err := builder.UnknownResource(header, dnsmessage.UnknownResource{Type: typeHTTPS, Data: record}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	response, err := builder.Finish()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return response
+}
+
+// startDNSServer starts a DNS server that answers every query with rcode and
+// HTTPS records with the given RDATA
+func startDNSServer(t *testing.T, rcode dnsmessage.RCode, records ...[]byte) string {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	go func() {
+		buf := make([]byte, dnsUDPSize)
+		for {
+			n, addr, err := conn.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			var parser dnsmessage.Parser
+			header, err := parser.Start(buf[:n])
+			if err != nil {
+				continue
+			}
+			question, err := parser.Question()
+			if err != nil {
+				continue
+			}
+			conn.WriteTo(httpsResponse(t, header.ID, rcode, question.Name, records...), addr)
+		}
+	}()
+	return conn.LocalAddr().String()
+}
+
+func TestParseHTTPSResponse(t *testing.T) {
+	first, _ := newTestECHKey(t, 1, "first.example", false)
+	second, _ := newTestECHKey(t, 2, "second.example", false)
+	name := dnsmessage.MustNewName("server.example.")
+
+	list, alias, ttl, err := parseHTTPSResponse(httpsResponse(t, 7, dnsmessage.RCodeSuccess, name,
+		svcbRecord(0, "alias.example.", nil),
+		svcbRecord(2, ".", second),
+		svcbRecord(1, ".", first),
+		svcbRecord(1, ".", nil),
+	), 7)
+	switch {
+	case err != nil:
+		t.Fatal(err)
+	case string(list) != string(first):
+		t.Errorf("list of the most preferred record not chosen")
+	case alias != "alias.example.":
+		t.Errorf("alias %q", alias)
+	case ttl != 300*time.Second:
+		t.Errorf("TTL %v", ttl)
+	}
+
+	// Only aliases
+	list, alias, _, err = parseHTTPSResponse(httpsResponse(t, 7, dnsmessage.RCodeSuccess, name, svcbRecord(0, "alias.example.", nil)), 7)
+	if err != nil || list != nil || alias != "alias.example." {
+		t.Errorf("alias only: %x, %q, %v", list, alias, err)
+	}
+
+	if _, _, _, err := parseHTTPSResponse(httpsResponse(t, 7, dnsmessage.RCodeSuccess, name), 8); err == nil {
+		t.Error("response with another ID accepted")
+	}
+	if _, _, _, err := parseHTTPSResponse(httpsResponse(t, 7, dnsmessage.RCodeServerFailure, name), 7); err == nil {
+		t.Error("SERVFAIL accepted")
+	}
+	if _, _, _, err := parseHTTPSResponse(httpsResponse(t, 7, dnsmessage.RCodeSuccess, name, []byte{0, 1, 3, 'a'}), 7); err == nil {
+		t.Error("malformed record accepted")
+	}
+}
+
+func TestParseSVCB(t *testing.T) {
+	list, _ := newTestECHKey(t, 1, "public.example", false)
+
+	// Other parameters around the ech one are skipped
+	var b cryptobyte.Builder
+	b.AddUint16(1)
+	b.AddBytes([]byte{3, 'c', 'd', 'n', 7, 'e', 'x', 'a', 'm', 'p', 'l', 'e', 0})
+	b.AddUint16(1) // alpn
+	b.AddUint16LengthPrefixed(func(b *cryptobyte.Builder) {
+		b.AddBytes([]byte{2, 'h', '2'})
+	})
+	b.AddUint16(svcParamECH)
+	b.AddUint16LengthPrefixed(func(b *cryptobyte.Builder) {
+		b.AddBytes(list)
+	})
+	b.AddUint16(6) // ipv6hint
+	b.AddUint16LengthPrefixed(func(b *cryptobyte.Builder) {
+		b.AddBytes(make([]byte, 16))
+	})
+	priority, target, ech, err := parseSVCB(b.BytesOrPanic())
+	if err != nil || priority != 1 || target != "cdn.example." || string(ech) != string(list) {
+		t.Errorf("parseSVCB = %d, %q, %x, %v", priority, target, ech, err)
+	}
+
+	for _, data := range [][]byte{
+		{0},                            // truncated priority
+		{0, 1, 5, 'a'},                 // truncated label
+		{0, 1, 0, 0, 5, 0, 10, 1, 2},   // truncated value
+		{0, 1, 0, 0, 5, 0},             // truncated key
+		{0, 1, 3, 'c', 'd', 'n', 0, 0}, // truncated key after target
+	} {
+		if _, _, _, err := parseSVCB(data); err == nil {
+			t.Errorf("parseSVCB(%x) accepted", data)
+		}
+	}
+}
+
+func TestParseECHConfigList(t *testing.T) {
+	list, key := newTestECHKey(t, 1, "public.example", false)
+	if name, err := parseECHConfigList(list); err != nil || name != "public.example" {
+		t.Errorf("parseECHConfigList = %q, %v", name, err)
+	}
+
+	// Configurations of other versions come first in this list, and are
+	// skipped
+	other := append([]byte{0xfe, 0x0a, 0, 2, 0xaa, 0xbb}, key.Config...)
+	mixed := append([]byte{byte(len(other) >> 8), byte(len(other))}, other...)
+	if name, err := parseECHConfigList(mixed); err != nil || name != "public.example" {
+		t.Errorf("mixed versions: %q, %v", name, err)
+	}
+
+	for what, data := range map[string][]byte{
+		"empty":          {0, 0},
+		"other version":  {0, 6, 0xfe, 0x0a, 0, 2, 0xaa, 0xbb},
+		"truncated":      list[:len(list)-1],
+		"trailing data":  append(list, 0),
+		"no public name": {0, 15, 0xfe, 0x0d, 0, 11, 1, 0, 0x20, 0, 0, 0, 0, 0, 0, 0, 0},
+	} {
+		if _, err := parseECHConfigList(data); err == nil {
+			t.Errorf("%s: accepted", what)
+		}
+	}
+}
+
+func TestValidateECH(t *testing.T) {
+	list, _ := newTestECHKey(t, 1, "public.example", false)
+	field := fmt.Sprintf(`"ech_config_list": %q`, base64.StdEncoding.EncodeToString(list))
+	tests := map[string]string{
+		`"ech_mode": "strict", "fingerprint_profile": "chrome", ` + field:     "",
+		`"ech_mode": "strict", "fingerprint_profile": "Randomized", ` + field: "",
+		`"ech_mode": "strict", "fingerprint_profile": "okhttp", ` + field:     "ech_mode",
+		`"ech_mode": "strict"`:      "ech_resolver",
+		`"ech_config_list": "AAAA"`: "ech_config_list",
+		`"ech_mode": "prefer", "fingerprint_profile": "chrome", "ech_config_list": "!"`:                                                              "ech_config_list",
+		`"ech_mode": "prefer", "fingerprint_profile": "chrome", "ech_resolver": "https://"`:                                                          "ech_resolver",
+		`"ech_mode": "prefer", "fingerprint_profile": "chrome", "ech_resolver": "1.1.1.1", "proxy": "socks5://127.0.0.1:1080"`:                       "ech_resolver",
+		`"ech_mode": "prefer", "fingerprint_profile": "chrome", "ech_resolver": "https://dns.example/dns-query", "proxy": "socks5://127.0.0.1:1080"`: "",
+	}
+	for fields, wantField := range tests {
+		_, err := parseConfig(`{"destination": "server.example:443", ` + fields + `}`)
+		switch {
+		case wantField == "" && err != nil:
+			t.Errorf("%s: %v", fields, err)
+		case wantField != "" && (err == nil || !strings.Contains(err.Error(), `"`+wantField+`"`)):
+			t.Errorf("%s: %v, want an error for %s", fields, err, wantField)
+		}
+	}
+}
@@ -0,0 +1,90 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2024 AmneziaWG. All Rights Reserved.
+ */
+
+package main
+
+import (
+	"errors"
+	"net"
+	"net/http"
+
+	"github.com/gorilla/websocket"
+)
+
+// pipeErrorCode classifies handle errors, see UDPTLSPIPE_ERROR_* in udptlspipe.h
+type pipeErrorCode int
+
+const (
+	errorNone          pipeErrorCode = 0
+	errorInternal      pipeErrorCode = 1
+	errorInvalidConfig pipeErrorCode = 2
+	errorBind          pipeErrorCode = 3
+	errorDNS           pipeErrorCode = 4
+	errorConnect       pipeErrorCode = 5
+	errorTLS           pipeErrorCode = 6
+	errorAuth          pipeErrorCode = 7
+	errorProxy         pipeErrorCode = 8
+)
+
+// pipeError is an error tagged with the code reported to the host app
+type pipeError struct {
+	code pipeErrorCode
+	err  error
+}
+
+func (e *pipeError) Error() string {
+	return e.err.Error()
+}
+
+func (e *pipeError) Unwrap() error {
+	return e.err
+}
+
+// newPipeError tags err with code, or returns nil if err is nil
+func newPipeError(code pipeErrorCode, err error) error {
+	if err == nil {
+		return nil
+	}
+	return &pipeError{code: code, err: err}
+}
+
+// errorCode returns the code of the first pipeError in err's chain, or
+// errorInternal if there is none.
+func errorCode(err error) pipeErrorCode {
+	if err == nil {
+		return errorNone
+	}
+	var pe *pipeError
+	if errors.As(err, &pe) {
+		return pe.code
+	}
+	return errorInternal
+}
+
+// classifyDialError tags an error returned by websocket.Dialer.DialContext.
+// resp is the server's handshake response, if any.
+func classifyDialError(err error, resp *http.Response) error {
+	var pe *pipeError
+	if errors.As(err, &pe) {
+		return err
+	}
+
+	if errors.Is(err, websocket.ErrBadHandshake) && resp != nil &&
+		(resp.StatusCode == http.StatusUnauthorized || resp.StatusCode == http.StatusForbidden) {
+		return newPipeError(errorAuth, err)
+	}
+
+	return newPipeError(netErrorCode(err), err)
+}
+
+// netErrorCode tells name resolution failures apart from other connection
+// failures.
+func netErrorCode(err error) pipeErrorCode {
+	var dnsErr *net.DNSError
+	if errors.As(err, &dnsErr) {
+		return errorDNS
+	}
+	return errorConnect
+}
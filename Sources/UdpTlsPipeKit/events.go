@@ -0,0 +1,95 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2024 AmneziaWG. All Rights Reserved.
+ */
+
+package main
+
+// static void callEvent(void *func, void *ctx, int handle, int event, int code, const char *detail)
+// {
+// 	((void(*)(void *, int, int, int, const char *))func)(ctx, handle, event, code, detail);
+// }
+import "C"
+
+import (
+	"encoding/json"
+	"sync"
+	"unsafe"
+)
+
+// pipeEvent identifies a connection state change, see UDPTLSPIPE_EVENT_* in udptlspipe.h
+type pipeEvent int
+
+const (
+	eventConnecting    pipeEvent = 1
+	eventTLSHandshake  pipeEvent = 2
+	eventWebSocketUp   pipeEvent = 3
+	eventDisconnected  pipeEvent = 4
+	eventListenerError pipeEvent = 5
+	eventSessionReaped pipeEvent = 6
+	eventConfigWarning pipeEvent = 7
+)
+
+// Reason codes for eventDisconnected, see UDPTLSPIPE_DISCONNECT_* in udptlspipe.h
+const (
+	disconnectClosed       = 0
+	disconnectDialFailed   = 1
+	disconnectReadError    = 2
+	disconnectRemoteClosed = 3
+	disconnectPingTimeout  = 4
+)
+
+// Reason codes for eventSessionReaped, see UDPTLSPIPE_REAP_* in udptlspipe.h
+const (
+	reapIdle         = 0
+	reapSessionLimit = 1
+)
+
+var (
+	eventMu   sync.RWMutex
+	eventFunc unsafe.Pointer
+	eventCtx  unsafe.Pointer
+)
+
+// EventSink delivers the events and errors of one handle to the host app.
+// Its value is the handle ID, so several pipes can be told apart.
+type EventSink int32
+
+// ReportError records err as the handle's last error. Errors are also copied
+// to the process-wide last error for older callers.
+func (e EventSink) ReportError(err error) {
+	setLastError(err)
+
+	if h := lookupHandle(C.int(e)); h != nil {
+		h.setError(err)
+	}
+}
+
+// Emit reports an event with an event-specific code and a detail object that
+// is passed to the callback as JSON. The callback is called without eventMu
+// held, so that it may register another one.
+func (e EventSink) Emit(event pipeEvent, code int, detail map[string]interface{}) {
+	eventMu.RLock()
+	fn, ctx := eventFunc, eventCtx
+	eventMu.RUnlock()
+	if uintptr(fn) == 0 {
+		return
+	}
+
+	data, err := json.Marshal(detail)
+	if err != nil {
+		data = []byte("{}")
+	}
+	C.callEvent(fn, ctx, C.int(e), C.int(event), C.int(code), cstring(string(data)))
+}
+
+// udptlspipeSetEventCallback registers the callback that receives connection
+// state changes of all handles. Pass NULL to unregister.
+//
+//export udptlspipeSetEventCallback
+func udptlspipeSetEventCallback(context unsafe.Pointer, callbackFn unsafe.Pointer) {
+	eventMu.Lock()
+	defer eventMu.Unlock()
+	eventCtx = context
+	eventFunc = callbackFn
+}
@@ -0,0 +1,221 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2024 AmneziaWG. All Rights Reserved.
+ */
+
+package main
+
+import (
+	"crypto/rand"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"math/big"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+
+	tls "github.com/refraction-networking/utls"
+)
+
+// The "randomized" profile picks its fingerprint at random, and the policy of
+// a handle decides how long a pick lasts: for the whole process, shared by all
+// handles as it always was; for a single connection; for a destination, kept
+// across restarts if a file is given, so that a server keeps seeing the same
+// client; or for the handle, picked from weighted profiles of the user.
+// Handles with any other profile always use that profile.
+
+// fingerprintPolicy selects how the randomized profile picks fingerprints
+type fingerprintPolicy string
+
+const (
+	// fingerprintPerProcess shares one pick between all handles until
+	// udptlspipeResetFingerprint is called
+	fingerprintPerProcess fingerprintPolicy = "process"
+	// fingerprintPerConnection picks again for each connection
+	fingerprintPerConnection fingerprintPolicy = "connection"
+	// fingerprintPerDestination keeps one pick per destination
+	fingerprintPerDestination fingerprintPolicy = "destination"
+	// fingerprintWeighted picks one of fingerprint_weights for the handle
+	fingerprintWeighted fingerprintPolicy = "weighted"
+)
+
+const (
+	// fingerprintFileVersion is the version of the fingerprint state file
+	// format
+	fingerprintFileVersion = 1
+	// maxFingerprintWeight is the largest weight of a profile
+	maxFingerprintWeight = 1000000
+)
+
+// profileWeights are the relative chances of profiles, by name
+type profileWeights map[string]int
+
+// fingerprintSelector picks the fingerprint of each connection of a handle
+type fingerprintSelector struct {
+	profile     string
+	policy      fingerprintPolicy
+	profiles    customProfileSet
+	weights     profileWeights    // lowercase names, for fingerprintWeighted
+	store       *fingerprintStore // for fingerprintPerDestination, set by openStores
+	destination string
+
+	// weighted is the profile picked for the handle with fingerprintWeighted
+	weightedOnce sync.Once
+	weighted     string
+}
+
+func newFingerprintSelector(profile string, policy fingerprintPolicy, profiles customProfileSet, weights profileWeights, store *fingerprintStore, destination string) *fingerprintSelector {
+	return &fingerprintSelector{
+		profile:     profile,
+		policy:      policy,
+		profiles:    profiles,
+		weights:     weights,
+		store:       store,
+		destination: destination,
+	}
+}
+
+// pick returns the ClientHelloID and User-Agent for a new connection
+func (s *fingerprintSelector) pick(logger CLogger) (tls.ClientHelloID, string) {
+	if FingerprintProfile(strings.ToLower(s.profile)) != ProfileRandomized {
+		return s.profiles.fingerprintPair(s.profile)
+	}
+	switch s.policy {
+	case fingerprintPerConnection:
+		pair := randomPair()
+		return pair.clientHelloID, pair.userAgent
+	case fingerprintPerDestination:
+		pair := s.store.pair(s.destination, logger)
+		return pair.clientHelloID, pair.userAgent
+	case fingerprintWeighted:
+		s.weightedOnce.Do(func() {
+			s.weighted = pickWeighted(s.weights)
+			logger.Printf("udptlspipe: Picked fingerprint profile %s", s.weighted)
+		})
+		return s.profiles.fingerprintPair(s.weighted)
+	default:
+		return getRandomizedPair()
+	}
+}
+
+// pickWeighted picks one of the names of weights with a chance proportional
+// to its weight
+func pickWeighted(weights profileWeights) string {
+	names := make([]string, 0, len(weights))
+	total := int64(0)
+	for name, weight := range weights {
+		names = append(names, name)
+		total += int64(weight)
+	}
+	sort.Strings(names)
+
+	n, err := rand.Int(rand.Reader, big.NewInt(total))
+	if err != nil {
+		return names[0]
+	}
+	r := n.Int64()
+	for _, name := range names {
+		if r < int64(weights[name]) {
+			return name
+		}
+		r -= int64(weights[name])
+	}
+	return names[len(names)-1]
+}
+
+// fingerprintFile is the content of a fingerprint state file
+type fingerprintFile struct {
+	Version      int               `json:"version"`
+	Fingerprints map[string]string `json:"fingerprints"`
+}
+
+// fingerprintStore holds the randomized picks by destination, as the
+// ClientHelloID.Str() of one of fingerprintPairs
+type fingerprintStore struct {
+	path string // empty if the store isn't persisted
+
+	mu    sync.Mutex
+	picks map[string]string
+}
+
+var (
+	fingerprintStoresMu sync.Mutex
+	fingerprintStores   = make(map[string]*fingerprintStore)
+)
+
+// openFingerprintStore returns the store for path, reading it from the file
+// the first time. An empty path is the store kept in memory only. A missing
+// or unreadable file is taken as empty, so destinations are picked for anew.
+func openFingerprintStore(path string) (*fingerprintStore, error) {
+	if path != "" {
+		var err error
+		if path, err = filepath.Abs(path); err != nil {
+			return nil, err
+		}
+	}
+
+	fingerprintStoresMu.Lock()
+	defer fingerprintStoresMu.Unlock()
+	if store := fingerprintStores[path]; store != nil {
+		return store, nil
+	}
+
+	store := &fingerprintStore{
+		path:  path,
+		picks: make(map[string]string),
+	}
+	if path != "" {
+		if info, err := os.Stat(filepath.Dir(path)); err != nil || !info.IsDir() {
+			return nil, fmt.Errorf("no directory for %s", path)
+		}
+		data, err := os.ReadFile(path)
+		switch {
+		case errors.Is(err, fs.ErrNotExist):
+		case err != nil:
+			return nil, err
+		default:
+			var file fingerprintFile
+			if json.Unmarshal(data, &file) == nil && file.Version == fingerprintFileVersion {
+				for destination, name := range file.Fingerprints {
+					store.picks[destination] = name
+				}
+			}
+		}
+	}
+	fingerprintStores[path] = store
+	return store, nil
+}
+
+// pair returns the pick for destination. A destination without one, or whose
+// pick is no longer among fingerprintPairs, gets a new one, which is saved
+// right away since it's rare.
+func (s *fingerprintStore) pair(destination string, logger CLogger) fingerprintPair {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if name, ok := s.picks[destination]; ok {
+		for _, pair := range fingerprintPairs {
+			if pair.clientHelloID.Str() == name {
+				return pair
+			}
+		}
+	}
+
+	pair := randomPair()
+	s.picks[destination] = pair.clientHelloID.Str()
+	logger.Printf("udptlspipe: Picked fingerprint %s for %s", pair.clientHelloID.Str(), destination)
+	if s.path == "" {
+		return pair
+	}
+	data, err := json.Marshal(fingerprintFile{Version: fingerprintFileVersion, Fingerprints: s.picks})
+	if err == nil {
+		err = writeFileAtomic(s.path, data, 0o600)
+	}
+	if err != nil {
+		logger.Printf("udptlspipe: Failed to save fingerprints to %s: %v", s.path, err)
+	}
+	return pair
+}
@@ -118,22 +118,26 @@ func getRandomizedPair() (tls.ClientHelloID, string) {
 		return currentRandomPair.clientHelloID, currentRandomPair.userAgent
 	}
 
-	// Select a random pair from our predefined list
+	pair := randomPair()
+	currentRandomPair = &pair
+	randomPairGenerated = true
+
+	return currentRandomPair.clientHelloID, currentRandomPair.userAgent
+}
+
+// randomPair selects a random pair from our predefined list
+func randomPair() fingerprintPair {
 	idx, err := rand.Int(rand.Reader, big.NewInt(int64(len(fingerprintPairs))))
 	if err != nil {
 		// Fallback to okhttp on error
-		currentRandomPair = &fingerprintPairs[len(fingerprintPairs)-1] // okhttp is last
-	} else {
-		pair := fingerprintPairs[idx.Int64()]
-		currentRandomPair = &pair
+		return fingerprintPairs[len(fingerprintPairs)-1] // okhttp is last
 	}
-	randomPairGenerated = true
-
-	return currentRandomPair.clientHelloID, currentRandomPair.userAgent
+	return fingerprintPairs[idx.Int64()]
 }
 
 // ResetRandomizedPair clears the cached randomized pair, causing a new one to be
 // selected on the next call. This can be called on reconnection to get a fresh fingerprint.
+// It only affects handles with the "process" fingerprint policy.
 func ResetRandomizedPair() {
 	randomizedPairMu.Lock()
 	defer randomizedPairMu.Unlock()
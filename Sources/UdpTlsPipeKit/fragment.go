@@ -0,0 +1,209 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2024 AmneziaWG. All Rights Reserved.
+ */
+
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"time"
+)
+
+// Fragmentation carries datagrams larger than MaxMessageLength, such as those
+// of WireGuard with its default MTU of 1420, over several WebSocket messages.
+// The client offers it as a WebSocket subprotocol, like multiplexing and HMAC
+// authentication, and the server selects it if it agrees; only then do both
+// ends frame every message body as
+//
+//	<2 bytes>: datagram ID (big-endian)
+//	<1 byte>: fragment index
+//	<1 byte>: fragment count
+//	<fragment>
+//
+// wrapped in the usual framing of packMessage. A datagram that fits in one
+// message is sent as a single fragment. The fragments of a datagram are sent
+// in order on one connection, but may be interleaved with those of others.
+// Without it, datagrams are sent in one message each whatever their size, as
+// before fragmentation existed.
+
+const (
+	// fragmentSubprotocol offers fragmentation, and muxFragmentSubprotocol
+	// fragmentation along with multiplexing, since the server selects a
+	// single subprotocol
+	fragmentSubprotocol    = "udptlspipe-fragment-v1"
+	muxFragmentSubprotocol = "udptlspipe-mux-fragment-v1"
+
+	fragmentHeaderSize = 4
+	maxFragmentSize    = MaxMessageLength - fragmentHeaderSize
+	// maxDatagramSize is the largest datagram, with its multiplexing header
+	maxDatagramSize = bufferSize + muxHeaderSize
+	maxFragments    = (maxDatagramSize + maxFragmentSize - 1) / maxFragmentSize
+
+	// Datagrams being reassembled per connection, beyond which the oldest is
+	// given up on
+	maxReassemblies = 16
+	// Time after which a datagram that is still missing fragments is given up on
+	reassemblyTimeout = 5 * time.Second
+)
+
+var (
+	errDatagramTooLarge = errors.New("datagram too large")
+	errBadFragment      = errors.New("malformed fragment")
+)
+
+// fragmentsWith reports whether the subprotocol selected by the server
+// enables fragmentation
+func fragmentsWith(subprotocol string) bool {
+	return subprotocol == fragmentSubprotocol || subprotocol == muxFragmentSubprotocol
+}
+
+// fragmenter splits outgoing datagrams into message bodies and reassembles
+// incoming ones, for one connection. split and join may run concurrently with
+// each other, but not with themselves.
+type fragmenter struct {
+	// enabled is whether both ends agreed on fragmentation
+	enabled bool
+	// bodyLimit is the largest message body split makes, which is at most
+	// MaxMessageLength, its default
+	bodyLimit int
+	// onIncomplete, if set, is called for every datagram given up on before
+	// all its fragments arrived
+	onIncomplete func()
+
+	nextID  uint16
+	partial map[uint16]*partialDatagram
+}
+
+// partialDatagram is a datagram still missing some of its fragments
+type partialDatagram struct {
+	fragments [][]byte
+	received  int
+	size      int
+	started   time.Time
+}
+
+func newFragmenter(enabled bool) *fragmenter {
+	return &fragmenter{
+		enabled:   enabled,
+		bodyLimit: MaxMessageLength,
+		partial:   make(map[uint16]*partialDatagram),
+	}
+}
+
+// split returns the message bodies that carry data, or errDatagramTooLarge if
+// it can't be sent.
+func (f *fragmenter) split(data []byte) ([][]byte, error) {
+	if !f.enabled {
+		// The body length of packMessage is all that limits them
+		if len(data) > bufferSize {
+			return nil, errDatagramTooLarge
+		}
+		return [][]byte{data}, nil
+	}
+
+	fragmentSize := f.bodyLimit - fragmentHeaderSize
+	count := max(1, (len(data)+fragmentSize-1)/fragmentSize)
+	if count > maxFragments {
+		return nil, errDatagramTooLarge
+	}
+
+	id := f.nextID
+	f.nextID++
+	bodies := make([][]byte, count)
+	for i := range bodies {
+		chunk := data[i*fragmentSize : min(len(data), (i+1)*fragmentSize)]
+		body := make([]byte, fragmentHeaderSize+len(chunk))
+		binary.BigEndian.PutUint16(body, id)
+		body[2] = byte(i)
+		body[3] = byte(count)
+		copy(body[fragmentHeaderSize:], chunk)
+		bodies[i] = body
+	}
+	return bodies, nil
+}
+
+// join takes the body of a received message and returns the datagram it
+// completes. ok is false while fragments of the datagram are still missing.
+// join keeps a reference to body.
+func (f *fragmenter) join(body []byte, now time.Time) (data []byte, ok bool, err error) {
+	if !f.enabled {
+		return body, true, nil
+	}
+
+	if len(body) < fragmentHeaderSize {
+		return nil, false, errBadFragment
+	}
+	id := binary.BigEndian.Uint16(body)
+	index, count := int(body[2]), int(body[3])
+	chunk := body[fragmentHeaderSize:]
+	if count == 0 || count > maxFragments || index >= count {
+		return nil, false, errBadFragment
+	}
+	if count == 1 {
+		return chunk, true, nil
+	}
+
+	f.expire(now)
+	p := f.partial[id]
+	if p == nil {
+		if len(f.partial) >= maxReassemblies {
+			f.dropOldest()
+		}
+		p = &partialDatagram{fragments: make([][]byte, count), started: now}
+		f.partial[id] = p
+	}
+	if len(p.fragments) != count || p.fragments[index] != nil {
+		f.drop(id)
+		return nil, false, errBadFragment
+	}
+
+	p.size += len(chunk)
+	if p.size > maxDatagramSize {
+		delete(f.partial, id)
+		return nil, false, errDatagramTooLarge
+	}
+	p.fragments[index] = chunk
+	p.received++
+	if p.received < count {
+		return nil, false, nil
+	}
+
+	delete(f.partial, id)
+	data = make([]byte, 0, p.size)
+	for _, fragment := range p.fragments {
+		data = append(data, fragment...)
+	}
+	return data, true, nil
+}
+
+// expire gives up on the datagrams that have waited too long for fragments
+func (f *fragmenter) expire(now time.Time) {
+	for id, p := range f.partial {
+		if now.Sub(p.started) >= reassemblyTimeout {
+			f.drop(id)
+		}
+	}
+}
+
+// dropOldest gives up on the datagram that has waited the longest
+func (f *fragmenter) dropOldest() {
+	var oldest *partialDatagram
+	var oldestID uint16
+	for id, p := range f.partial {
+		if oldest == nil || p.started.Before(oldest.started) {
+			oldest, oldestID = p, id
+		}
+	}
+	if oldest != nil {
+		f.drop(oldestID)
+	}
+}
+
+func (f *fragmenter) drop(id uint16) {
+	delete(f.partial, id)
+	if f.onIncomplete != nil {
+		f.onIncomplete()
+	}
+}
@@ -0,0 +1,113 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2024 AmneziaWG. All Rights Reserved.
+ */
+
+package main
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+func TestSubprotocolNegotiation(t *testing.T) {
+	p := &pipeServer{
+		password: "secret",
+		replay:   newReplayGuard(),
+		logger:   CLogger(0),
+		upgrader: websocket.Upgrader{Subprotocols: pipeSubprotocols},
+	}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if err := p.authenticate(r); err != nil {
+			http.Error(w, err.Error(), http.StatusForbidden)
+			return
+		}
+		if conn, err := p.upgrader.Upgrade(w, r, nil); err == nil {
+			conn.Close()
+		}
+	}))
+	defer server.Close()
+	wsURL := "ws" + strings.TrimPrefix(server.URL, "http")
+
+	// token stands for a fresh HMAC token
+	const token = "<token>"
+	tests := []struct {
+		name  string
+		offer []string
+		mux   bool
+		frag  bool
+	}{
+		{"nothing", nil, false, false},
+		{"fragmentation", []string{fragmentSubprotocol}, false, true},
+		{"mux and fragmentation", []string{muxSubprotocol, muxFragmentSubprotocol, fragmentSubprotocol}, true, true},
+		{"mux only", []string{muxSubprotocol}, true, false},
+		{"hmac", []string{authSubprotocol, token}, false, false},
+		{"hmac and fragmentation", []string{authSubprotocol, token, fragmentSubprotocol}, false, true},
+		{"hmac, mux and fragmentation", []string{muxSubprotocol, authSubprotocol, token, muxFragmentSubprotocol, fragmentSubprotocol}, true, true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			u := wsURL + "?password=secret"
+			offer := make([]string, len(test.offer))
+			for i, protocol := range test.offer {
+				if protocol == token {
+					protocol = newAuthToken("secret", time.Now())
+					u = wsURL
+				}
+				offer[i] = protocol
+			}
+
+			dialer := websocket.Dialer{Subprotocols: offer}
+			conn, _, err := dialer.Dial(u, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer conn.Close()
+			if mux, frag := multiplexesWith(conn.Subprotocol()), fragmentsWith(conn.Subprotocol()); mux != test.mux || frag != test.frag {
+				t.Errorf("selected %q: mux %t, fragmentation %t", conn.Subprotocol(), mux, frag)
+			}
+		})
+	}
+}
+
+func TestFragmenterSplit(t *testing.T) {
+	large := make([]byte, 1420)
+	for i := range large {
+		large[i] = byte(i)
+	}
+
+	// Without fragmentation large datagrams go out whole, as they used to
+	plain := newFragmenter(false)
+	bodies, err := plain.split(large)
+	if err != nil || len(bodies) != 1 || len(bodies[0]) != len(large) {
+		t.Fatalf("unfragmented split = %d bodies, %v", len(bodies), err)
+	}
+	if _, err := plain.split(make([]byte, bufferSize+1)); err != errDatagramTooLarge {
+		t.Errorf("unfragmented split of %d bytes = %v", bufferSize+1, err)
+	}
+
+	frag := newFragmenter(true)
+	bodies, err = frag.split(large)
+	if err != nil || len(bodies) != 2 {
+		t.Fatalf("fragmented split = %d bodies, %v", len(bodies), err)
+	}
+	peer := newFragmenter(true)
+	for i, body := range bodies {
+		if len(body) > MaxMessageLength {
+			t.Errorf("fragment %d is %d bytes", i, len(body))
+		}
+		data, ok, err := peer.join(body, time.Now())
+		if err != nil || ok != (i == len(bodies)-1) {
+			t.Fatalf("join fragment %d: ok %t, %v", i, ok, err)
+		}
+		if ok && !bytes.Equal(data, large) {
+			t.Error("reassembled datagram differs")
+		}
+	}
+}
@@ -0,0 +1,60 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2024 AmneziaWG. All Rights Reserved.
+ */
+
+package main
+
+import (
+	"fmt"
+	"net"
+	"strings"
+)
+
+// A connection involves three names, which domain fronting sets apart: the
+// dial address (destination), which may be a pinned CDN edge address; the SNI
+// (tls_server_name), a domain the CDN serves that the network may see; and
+// the Host header (host), naming the real backend, which only the CDN sees
+// once TLS is up and routes the request by.
+//
+// Whether a CDN serves a Host other than the SNI is up to the CDN, and many
+// refuse to, so nothing about fronting is rejected. Combinations that can't
+// work on any CDN, or that look like a mix-up of the names, are warned about
+// when the pipe starts.
+
+// configWarning is an accepted but questionable configuration field
+type configWarning struct {
+	field   string
+	message string
+}
+
+func (w configWarning) String() string {
+	return fmt.Sprintf("config field %q: %s", w.field, w.message)
+}
+
+// frontingWarnings checks a configuration that fronts, whose Host header
+// names another host than tls_server_name, for names that can't work together
+func (c *pipeConfig) frontingWarnings(destHost string) []configWarning {
+	host := c.Host
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	if host == "" || c.TLSServerName == "" || strings.EqualFold(host, c.TLSServerName) {
+		return nil
+	}
+
+	var warnings []configWarning
+	if net.ParseIP(c.TLSServerName) != nil {
+		warnings = append(warnings, configWarning{"tls_server_name", fmt.Sprintf("%s is an IP address, which isn't sent as SNI, so the CDN can't tell which domain is fronted", c.serverName)})
+	}
+	if net.ParseIP(strings.Trim(host, "[]")) != nil {
+		warnings = append(warnings, configWarning{"host", fmt.Sprintf("%s is an IP address, which a CDN can't route to a fronted backend", host)})
+	}
+	if strings.EqualFold(destHost, host) {
+		warnings = append(warnings, configWarning{"destination", fmt.Sprintf("dials the backend %s rather than the front %s; use the front or a CDN edge address", host, c.serverName)})
+	}
+	if strings.EqualFold(c.VerifyName, host) {
+		warnings = append(warnings, configWarning{"verify_name", fmt.Sprintf("the CDN presents the certificate of the front %s, not of the backend %s", c.serverName, host)})
+	}
+	return warnings
+}
@@ -0,0 +1,29 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2024 AmneziaWG. All Rights Reserved.
+ */
+
+package main
+
+import "testing"
+
+func TestHostHeader(t *testing.T) {
+	tests := []struct {
+		fields string
+		host   string
+	}{
+		// The destination stays the authority unless host is set
+		{`"destination": "192.0.2.1:443"`, ""},
+		{`"destination": "192.0.2.1:443", "tls_server_name": "front.example"`, ""},
+		{`"destination": "192.0.2.1:8443", "tls_server_name": "front.example", "host": "backend.example"`, "backend.example"},
+	}
+	for _, test := range tests {
+		cfg, err := parseConfig(`{` + test.fields + `}`)
+		if err != nil {
+			t.Fatalf("%s: %v", test.fields, err)
+		}
+		if host := cfg.header.Get("Host"); host != test.host {
+			t.Errorf("%s: Host %q, want %q", test.fields, host, test.host)
+		}
+	}
+}
@@ -0,0 +1,397 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2024 AmneziaWG. All Rights Reserved.
+ */
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/sha1"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/netip"
+	"net/url"
+	"os"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+	tls "github.com/refraction-networking/utls"
+	"golang.org/x/net/http2"
+)
+
+// WebSockets over HTTP/2 (RFC 8441) are opened with an extended CONNECT
+// request on a stream of their own. Browser fingerprints offer h2 in ALPN, so
+// a server that picks it must be talked to over HTTP/2. Both ends translate
+// the extended CONNECT handshake to and from the HTTP/1.1 upgrade handshake,
+// so that gorilla/websocket, which only knows the latter, runs unchanged on
+// top of the stream.
+
+// httpVersion selects how the WebSocket connection is established
+type httpVersion string
+
+const (
+	// httpVersionAuto offers the ALPN protocols of the fingerprint profile
+	// and uses HTTP/2 if the server selects it
+	httpVersionAuto httpVersion = "auto"
+	// httpVersion1 offers only http/1.1 and always upgrades
+	httpVersion1 httpVersion = "1.1"
+	// httpVersion2 offers only h2 and fails if the server doesn't select it
+	httpVersion2 httpVersion = "2"
+)
+
+const (
+	alpnHTTP1 = "http/1.1"
+	alpnHTTP2 = "h2"
+	// websocketGUID is appended to Sec-WebSocket-Key to derive
+	// Sec-WebSocket-Accept, see RFC 6455 section 4.2.2
+	websocketGUID = "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"
+)
+
+var errNoExtendedConnect = errors.New("server selected HTTP/2 but doesn't support WebSockets over it, falling back to HTTP/1.1")
+
+// h2Transport opens the HTTP/2 connections of all handles. Each WebSocket has
+// a connection of its own, so that it fails and reconnects just like one over
+// HTTP/1.1.
+var h2Transport = &http2.Transport{}
+
+// alpnProtocols returns the ALPN protocols to offer, or nil to offer those of
+// the fingerprint profile.
+func (c *pipeConfig) alpnProtocols() []string {
+	switch {
+	case c.HTTPVersion == httpVersion1 || c.h2Refused.Load():
+		return []string{alpnHTTP1}
+	case c.HTTPVersion == httpVersion2:
+		return []string{alpnHTTP2}
+	default:
+		return nil
+	}
+}
+
+// setALPN replaces the ALPN protocols of spec. ALPS, which Chrome only sends
+// for h2, is trimmed to match, since a browser never offers settings for a
+// protocol it doesn't offer.
+func setALPN(spec *tls.ClientHelloSpec, protocols []string) {
+	extensions := spec.Extensions[:0]
+	for _, ext := range spec.Extensions {
+		switch ext := ext.(type) {
+		case *tls.ALPNExtension:
+			ext.AlpnProtocols = protocols
+		case *tls.ApplicationSettingsExtension:
+			var supported []string
+			for _, protocol := range ext.SupportedProtocols {
+				if slices.Contains(protocols, protocol) {
+					supported = append(supported, protocol)
+				}
+			}
+			if len(supported) == 0 {
+				continue
+			}
+			ext.SupportedProtocols = supported
+		}
+		extensions = append(extensions, ext)
+	}
+	spec.Extensions = extensions
+}
+
+// h2ClientConn carries a WebSocket over an extended CONNECT stream. It stands
+// in for the TLS connection under websocket.Dialer: the upgrade request the
+// dialer writes is sent as the CONNECT request, and the server's answer is
+// read back as the 101 response the dialer expects. Deadlines apply to the
+// TLS connection, which only carries this stream.
+type h2ClientConn struct {
+	net.Conn
+	cc     *http2.ClientConn
+	ctx    context.Context
+	cancel context.CancelFunc
+	// onRefused is called when the server doesn't support extended CONNECT
+	onRefused func()
+
+	pending    []byte // request head until complete
+	handshaken bool
+	body       *io.PipeWriter // request body, client to server
+
+	ready     chan struct{} // closed once reader is set
+	reader    io.Reader     // the translated response, then the response body
+	closeOnce sync.Once
+	closeErr  error
+}
+
+// newH2ClientConn starts an HTTP/2 connection over tlsConn, on which the
+// WebSocket will be opened.
+func newH2ClientConn(tlsConn net.Conn, onRefused func()) (*h2ClientConn, error) {
+	cc, err := h2Transport.NewClientConn(tlsConn)
+	if err != nil {
+		return nil, newPipeError(errorConnect, fmt.Errorf("HTTP/2 setup failed: %w", err))
+	}
+
+	// The stream lives as long as the WebSocket, not as long as the dial
+	ctx, cancel := context.WithCancel(context.Background())
+	return &h2ClientConn{
+		Conn:      tlsConn,
+		cc:        cc,
+		ctx:       ctx,
+		cancel:    cancel,
+		onRefused: onRefused,
+		ready:     make(chan struct{}),
+	}, nil
+}
+
+func (c *h2ClientConn) Write(b []byte) (int, error) {
+	if c.handshaken {
+		return c.body.Write(b)
+	}
+
+	// Hold the upgrade request back until its head is complete
+	c.pending = append(c.pending, b...)
+	if !bytes.Contains(c.pending, []byte("\r\n\r\n")) {
+		return len(b), nil
+	}
+
+	req, err := http.ReadRequest(bufio.NewReader(bytes.NewReader(c.pending)))
+	c.pending = nil
+	if err != nil {
+		return 0, err
+	}
+	if err := c.connect(req); err != nil {
+		return 0, err
+	}
+	c.handshaken = true
+	return len(b), nil
+}
+
+// connect sends the extended CONNECT request equivalent to the upgrade
+// request req, and translates the response.
+func (c *h2ClientConn) connect(req *http.Request) error {
+	header := http.Header{}
+	for name, values := range req.Header {
+		switch name {
+		case "Connection", "Upgrade", "Sec-Websocket-Key":
+			// Connection specific, or replaced by the stream
+		default:
+			header[name] = values
+		}
+	}
+	header.Set(":protocol", "websocket")
+
+	bodyReader, bodyWriter := io.Pipe()
+	c.body = bodyWriter
+	connectReq := (&http.Request{
+		Method: http.MethodConnect,
+		URL: &url.URL{
+			Scheme:   "https",
+			Host:     req.Host,
+			Path:     req.URL.Path,
+			RawPath:  req.URL.RawPath,
+			RawQuery: req.URL.RawQuery,
+		},
+		Host:          req.Host,
+		Header:        header,
+		Body:          bodyReader,
+		ContentLength: -1,
+	}).WithContext(c.ctx)
+
+	resp, err := c.cc.RoundTrip(connectReq)
+	if err != nil {
+		// x/net doesn't export this error
+		if strings.Contains(err.Error(), "extended connect not supported") {
+			c.onRefused()
+			return newPipeError(errorConnect, errNoExtendedConnect)
+		}
+		return newPipeError(errorConnect, fmt.Errorf("HTTP/2 CONNECT failed: %w", err))
+	}
+
+	var head bytes.Buffer
+	if resp.StatusCode == http.StatusOK {
+		head.WriteString("HTTP/1.1 101 Switching Protocols\r\nUpgrade: websocket\r\nConnection: Upgrade\r\n")
+		fmt.Fprintf(&head, "Sec-WebSocket-Accept: %s\r\n", websocketAccept(req.Header.Get("Sec-Websocket-Key")))
+		if protocol := resp.Header.Get("Sec-Websocket-Protocol"); protocol != "" {
+			fmt.Fprintf(&head, "Sec-WebSocket-Protocol: %s\r\n", protocol)
+		}
+		head.WriteString("\r\n")
+		c.reader = io.MultiReader(&head, resp.Body)
+	} else {
+		// The dialer reports the status as a bad handshake
+		resp.Body.Close()
+		bodyWriter.Close()
+		fmt.Fprintf(&head, "HTTP/1.1 %03d %s\r\nContent-Length: 0\r\n\r\n", resp.StatusCode, http.StatusText(resp.StatusCode))
+		c.reader = &head
+	}
+	close(c.ready)
+	return nil
+}
+
+func (c *h2ClientConn) Read(b []byte) (int, error) {
+	select {
+	case <-c.ready:
+		return c.reader.Read(b)
+	case <-c.ctx.Done():
+		return 0, net.ErrClosed
+	}
+}
+
+func (c *h2ClientConn) Close() error {
+	c.closeOnce.Do(func() {
+		c.cancel()
+		c.cc.Close()
+		c.closeErr = c.Conn.Close()
+	})
+	return c.closeErr
+}
+
+// websocketAccept returns the Sec-WebSocket-Accept value for key
+func websocketAccept(key string) string {
+	hash := sha1.Sum([]byte(key + websocketGUID))
+	return base64.StdEncoding.EncodeToString(hash[:])
+}
+
+// extendedConnectEnabled reports whether net/http accepts extended CONNECT
+// requests. It only does with GODEBUG=http2xconnect=1 in the environment,
+// which can't be changed once the process has started.
+func extendedConnectEnabled() bool {
+	for _, setting := range strings.Split(os.Getenv("GODEBUG"), ",") {
+		if strings.TrimSpace(setting) == "http2xconnect=1" {
+			return true
+		}
+	}
+	return false
+}
+
+// isExtendedConnect reports whether r opens a WebSocket over HTTP/2
+func isExtendedConnect(r *http.Request) bool {
+	return r.ProtoMajor == 2 && r.Method == http.MethodConnect && r.Header.Get(":protocol") == "websocket"
+}
+
+// upgradeExtendedConnect accepts a WebSocket opened with an extended CONNECT
+// request. The upgrader is handed the equivalent HTTP/1.1 upgrade request and
+// the stream as the hijacked connection; the 101 response it writes there is
+// sent as the 200 response of the stream.
+func upgradeExtendedConnect(upgrader *websocket.Upgrader, w http.ResponseWriter, r *http.Request, responseHeader http.Header) (*websocket.Conn, error) {
+	key := make([]byte, 16)
+	if _, err := rand.Read(key); err != nil {
+		return nil, err
+	}
+
+	upgradeReq := r.Clone(r.Context())
+	upgradeReq.Method = http.MethodGet
+	upgradeReq.Proto, upgradeReq.ProtoMajor, upgradeReq.ProtoMinor = "HTTP/1.1", 1, 1
+	upgradeReq.Header.Del(":protocol")
+	upgradeReq.Header.Set("Connection", "Upgrade")
+	upgradeReq.Header.Set("Upgrade", "websocket")
+	upgradeReq.Header.Set("Sec-Websocket-Key", base64.StdEncoding.EncodeToString(key))
+
+	conn := &h2ServerConn{
+		w:          w,
+		controller: http.NewResponseController(w),
+		body:       r.Body,
+		remoteAddr: parseAddr(r.RemoteAddr),
+	}
+	if addr, ok := r.Context().Value(http.LocalAddrContextKey).(net.Addr); ok {
+		conn.localAddr = addr
+	}
+	return upgrader.Upgrade(&h2Hijacker{ResponseWriter: w, conn: conn}, upgradeReq, responseHeader)
+}
+
+// h2Hijacker lets websocket.Upgrader take over an extended CONNECT stream
+type h2Hijacker struct {
+	http.ResponseWriter
+	conn *h2ServerConn
+}
+
+func (h *h2Hijacker) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	return h.conn, bufio.NewReadWriter(bufio.NewReader(h.conn), bufio.NewWriter(h.conn)), nil
+}
+
+// h2ServerConn is the server end of an extended CONNECT stream, as a net.Conn
+type h2ServerConn struct {
+	w          http.ResponseWriter
+	controller *http.ResponseController
+	body       io.ReadCloser
+	localAddr  net.Addr
+	remoteAddr net.Addr
+
+	pending    []byte // response head until complete
+	handshaken bool
+}
+
+func (c *h2ServerConn) Write(b []byte) (int, error) {
+	if c.handshaken {
+		n, err := c.w.Write(b)
+		if err != nil {
+			return n, err
+		}
+		return n, c.controller.Flush()
+	}
+
+	// Hold the 101 response back until its head is complete
+	c.pending = append(c.pending, b...)
+	if !bytes.Contains(c.pending, []byte("\r\n\r\n")) {
+		return len(b), nil
+	}
+
+	resp, err := http.ReadResponse(bufio.NewReader(bytes.NewReader(c.pending)), nil)
+	c.pending = nil
+	if err != nil {
+		return 0, err
+	}
+	if protocol := resp.Header.Get("Sec-Websocket-Protocol"); protocol != "" {
+		c.w.Header().Set("Sec-Websocket-Protocol", protocol)
+	}
+	c.w.WriteHeader(http.StatusOK)
+	if err := c.controller.Flush(); err != nil {
+		return 0, err
+	}
+	c.handshaken = true
+	return len(b), nil
+}
+
+func (c *h2ServerConn) Read(b []byte) (int, error) {
+	return c.body.Read(b)
+}
+
+// Close ends the request body; the stream itself ends when the handler returns
+func (c *h2ServerConn) Close() error {
+	return c.body.Close()
+}
+
+func (c *h2ServerConn) LocalAddr() net.Addr {
+	return c.localAddr
+}
+
+func (c *h2ServerConn) RemoteAddr() net.Addr {
+	return c.remoteAddr
+}
+
+func (c *h2ServerConn) SetDeadline(t time.Time) error {
+	if err := c.controller.SetReadDeadline(t); err != nil {
+		return err
+	}
+	return c.controller.SetWriteDeadline(t)
+}
+
+func (c *h2ServerConn) SetReadDeadline(t time.Time) error {
+	return c.controller.SetReadDeadline(t)
+}
+
+func (c *h2ServerConn) SetWriteDeadline(t time.Time) error {
+	return c.controller.SetWriteDeadline(t)
+}
+
+// parseAddr parses the RemoteAddr of a request, which is an IP and port
+func parseAddr(addr string) net.Addr {
+	addrPort, err := netip.ParseAddrPort(addr)
+	if err != nil {
+		return nil
+	}
+	return net.TCPAddrFromAddrPort(addrPort)
+}
@@ -0,0 +1,94 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2024 AmneziaWG. All Rights Reserved.
+ */
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// TestH2RoundTrip relays datagrams both ways over a WebSocket opened with
+// extended CONNECT. net/http only serves those with GODEBUG=http2xconnect=1,
+// which must be set when the tests start.
+func TestH2RoundTrip(t *testing.T) {
+	if !extendedConnectEnabled() {
+		t.Skip("needs GODEBUG=http2xconnect=1")
+	}
+
+	upstream := startTestUpstream(t)
+	ctx, cancel := context.WithCancel(context.Background())
+	p := &pipeServer{
+		ctx:          ctx,
+		upstreamAddr: upstream.conn.LocalAddr().(*net.UDPAddr),
+		path:         "/",
+		password:     "secret",
+		replay:       newReplayGuard(),
+		logger:       CLogger(0),
+		upgrader:     websocket.Upgrader{Subprotocols: pipeSubprotocols},
+	}
+	var extendedConnects atomic.Int32
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if isExtendedConnect(r) {
+			extendedConnects.Add(1)
+		}
+		p.ServeHTTP(w, r)
+	}))
+	server.EnableHTTP2 = true
+	server.StartTLS()
+	t.Cleanup(func() {
+		cancel()
+		server.Close()
+		p.wg.Wait()
+	})
+
+	cfg, err := parseConfig(fmt.Sprintf(`{"destination": %q, "password": "secret", "auth_mode": "hmac", "fingerprint_profile": "chrome", "http_version": "2"}`, server.Listener.Addr()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	received := make(chan []byte, 1)
+	link := newWSLink(context.Background(), cfg, "test", func(data []byte) { received <- data }, newPipeStats(1), EventSink(0), CLogger(0))
+	go link.run()
+	t.Cleanup(link.close)
+
+	waitCtx, waitCancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer waitCancel()
+	if !link.waitUp(waitCtx) {
+		t.Fatal("link didn't come up")
+	}
+	if extendedConnects.Load() != 1 {
+		t.Fatalf("%d extended CONNECT requests, want 1", extendedConnects.Load())
+	}
+
+	// A datagram larger than a message makes it through in fragments
+	datagram := bytes.Repeat([]byte("x"), 1420)
+	if err := link.write(datagram); err != nil {
+		t.Fatal(err)
+	}
+	eventually(t, "the upstream received the datagram", func() bool {
+		return len(upstream.received()) == 1
+	})
+
+	if _, err := upstream.conn.WriteToUDP(datagram[:200], upstream.last); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case data := <-received:
+		if !bytes.Equal(data, datagram[:200]) {
+			t.Errorf("received %d bytes, want the 200 sent", len(data))
+		}
+	case <-waitCtx.Done():
+		t.Fatal("no datagram from the upstream")
+	}
+}
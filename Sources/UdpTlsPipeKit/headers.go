@@ -0,0 +1,156 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2024 AmneziaWG. All Rights Reserved.
+ */
+
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"sort"
+	"strings"
+
+	tls "github.com/refraction-networking/utls"
+)
+
+// Header order of the WebSocket upgrade request sent by each browser, by
+// lowercase name. Headers that aren't listed are sent after the listed ones.
+var (
+	chromeHeaderOrder = []string{
+		"host", "connection", "pragma", "cache-control", "user-agent", "upgrade",
+		"origin", "sec-websocket-version", "accept-encoding", "accept-language",
+		"cookie", "sec-websocket-key", "sec-websocket-extensions", "sec-websocket-protocol",
+	}
+	firefoxHeaderOrder = []string{
+		"host", "user-agent", "accept", "accept-language", "accept-encoding",
+		"sec-websocket-version", "origin", "sec-websocket-protocol", "sec-websocket-extensions",
+		"sec-websocket-key", "connection", "cookie", "pragma", "cache-control", "upgrade",
+	}
+	safariHeaderOrder = []string{
+		"host", "upgrade", "connection", "origin", "pragma", "cache-control",
+		"accept-language", "sec-websocket-key", "sec-websocket-version", "sec-websocket-protocol",
+		"sec-websocket-extensions", "user-agent", "cookie", "accept-encoding",
+	}
+	okhttpHeaderOrder = []string{
+		"upgrade", "connection", "sec-websocket-key", "sec-websocket-version",
+		"sec-websocket-extensions", "sec-websocket-protocol", "host", "accept-encoding",
+		"cookie", "user-agent",
+	}
+)
+
+// headerOrderFor returns the header order of the browser or library that
+// clientHelloID imitates, so that the randomized profile stays consistent too.
+func headerOrderFor(clientHelloID tls.ClientHelloID) []string {
+	switch clientHelloID.Client {
+	case tls.HelloChrome_Auto.Client, tls.HelloEdge_Auto.Client:
+		return chromeHeaderOrder
+	case tls.HelloFirefox_Auto.Client:
+		return firefoxHeaderOrder
+	case tls.HelloSafari_Auto.Client, tls.HelloIOS_Auto.Client:
+		return safariHeaderOrder
+	default:
+		return okhttpHeaderOrder
+	}
+}
+
+// reservedHeaders are set by the WebSocket handshake itself and can't be
+// overridden from the configuration.
+var reservedHeaders = map[string]bool{
+	"Upgrade":                  true,
+	"Connection":               true,
+	"Sec-Websocket-Key":        true,
+	"Sec-Websocket-Version":    true,
+	"Sec-Websocket-Extensions": true,
+	"Sec-Websocket-Protocol":   true,
+	"Content-Length":           true,
+	"Transfer-Encoding":        true,
+}
+
+// validateHeader checks a configured request header
+func validateHeader(name, value string) error {
+	if name == "" {
+		return errors.New("empty header name")
+	}
+	for _, r := range name {
+		// RFC 9110 token characters
+		if r >= 0x80 || r <= ' ' || strings.ContainsRune(`"(),/:;<=>?@[\]{}`, r) {
+			return fmt.Errorf("invalid header name %q", name)
+		}
+	}
+	if strings.ContainsAny(value, "\r\n\x00") {
+		return fmt.Errorf("invalid value for header %q", name)
+	}
+
+	canonical := http.CanonicalHeaderKey(name)
+	if canonical == "Host" {
+		return errors.New(`set the Host header with the "host" field`)
+	}
+	if reservedHeaders[canonical] {
+		return fmt.Errorf("header %q is set by the WebSocket handshake", canonical)
+	}
+	return nil
+}
+
+// headerOrderConn reorders the header lines of the HTTP request written
+// through it, then passes everything else through unchanged. gorilla/websocket
+// writes the upgrade request with net/http, which always sends Host and
+// User-Agent first and sorts the rest alphabetically; no browser does that.
+type headerOrderConn struct {
+	net.Conn
+	order   []string
+	pending []byte
+	done    bool
+}
+
+func newHeaderOrderConn(conn net.Conn, order []string) *headerOrderConn {
+	return &headerOrderConn{Conn: conn, order: order}
+}
+
+func (c *headerOrderConn) Write(b []byte) (int, error) {
+	if c.done {
+		return c.Conn.Write(b)
+	}
+
+	// Hold the request back until its head is complete
+	c.pending = append(c.pending, b...)
+	end := bytes.Index(c.pending, []byte("\r\n\r\n"))
+	if end < 0 {
+		return len(b), nil
+	}
+
+	out := append(c.reorder(c.pending[:end]), c.pending[end:]...)
+	c.pending = nil
+	c.done = true
+	if _, err := c.Conn.Write(out); err != nil {
+		return 0, err
+	}
+	return len(b), nil
+}
+
+// reorder sorts the header lines of a request head, without its final CRLF,
+// by c.order. The request line stays first and unknown headers keep their
+// relative order.
+func (c *headerOrderConn) reorder(head []byte) []byte {
+	lines := bytes.Split(head, []byte("\r\n"))
+	headers := lines[1:]
+
+	rank := func(line []byte) int {
+		name, _, _ := bytes.Cut(line, []byte(":"))
+		name = bytes.ToLower(bytes.TrimSpace(name))
+		for i, known := range c.order {
+			if string(name) == known {
+				return i
+			}
+		}
+		return len(c.order)
+	}
+	sort.SliceStable(headers, func(i, j int) bool {
+		return rank(headers[i]) < rank(headers[j])
+	})
+
+	return bytes.Join(lines, []byte("\r\n"))
+}
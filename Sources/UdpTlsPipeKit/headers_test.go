@@ -0,0 +1,112 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2024 AmneziaWG. All Rights Reserved.
+ */
+
+package main
+
+import (
+	"bufio"
+	"context"
+	"net"
+	"net/http"
+	"net/textproto"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+	tls "github.com/refraction-networking/utls"
+)
+
+// upgradeHeaderNames returns the lowercase header names of the upgrade
+// request gorilla/websocket writes through a headerOrderConn with order, as
+// they are on the wire
+func upgradeHeaderNames(t *testing.T, order []string, header http.Header) []string {
+	t.Helper()
+	client, server := net.Pipe()
+	defer server.Close()
+
+	dialer := websocket.Dialer{
+		NetDialContext: func(context.Context, string, string) (net.Conn, error) {
+			return newHeaderOrderConn(client, order), nil
+		},
+		Subprotocols: []string{fragmentSubprotocol},
+	}
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		// Fails once the server side is closed, nothing answers the upgrade
+		dialer.DialContext(ctx, "ws://server.example/", header)
+	}()
+
+	reader := textproto.NewReader(bufio.NewReader(server))
+	if _, err := reader.ReadLine(); err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	for {
+		line, err := reader.ReadLine()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if line == "" {
+			return names
+		}
+		name, _, _ := strings.Cut(line, ":")
+		names = append(names, strings.ToLower(name))
+	}
+}
+
+func TestHeaderOrder(t *testing.T) {
+	tests := []struct {
+		name          string
+		clientHelloID tls.ClientHelloID
+		order         []string
+	}{
+		{"chrome", tls.HelloChrome_Auto, chromeHeaderOrder},
+		{"edge", tls.HelloEdge_Auto, chromeHeaderOrder},
+		{"firefox", tls.HelloFirefox_Auto, firefoxHeaderOrder},
+		{"safari", tls.HelloSafari_Auto, safariHeaderOrder},
+		{"ios", tls.HelloIOS_Auto, safariHeaderOrder},
+		{"okhttp", tls.HelloAndroid_11_OkHttp, okhttpHeaderOrder},
+	}
+	header := http.Header{}
+	header.Set("User-Agent", "test")
+	header.Set("Origin", "https://server.example")
+	header.Set("Cache-Control", "no-cache")
+	header.Set("X-Extra", "1")
+	header.Set("Accept-Language", "en")
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			order := headerOrderFor(tt.clientHelloID)
+			if !slices.Equal(order, tt.order) {
+				t.Fatalf("headerOrderFor picked %v", order)
+			}
+
+			names := upgradeHeaderNames(t, order, header)
+			// The listed headers come in their order, the others after them
+			var want []string
+			for _, name := range order {
+				if slices.Contains(names, name) {
+					want = append(want, name)
+				}
+			}
+			for _, name := range names {
+				if !slices.Contains(order, name) {
+					want = append(want, name)
+				}
+			}
+			if !slices.Equal(names, want) {
+				t.Errorf("headers sent as %v, want %v", names, want)
+			}
+			for _, name := range []string{"host", "upgrade", "sec-websocket-key", "sec-websocket-protocol", "x-extra"} {
+				if !slices.Contains(names, name) {
+					t.Errorf("header %s is missing from %v", name, names)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,12 @@
+//go:build !udptlspipe_server
+
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2024 AmneziaWG. All Rights Reserved.
+ */
+
+package main
+
+// main is never called when built with -buildmode c-archive, but the package
+// still needs one.
+func main() {}
@@ -0,0 +1,55 @@
+//go:build udptlspipe_server
+
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2024 AmneziaWG. All Rights Reserved.
+ */
+
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"os"
+	"os/signal"
+	"syscall"
+)
+
+// main runs a standalone udptlspipe server, for self-hosting and for testing
+// the client end to end. Build with:
+//
+//	go build -tags udptlspipe_server -o udptlspipe-server .
+//
+// WebSockets over HTTP/2 are only accepted when run with
+// GODEBUG=http2xconnect=1, which enables extended CONNECT in net/http. QUIC
+// tunnels are accepted on the UDP address given with -quic, with the same
+// certificate.
+func main() {
+	listenAddr := flag.String("l", "0.0.0.0:443", "TCP address to accept TLS WebSocket connections on")
+	quicAddr := flag.String("quic", "", "UDP address to accept QUIC tunnels on (disabled if empty)")
+	path := flag.String("path", defaultWSPath, "HTTP path to accept WebSocket upgrades on")
+	upstream := flag.String("d", "", "UDP address to relay datagrams to (e.g. 127.0.0.1:51820)")
+	password := flag.String("p", "", "password clients must present (empty disables authentication)")
+	requireHMAC := flag.Bool("require-hmac", false, "only accept HMAC tokens, not the password in the URL query")
+	certFile := flag.String("tls-certfile", "", "PEM certificate file (self-signed if unset)")
+	keyFile := flag.String("tls-keyfile", "", "PEM private key file (self-signed if unset)")
+	flag.Parse()
+
+	if *upstream == "" {
+		fmt.Fprintln(os.Stderr, "udptlspipe-server: -d is required")
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	logToStderr = true
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	err := runUdpTlsPipeServer(ctx, *listenAddr, *quicAddr, *path, *upstream, *password, *requireHMAC, *certFile, *keyFile, CLogger(0))
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "udptlspipe-server: %v\n", err)
+		os.Exit(1)
+	}
+}
@@ -25,33 +25,24 @@ const (
 	MaxPaddingLength = 256
 )
 
-// packMessage wraps data with the udptlspipe framing protocol.
+// packMessage wraps data with the udptlspipe framing protocol, padded as p
+// decides.
 // Message format:
 //
 //	<2 bytes>: body length (big-endian)
 //	<body bytes>
 //	<2 bytes>: padding length (big-endian)
 //	<random padding bytes>
-func packMessage(data []byte) []byte {
-	// Calculate padding length
-	minLength := MinMessageLength - len(data)
-	if minLength <= 0 {
-		minLength = 1
-	}
-	maxLength := MaxPaddingLength
-	if maxLength <= minLength {
-		maxLength = minLength + 1
-	}
-
-	// Generate random padding
-	padding := createRandomPadding(minLength, maxLength)
+func packMessage(data []byte, p padder) []byte {
+	padding := p.paddingLength(len(data))
 
 	// Pack: <2 byte len><data><2 byte padding len><padding>
-	msg := make([]byte, len(data)+len(padding)+4)
+	msg := make([]byte, len(data)+padding+4)
 	binary.BigEndian.PutUint16(msg[:2], uint16(len(data)))
 	copy(msg[2:], data)
-	binary.BigEndian.PutUint16(msg[len(data)+2:len(data)+4], uint16(len(padding)))
-	copy(msg[len(data)+4:], padding)
+	binary.BigEndian.PutUint16(msg[len(data)+2:len(data)+4], uint16(padding))
+	// crypto/rand doesn't fail, and zeros would still be valid padding
+	rand.Read(msg[len(data)+4:])
 
 	return msg
 }
@@ -75,33 +66,3 @@ func unpackMessage(msg []byte) ([]byte, error) {
 
 	return data, nil
 }
-
-// createRandomPadding creates a random padding array with length between min and max.
-func createRandomPadding(minLength, maxLength int) []byte {
-	// Generate a random length for the slice between minLength and maxLength
-	lengthBuf := make([]byte, 1)
-	_, err := rand.Read(lengthBuf)
-	if err != nil {
-		// Fallback to minimum length if random fails
-		lengthBuf[0] = 0
-	}
-	length := int(lengthBuf[0])
-
-	// Ensure the length is within our desired range
-	length = (length % (maxLength - minLength)) + minLength
-
-	// Create a slice of the random length
-	padding := make([]byte, length)
-
-	// Fill the slice with random bytes
-	_, err = rand.Read(padding)
-	if err != nil {
-		// If random fails, just use zeros (still valid padding)
-		for i := range padding {
-			padding[i] = 0
-		}
-	}
-
-	return padding
-}
-
@@ -0,0 +1,229 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2024 AmneziaWG. All Rights Reserved.
+ */
+
+package main
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"sync"
+
+	"github.com/gorilla/websocket"
+)
+
+// Multiplexing carries the datagrams of many UDP clients over one WebSocket
+// connection. The client offers muxSubprotocol and only multiplexes if the
+// server selects it; servers that don't know it select nothing, and the client
+// falls back to one connection per UDP client. Each message body is then
+//
+//	<4 bytes>: flow ID (big-endian)
+//	<datagram>
+//
+// wrapped in the usual framing of packMessage. Flow IDs are chosen by the
+// client, one per UDP client; the server relays each flow from a UDP socket of
+// its own, just as it does for a connection without multiplexing.
+
+const (
+	muxSubprotocol = "udptlspipe-mux-v1"
+	muxHeaderSize  = 4
+	// muxLabel stands for the shared connection in logs and events
+	muxLabel = "*"
+)
+
+// muxFrame prefixes a datagram with its flow ID
+func muxFrame(flow uint32, data []byte) []byte {
+	frame := make([]byte, muxHeaderSize+len(data))
+	binary.BigEndian.PutUint32(frame, flow)
+	copy(frame[muxHeaderSize:], data)
+	return frame
+}
+
+// muxUnframe splits a multiplexed message into its flow ID and datagram
+func muxUnframe(frame []byte) (uint32, []byte, error) {
+	if len(frame) < muxHeaderSize {
+		return 0, nil, errors.New("multiplexed message too short")
+	}
+	return binary.BigEndian.Uint32(frame), frame[muxHeaderSize:], nil
+}
+
+var errMuxUnsupported = errors.New("server doesn't support multiplexing")
+
+type muxState int
+
+const (
+	muxUnknown muxState = iota
+	muxSupported
+	muxUnsupported
+)
+
+// muxClient shares one WebSocket connection between the sessions of a
+// handle. The connection is only kept while there are sessions using it.
+type muxClient struct {
+	ctx    context.Context
+	cfg    *pipeConfig
+	stats  *pipeStats
+	events EventSink
+	logger CLogger
+
+	mu sync.Mutex
+	// state is whether the server supports multiplexing. It's decided by the
+	// first connection and then kept for the lifetime of the handle.
+	state      muxState
+	negotiated chan struct{} // closed once state is no longer muxUnknown
+	link       connection    // the shared connection, nil if not running
+	linkDone   chan struct{} // closed when link stops
+	flows      map[uint32]*clientSession
+	nextFlow   uint32
+}
+
+func newMuxClient(ctx context.Context, cfg *pipeConfig, stats *pipeStats, events EventSink, logger CLogger) *muxClient {
+	return &muxClient{
+		ctx:        ctx,
+		cfg:        cfg,
+		stats:      stats,
+		events:     events,
+		logger:     logger,
+		negotiated: make(chan struct{}),
+		flows:      make(map[uint32]*clientSession),
+	}
+}
+
+// muxFlow is the transport of a session over the shared connection
+type muxFlow struct {
+	id   uint32
+	link connection
+	// done is closed when the shared connection gives up, which ends the flow
+	done chan struct{}
+}
+
+func (f *muxFlow) waitUp(ctx context.Context) bool {
+	return f.link.waitUp(ctx)
+}
+
+func (f *muxFlow) write(data []byte) error {
+	return f.link.write(muxFrame(f.id, data))
+}
+
+// attach adds a session to the shared connection, starting it if needed.
+// It returns nil if the server doesn't support multiplexing, in which case the
+// session needs a connection of its own.
+func (m *muxClient) attach(s *clientSession) *muxFlow {
+	m.mu.Lock()
+	if m.state == muxUnsupported {
+		m.mu.Unlock()
+		return nil
+	}
+	m.nextFlow++
+	flow := &muxFlow{id: m.nextFlow}
+	m.flows[flow.id] = s
+	if m.link == nil {
+		m.startLocked()
+	}
+	flow.link, flow.done = m.link, m.linkDone
+	m.mu.Unlock()
+
+	// Only the server's answer tells whether the flow can be used
+	select {
+	case <-m.negotiated:
+	case <-flow.done:
+	case <-s.ctx.Done():
+	}
+
+	m.mu.Lock()
+	unsupported := m.state == muxUnsupported
+	m.mu.Unlock()
+	if unsupported {
+		m.detach(flow)
+		return nil
+	}
+	return flow
+}
+
+// detach removes a session, closing the shared connection with the last one
+func (m *muxClient) detach(flow *muxFlow) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	delete(m.flows, flow.id)
+	if len(m.flows) == 0 && m.link != nil {
+		m.link.close()
+		m.link = nil
+	}
+}
+
+func (m *muxClient) startLocked() {
+	link := newConnection(m.ctx, m.cfg, muxLabel, m.dispatch, m.stats, m.events, m.logger, func(l *wsLink) {
+		l.offerMux = true
+		l.onConnect = m.negotiate
+	})
+
+	done := make(chan struct{})
+	m.link, m.linkDone = link, done
+
+	go func() {
+		link.run()
+
+		m.mu.Lock()
+		if m.link == link {
+			m.link = nil
+		}
+		m.mu.Unlock()
+		close(done)
+	}()
+}
+
+// multiplexesWith reports whether the subprotocol selected by the server
+// enables multiplexing
+func multiplexesWith(subprotocol string) bool {
+	return subprotocol == muxSubprotocol || subprotocol == muxFragmentSubprotocol
+}
+
+// negotiate checks that the server selected the multiplexing subprotocol
+func (m *muxClient) negotiate(conn *websocket.Conn) error {
+	supported := multiplexesWith(conn.Subprotocol())
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	previous := m.state
+	if supported {
+		m.state = muxSupported
+	} else {
+		m.state = muxUnsupported
+	}
+	if previous == muxUnknown {
+		close(m.negotiated)
+	}
+
+	if !supported {
+		m.logger.Printf("udptlspipe: %v, using one connection per client", errMuxUnsupported)
+		// Stop all stripes, not just the one that found out
+		if m.link != nil {
+			m.link.close()
+			m.link = nil
+		}
+		return errMuxUnsupported
+	}
+	return nil
+}
+
+// dispatch hands a datagram received on the shared connection to its session
+func (m *muxClient) dispatch(frame []byte) {
+	flow, data, err := muxUnframe(frame)
+	if err != nil {
+		m.logger.Printf("udptlspipe: Failed to unpack message: %v", err)
+		return
+	}
+
+	m.mu.Lock()
+	session := m.flows[flow]
+	m.mu.Unlock()
+
+	// The session may have been closed since the datagram was sent
+	if session != nil {
+		session.deliver(data)
+	}
+}
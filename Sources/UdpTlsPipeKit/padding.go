@@ -0,0 +1,195 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2024 AmneziaWG. All Rights Reserved.
+ */
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"math/rand/v2"
+	"slices"
+	"time"
+)
+
+// Padding hides the sizes of the datagrams inside the messages that carry
+// them. How much padding a message gets is up to the padding policy of its
+// sender; receivers skip the padding whatever its length. The policies other
+// than uniform only hide sizes up to the largest message they pad to, so the
+// client splits datagrams into fragments that fit it, and doesn't use a
+// WebSocket connection to a server that can't reassemble them. Larger
+// messages, which only QUIC tunnels send, are padded to a multiple of it.
+//
+// The constant_rate policy also sends chaff, messages with an empty body,
+// whenever a connection has been idle for the chaff interval. Receivers drop
+// them; older servers relay them as empty datagrams, which WireGuard ignores.
+
+// paddingPolicy selects how messages are padded
+type paddingPolicy string
+
+const (
+	// paddingUniform pads to at least MinMessageLength, with a uniformly
+	// distributed random length up to MaxPaddingLength
+	paddingUniform paddingPolicy = "uniform"
+	// paddingBucket pads every message to the next of a few fixed sizes
+	paddingBucket paddingPolicy = "bucket"
+	// paddingHTTPS pads to sizes drawn from httpsRecordSizes
+	paddingHTTPS paddingPolicy = "https"
+	// paddingConstantRate pads every message to constantRateMessageSize and
+	// sends chaff when idle
+	paddingConstantRate paddingPolicy = "constant_rate"
+)
+
+const (
+	// messageHeaderSize is the framing overhead of packMessage, without padding
+	messageHeaderSize = 4
+	// constantRateMessageSize is the size of every message of the
+	// constant_rate policy, and the largest of the bucket and https ones
+	constantRateMessageSize = MaxMessageLength
+	// defaultChaffInterval is how long a connection may be idle with the
+	// constant_rate policy before chaff is sent
+	defaultChaffInterval = 100 * time.Millisecond
+)
+
+// defaultPaddingBuckets are the message sizes of the bucket policy
+var defaultPaddingBuckets = []int{128, 256, 512, 1024, constantRateMessageSize}
+
+// httpsRecordSizes is a coarse model of the TLS record sizes of browser HTTPS
+// traffic: small records for requests and HTTP/2 control frames, and mostly
+// full records for downloads. Each entry stands for the sizes above the
+// previous one, up to its own.
+var httpsRecordSizes = []struct{ size, weight int }{
+	{64, 12}, {128, 10}, {256, 7}, {512, 6}, {768, 4}, {1024, 4}, {1280, 5}, {constantRateMessageSize, 52},
+}
+
+// padder decides the padding of each message. Implementations must be safe
+// for concurrent use.
+type padder interface {
+	// paddingLength returns the padding for a message with a body of n bytes
+	paddingLength(n int) int
+	// bodyLimit returns the largest body whose size the padding hides
+	bodyLimit() int
+}
+
+// newPadder returns the padder of policy. buckets only applies to the bucket
+// policy, which uses defaultPaddingBuckets if it's empty.
+func newPadder(policy paddingPolicy, buckets []int) (padder, error) {
+	switch policy {
+	case paddingUniform:
+		return uniformPadder{}, nil
+	case paddingBucket:
+		if len(buckets) == 0 {
+			return bucketPadder{sizes: defaultPaddingBuckets}, nil
+		}
+		for i, size := range buckets {
+			if size <= messageHeaderSize+fragmentHeaderSize || size > MaxMessageLength {
+				return nil, fmt.Errorf("size %d is out of range, expected %d to %d", size, messageHeaderSize+fragmentHeaderSize+1, MaxMessageLength)
+			}
+			if i > 0 && size <= buckets[i-1] {
+				return nil, errors.New("sizes must be in ascending order")
+			}
+		}
+		return bucketPadder{sizes: slices.Clone(buckets)}, nil
+	case paddingHTTPS:
+		return newDistributionPadder(httpsRecordSizes), nil
+	case paddingConstantRate:
+		return bucketPadder{sizes: []int{constantRateMessageSize}}, nil
+	default:
+		return nil, fmt.Errorf("unknown policy %q", policy)
+	}
+}
+
+// cappedPadder pads as padder does, but keeps the body and padding of a
+// message within limit bytes, for messages that must fit in a QUIC datagram
+type cappedPadder struct {
+	padder
+	limit int
+}
+
+func (p cappedPadder) paddingLength(n int) int {
+	return min(p.padder.paddingLength(n), max(0, p.limit-n))
+}
+
+// uniformPadder implements paddingUniform
+type uniformPadder struct{}
+
+func (uniformPadder) paddingLength(n int) int {
+	low := max(1, MinMessageLength-n)
+	high := max(MaxPaddingLength, low+1)
+	return low + rand.IntN(high-low)
+}
+
+// bodyLimit is MaxMessageLength, since uniform padding never hid sizes
+func (uniformPadder) bodyLimit() int {
+	return MaxMessageLength
+}
+
+// bucketPadder pads messages to the smallest of sizes they fit in. Larger
+// messages are padded to a multiple of the largest size.
+type bucketPadder struct {
+	sizes []int // ascending
+}
+
+func (p bucketPadder) paddingLength(n int) int {
+	size := n + messageHeaderSize
+	i, _ := slices.BinarySearch(p.sizes, size)
+	if i == len(p.sizes) {
+		return paddingToMultiple(size, p.sizes[i-1])
+	}
+	return p.sizes[i] - size
+}
+
+func (p bucketPadder) bodyLimit() int {
+	return p.sizes[len(p.sizes)-1] - messageHeaderSize
+}
+
+// paddingToMultiple returns the padding of a message of size bytes to the
+// next multiple of largest
+func paddingToMultiple(size, largest int) int {
+	return (largest - size%largest) % largest
+}
+
+// distributionPadder pads messages to sizes drawn from a distribution, among
+// those they fit in. Larger messages are padded to a multiple of the largest
+// size.
+type distributionPadder struct {
+	sizes      []int // ascending
+	cumulative []int // total weight of sizes up to the same index
+}
+
+func newDistributionPadder(table []struct{ size, weight int }) *distributionPadder {
+	p := &distributionPadder{}
+	total := 0
+	for _, entry := range table {
+		total += entry.weight
+		p.sizes = append(p.sizes, entry.size)
+		p.cumulative = append(p.cumulative, total)
+	}
+	return p
+}
+
+func (p *distributionPadder) paddingLength(n int) int {
+	size := n + messageHeaderSize
+	i, _ := slices.BinarySearch(p.sizes, size)
+	if i == len(p.sizes) {
+		return paddingToMultiple(size, p.sizes[i-1])
+	}
+
+	// Draw an entry from i on, then a size within the entry
+	below := 0
+	if i > 0 {
+		below = p.cumulative[i-1]
+	}
+	pick := below + rand.IntN(p.cumulative[len(p.cumulative)-1]-below)
+	j, _ := slices.BinarySearch(p.cumulative, pick+1)
+	low := size
+	if j > 0 {
+		low = max(size, p.sizes[j-1]+1)
+	}
+	return low + rand.IntN(p.sizes[j]-low+1) - size
+}
+
+func (p *distributionPadder) bodyLimit() int {
+	return p.sizes[len(p.sizes)-1] - messageHeaderSize
+}
@@ -0,0 +1,163 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2024 AmneziaWG. All Rights Reserved.
+ */
+
+package main
+
+import (
+	"slices"
+	"testing"
+	"time"
+)
+
+// messageSizes returns the size of the message packed for a body of each
+// length from 0 to maxLength
+func messageSizes(t *testing.T, p padder, maxLength int) []int {
+	t.Helper()
+	var sizes []int
+	for n := 0; n <= maxLength; n++ {
+		msg := packMessage(make([]byte, n), p)
+		if body, err := unpackMessage(msg); err != nil || len(body) != n {
+			t.Fatalf("body of %d bytes unpacked to %d bytes: %v", n, len(body), err)
+		}
+		sizes = append(sizes, len(msg))
+	}
+	return sizes
+}
+
+func TestPaddingPolicies(t *testing.T) {
+	tests := []struct {
+		policy  paddingPolicy
+		buckets []int
+		// allowed are the message sizes the policy may produce up to limit
+		allowed []int
+		limit   int
+	}{
+		{paddingBucket, nil, defaultPaddingBuckets, MaxMessageLength},
+		{paddingBucket, []int{100, 600}, []int{100, 600}, 600},
+		{paddingConstantRate, nil, []int{MaxMessageLength}, MaxMessageLength},
+	}
+	for _, tt := range tests {
+		t.Run(string(tt.policy), func(t *testing.T) {
+			p, err := newPadder(tt.policy, tt.buckets)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := p.bodyLimit(); got != tt.limit-messageHeaderSize {
+				t.Errorf("bodyLimit = %d, want %d", got, tt.limit-messageHeaderSize)
+			}
+			for n, size := range messageSizes(t, p, p.bodyLimit()) {
+				if !slices.Contains(tt.allowed, size) {
+					t.Fatalf("body of %d bytes packed to %d bytes, want one of %v", n, size, tt.allowed)
+				}
+			}
+			// Larger messages are padded to multiples of the largest size
+			largest := tt.allowed[len(tt.allowed)-1]
+			for _, n := range []int{p.bodyLimit() + 1, 2*largest - messageHeaderSize, 2*largest + 7} {
+				if size := len(packMessage(make([]byte, n), p)); size%largest != 0 {
+					t.Errorf("body of %d bytes packed to %d bytes, want a multiple of %d", n, size, largest)
+				}
+			}
+		})
+	}
+
+	t.Run(string(paddingHTTPS), func(t *testing.T) {
+		p, err := newPadder(paddingHTTPS, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := p.bodyLimit(); got != MaxMessageLength-messageHeaderSize {
+			t.Errorf("bodyLimit = %d, want %d", got, MaxMessageLength-messageHeaderSize)
+		}
+		for range 20 {
+			for n, size := range messageSizes(t, p, p.bodyLimit()) {
+				if size < n+messageHeaderSize || size > MaxMessageLength {
+					t.Fatalf("body of %d bytes packed to %d bytes, want %d to %d", n, size, n+messageHeaderSize, MaxMessageLength)
+				}
+			}
+		}
+		if size := len(packMessage(make([]byte, MaxMessageLength), p)); size != 2*MaxMessageLength {
+			t.Errorf("body of %d bytes packed to %d bytes, want %d", MaxMessageLength, size, 2*MaxMessageLength)
+		}
+	})
+
+	t.Run(string(paddingUniform), func(t *testing.T) {
+		p, err := newPadder(paddingUniform, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := p.bodyLimit(); got != MaxMessageLength {
+			t.Errorf("bodyLimit = %d, want %d", got, MaxMessageLength)
+		}
+		for n, size := range messageSizes(t, p, MaxMessageLength) {
+			padding := size - n - messageHeaderSize
+			if padding < 1 || padding >= max(MaxPaddingLength, MinMessageLength-n+1) || size < MinMessageLength {
+				t.Fatalf("body of %d bytes got %d bytes of padding", n, padding)
+			}
+		}
+	})
+}
+
+func TestPaddingBucketsRange(t *testing.T) {
+	for _, buckets := range [][]int{
+		{messageHeaderSize + fragmentHeaderSize, 256},
+		{128, MaxMessageLength + 1},
+		{256, 128},
+		{128, 128},
+	} {
+		if _, err := newPadder(paddingBucket, buckets); err == nil {
+			t.Errorf("buckets %v accepted", buckets)
+		}
+	}
+}
+
+func TestCappedPadder(t *testing.T) {
+	const limit = 1200
+	for _, policy := range []paddingPolicy{paddingUniform, paddingBucket, paddingHTTPS, paddingConstantRate} {
+		p, err := newPadder(policy, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		capped := cappedPadder{p, limit}
+		for n, size := range messageSizes(t, capped, limit) {
+			if size > limit+messageHeaderSize {
+				t.Fatalf("%s: body of %d bytes packed to %d bytes, want at most %d", policy, n, size, limit+messageHeaderSize)
+			}
+		}
+		// Bodies over the limit aren't padded at all
+		if size := len(packMessage(make([]byte, limit+1), capped)); size != limit+1+messageHeaderSize {
+			t.Errorf("%s: body of %d bytes packed to %d bytes, want %d", policy, limit+1, size, limit+1+messageHeaderSize)
+		}
+	}
+}
+
+func TestFragmentsFitPadding(t *testing.T) {
+	p, err := newPadder(paddingConstantRate, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f := newFragmenter(true)
+	f.bodyLimit = p.bodyLimit()
+	bodies, err := f.split(make([]byte, 3000))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, body := range bodies {
+		if size := len(packMessage(body, p)); size != constantRateMessageSize {
+			t.Errorf("fragment %d packed to %d bytes, want %d", i, size, constantRateMessageSize)
+		}
+	}
+
+	r := newFragmenter(true)
+	var data []byte
+	var ok bool
+	for _, body := range bodies {
+		if data, ok, err = r.join(body, time.Now()); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if !ok || len(data) != 3000 {
+		t.Errorf("reassembled %d bytes (complete: %t), want 3000", len(data), ok)
+	}
+}
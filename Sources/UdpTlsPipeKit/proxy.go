@@ -0,0 +1,316 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2024 AmneziaWG. All Rights Reserved.
+ */
+
+package main
+
+import (
+	"bufio"
+	"context"
+	stdtls "crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+)
+
+// The proxy handshakes are implemented here rather than left to
+// websocket.Dialer.Proxy: gorilla/websocket performs its own crypto/tls
+// handshake after the proxy tunnel is up, which would replace the uTLS
+// ClientHello exactly where fingerprinting matters most.
+
+const (
+	socks5Version       = 0x05
+	socks5AuthNone      = 0x00
+	socks5AuthPassword  = 0x02
+	socks5AuthNoMethods = 0xff
+	socks5CmdConnect    = 0x01
+	socks5AddrIPv4      = 0x01
+	socks5AddrDomain    = 0x03
+	socks5AddrIPv6      = 0x04
+)
+
+// parseProxyURL validates a proxy URL. Supported schemes are "http" (HTTP
+// CONNECT), "https" (HTTP CONNECT over TLS), "socks5" (target resolved
+// locally) and "socks5h" (target resolved by the proxy). Credentials may be
+// given as user info. An empty string means no proxy and returns nil.
+func parseProxyURL(proxy string) (*url.URL, error) {
+	if proxy == "" {
+		return nil, nil
+	}
+
+	u, err := url.Parse(proxy)
+	if err != nil {
+		return nil, newPipeError(errorInvalidConfig, fmt.Errorf("invalid proxy URL: %w", err))
+	}
+
+	switch u.Scheme {
+	case "http", "https", "socks5", "socks5h":
+	default:
+		return nil, newPipeError(errorInvalidConfig, fmt.Errorf("unsupported proxy scheme %q", u.Scheme))
+	}
+	if u.Hostname() == "" {
+		return nil, newPipeError(errorInvalidConfig, fmt.Errorf("proxy URL %q has no host", proxy))
+	}
+	return u, nil
+}
+
+// proxyAddress returns the host:port of the proxy, applying the default port
+// for its scheme.
+func proxyAddress(u *url.URL) string {
+	port := u.Port()
+	if port == "" {
+		switch u.Scheme {
+		case "http":
+			port = "80"
+		case "https":
+			port = "443"
+		default:
+			port = "1080"
+		}
+	}
+	return net.JoinHostPort(u.Hostname(), port)
+}
+
+// dialTCP opens a TCP connection to addr, through proxy if it's not nil. The
+// certificate of an https proxy is verified against proxyRoots if it's not nil.
+func dialTCP(ctx context.Context, network, addr string, proxy *url.URL, proxyRoots *x509.CertPool) (net.Conn, error) {
+	dialer := &net.Dialer{
+		Timeout: dialTimeout,
+	}
+
+	if proxy == nil {
+		conn, err := dialer.DialContext(ctx, network, addr)
+		if err != nil {
+			return nil, newPipeError(netErrorCode(err), fmt.Errorf("failed to dial TCP: %w", err))
+		}
+		return conn, nil
+	}
+
+	conn, err := dialer.DialContext(ctx, network, proxyAddress(proxy))
+	if err != nil {
+		return nil, newPipeError(errorProxy, fmt.Errorf("failed to dial proxy: %w", err))
+	}
+
+	// Bound the handshake by the context, then hand over a clean connection
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	} else {
+		conn.SetDeadline(time.Now().Add(dialTimeout))
+	}
+	stop := context.AfterFunc(ctx, func() {
+		conn.SetDeadline(time.Now())
+	})
+
+	tunnel := conn
+	switch proxy.Scheme {
+	case "http":
+		tunnel, err = httpConnect(conn, proxy, addr)
+	case "https":
+		tunnel, err = httpsConnect(ctx, conn, proxy, proxyRoots, addr)
+	default:
+		err = socks5Connect(ctx, conn, proxy, addr)
+	}
+
+	if !stop() && err == nil {
+		err = ctx.Err()
+	}
+	if err != nil {
+		conn.Close()
+		return nil, newPipeError(errorProxy, err)
+	}
+	conn.SetDeadline(time.Time{})
+	return tunnel, nil
+}
+
+// httpConnect establishes a tunnel to addr with an HTTP CONNECT request
+func httpConnect(conn net.Conn, proxy *url.URL, addr string) (net.Conn, error) {
+	req := &http.Request{
+		Method: http.MethodConnect,
+		URL:    &url.URL{Opaque: addr},
+		Host:   addr,
+		Header: http.Header{},
+	}
+	if proxy.User != nil {
+		password, _ := proxy.User.Password()
+		credentials := proxy.User.Username() + ":" + password
+		req.Header.Set("Proxy-Authorization", "Basic "+base64.StdEncoding.EncodeToString([]byte(credentials)))
+	}
+
+	if err := req.Write(conn); err != nil {
+		return nil, fmt.Errorf("failed to send CONNECT request: %w", err)
+	}
+
+	br := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(br, req)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read CONNECT response: %w", err)
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("proxy refused CONNECT: %s", resp.Status)
+	}
+
+	// Don't lose anything the proxy sent along with its response
+	if br.Buffered() > 0 {
+		return &bufferedConn{Conn: conn, r: br}, nil
+	}
+	return conn, nil
+}
+
+// httpsConnect establishes a tunnel to addr with an HTTP CONNECT request over
+// TLS to the proxy. The proxy's certificate is always verified, against roots
+// if it's not nil or else the system roots, whatever the trust settings of the
+// destination, which only cover the inner connection.
+func httpsConnect(ctx context.Context, conn net.Conn, proxy *url.URL, roots *x509.CertPool, addr string) (net.Conn, error) {
+	tlsConn := stdtls.Client(conn, &stdtls.Config{
+		ServerName: proxy.Hostname(),
+		RootCAs:    roots,
+		NextProtos: []string{alpnHTTP1},
+	})
+	if err := tlsConn.HandshakeContext(ctx); err != nil {
+		return nil, fmt.Errorf("TLS handshake with proxy failed: %w", err)
+	}
+	return httpConnect(tlsConn, proxy, addr)
+}
+
+// bufferedConn is a net.Conn whose reads drain a bufio.Reader first
+type bufferedConn struct {
+	net.Conn
+	r *bufio.Reader
+}
+
+func (c *bufferedConn) Read(b []byte) (int, error) {
+	return c.r.Read(b)
+}
+
+// socks5Connect establishes a tunnel to addr with a SOCKS5 CONNECT command,
+// authenticating with username and password (RFC 1929) if the URL has them.
+func socks5Connect(ctx context.Context, conn net.Conn, proxy *url.URL, addr string) error {
+	host, portStr, err := net.SplitHostPort(addr)
+	if err != nil {
+		return err
+	}
+	port, err := strconv.ParseUint(portStr, 10, 16)
+	if err != nil {
+		return fmt.Errorf("invalid port %q", portStr)
+	}
+
+	// Greeting: offer password authentication only when we have credentials
+	methods := []byte{socks5AuthNone}
+	if proxy.User != nil {
+		methods = append(methods, socks5AuthPassword)
+	}
+	greeting := append([]byte{socks5Version, byte(len(methods))}, methods...)
+	if _, err := conn.Write(greeting); err != nil {
+		return fmt.Errorf("failed to send SOCKS5 greeting: %w", err)
+	}
+
+	reply := make([]byte, 2)
+	if _, err := io.ReadFull(conn, reply); err != nil {
+		return fmt.Errorf("failed to read SOCKS5 greeting: %w", err)
+	}
+	if reply[0] != socks5Version {
+		return fmt.Errorf("unexpected SOCKS version %d", reply[0])
+	}
+
+	switch reply[1] {
+	case socks5AuthNone:
+	case socks5AuthPassword:
+		if proxy.User == nil {
+			return errors.New("SOCKS5 proxy requires authentication")
+		}
+		username := proxy.User.Username()
+		password, _ := proxy.User.Password()
+		if len(username) > 255 || len(password) > 255 {
+			return errors.New("SOCKS5 username or password too long")
+		}
+
+		auth := []byte{0x01, byte(len(username))}
+		auth = append(auth, username...)
+		auth = append(auth, byte(len(password)))
+		auth = append(auth, password...)
+		if _, err := conn.Write(auth); err != nil {
+			return fmt.Errorf("failed to send SOCKS5 credentials: %w", err)
+		}
+		if _, err := io.ReadFull(conn, reply); err != nil {
+			return fmt.Errorf("failed to read SOCKS5 authentication reply: %w", err)
+		}
+		if reply[1] != 0x00 {
+			return errors.New("SOCKS5 proxy rejected credentials")
+		}
+	case socks5AuthNoMethods:
+		return errors.New("SOCKS5 proxy accepts none of the offered authentication methods")
+	default:
+		return fmt.Errorf("SOCKS5 proxy selected unsupported authentication method %d", reply[1])
+	}
+
+	// With "socks5" the target is resolved here, with "socks5h" by the proxy
+	req := []byte{socks5Version, socks5CmdConnect, 0x00}
+	ip := net.ParseIP(host)
+	if ip == nil && proxy.Scheme == "socks5" {
+		addrs, err := net.DefaultResolver.LookupIP(ctx, "ip", host)
+		if err != nil {
+			return err
+		}
+		ip = addrs[0]
+	}
+	switch {
+	case ip == nil:
+		if len(host) > 255 {
+			return fmt.Errorf("host name %q too long", host)
+		}
+		req = append(req, socks5AddrDomain, byte(len(host)))
+		req = append(req, host...)
+	case ip.To4() != nil:
+		req = append(req, socks5AddrIPv4)
+		req = append(req, ip.To4()...)
+	default:
+		req = append(req, socks5AddrIPv6)
+		req = append(req, ip.To16()...)
+	}
+	req = binary.BigEndian.AppendUint16(req, uint16(port))
+
+	if _, err := conn.Write(req); err != nil {
+		return fmt.Errorf("failed to send SOCKS5 request: %w", err)
+	}
+
+	// Reply: VER REP RSV ATYP BND.ADDR BND.PORT
+	header := make([]byte, 4)
+	if _, err := io.ReadFull(conn, header); err != nil {
+		return fmt.Errorf("failed to read SOCKS5 reply: %w", err)
+	}
+	if header[1] != 0x00 {
+		return fmt.Errorf("SOCKS5 proxy failed to connect: reply code %d", header[1])
+	}
+
+	var skip int
+	switch header[3] {
+	case socks5AddrIPv4:
+		skip = net.IPv4len
+	case socks5AddrIPv6:
+		skip = net.IPv6len
+	case socks5AddrDomain:
+		length := make([]byte, 1)
+		if _, err := io.ReadFull(conn, length); err != nil {
+			return fmt.Errorf("failed to read SOCKS5 reply: %w", err)
+		}
+		skip = int(length[0])
+	default:
+		return fmt.Errorf("unexpected SOCKS5 address type %d", header[3])
+	}
+	if _, err := io.ReadFull(conn, make([]byte, skip+2)); err != nil {
+		return fmt.Errorf("failed to read SOCKS5 reply: %w", err)
+	}
+
+	return nil
+}
@@ -0,0 +1,387 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2024 AmneziaWG. All Rights Reserved.
+ */
+
+package main
+
+import (
+	"bufio"
+	"context"
+	stdtls "crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/binary"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"slices"
+	"strconv"
+	"testing"
+	"time"
+
+	tls "github.com/refraction-networking/utls"
+)
+
+// listenTest listens on a loopback port for the duration of the test
+func listenTest(t *testing.T) net.Listener {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	return ln
+}
+
+// serveTest calls handle with each connection accepted on ln
+func serveTest(ln net.Listener, handle func(net.Conn)) {
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				handle(conn)
+			}()
+		}
+	}()
+}
+
+// relay copies between a and b until either side is done
+func relay(a, b net.Conn) {
+	go io.Copy(a, b)
+	io.Copy(b, a)
+}
+
+func (c *testCert) tlsCertificate() stdtls.Certificate {
+	return stdtls.Certificate{Certificate: [][]byte{c.cert.Raw}, PrivateKey: c.key}
+}
+
+// startTLSTarget starts a TLS server for localhost that reports the
+// ClientHello of each connection
+func startTLSTarget(t *testing.T) (string, <-chan *stdtls.ClientHelloInfo) {
+	hellos := make(chan *stdtls.ClientHelloInfo, 4)
+	config := &stdtls.Config{
+		Certificates: []stdtls.Certificate{newTestCert(t, nil, "localhost").tlsCertificate()},
+		GetConfigForClient: func(hello *stdtls.ClientHelloInfo) (*stdtls.Config, error) {
+			hellos <- hello
+			return nil, nil
+		},
+	}
+	ln := listenTest(t)
+	serveTest(ln, func(conn net.Conn) {
+		stdtls.Server(conn, config).Handshake()
+	})
+	return ln.Addr().String(), hellos
+}
+
+// dialTestFingerprint connects to the target port on localhost with the
+// Chrome fingerprint through proxy, whose certificate is verified against
+// proxyRoots
+func dialTestFingerprint(t *testing.T, proxy string, target string, proxyRoots *x509.CertPool) error {
+	t.Helper()
+	proxyURL, err := parseProxyURL(proxy)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, port, _ := net.SplitHostPort(target)
+	trust, _ := newTLSTrust(false, nil, "", "")
+	trust.proxyRoots = proxyRoots
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	conn, err := dialTLSWithFingerprint(ctx, "tcp", net.JoinHostPort("localhost", port), dialOptions{
+		serverName:    "localhost",
+		trust:         trust,
+		proxy:         proxyURL,
+		clientHelloID: tls.HelloChrome_120,
+		label:         "test",
+		stats:         newPipeStats(1),
+	})
+	if err == nil {
+		conn.Close()
+	}
+	return err
+}
+
+// withoutGREASE drops the GREASE values, which are random, from a list of
+// cipher suites
+func withoutGREASE(suites []uint16) []uint16 {
+	return slices.DeleteFunc(slices.Clone(suites), func(suite uint16) bool {
+		return suite&0x0f0f == 0x0a0a
+	})
+}
+
+// checkChromeHello checks that the target got the uTLS ClientHello of Chrome
+func checkChromeHello(t *testing.T, hellos <-chan *stdtls.ClientHelloInfo) {
+	t.Helper()
+	var hello *stdtls.ClientHelloInfo
+	select {
+	case hello = <-hellos:
+	case <-time.After(5 * time.Second):
+		t.Fatal("no ClientHello reached the target")
+	}
+	spec, err := customProfileSet(nil).clientHelloSpec(tls.HelloChrome_120)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := withoutGREASE(hello.CipherSuites), withoutGREASE(spec.CipherSuites); !slices.Equal(got, want) {
+		t.Errorf("cipher suites %x, want those of Chrome %x", got, want)
+	}
+	if !slices.Equal(hello.SupportedProtos, []string{alpnHTTP2, alpnHTTP1}) {
+		t.Errorf("ALPN %q", hello.SupportedProtos)
+	}
+	if hello.ServerName != "localhost" {
+		t.Errorf("SNI %q", hello.ServerName)
+	}
+}
+
+// startHTTPProxy starts an HTTP CONNECT proxy that requires the credentials
+// user and password if user isn't empty, and relays every tunnel to target.
+// It reports the authority of each CONNECT request.
+func startHTTPProxy(t *testing.T, config *stdtls.Config, user, password, target string) (net.Addr, <-chan string) {
+	requests := make(chan string, 4)
+	ln := listenTest(t)
+	if config != nil {
+		ln = stdtls.NewListener(ln, config)
+	}
+	serveTest(ln, func(conn net.Conn) {
+		br := bufio.NewReader(conn)
+		req, err := http.ReadRequest(br)
+		if err != nil || req.Method != http.MethodConnect {
+			return
+		}
+		if user != "" && req.Header.Get("Proxy-Authorization") != "Basic "+base64.StdEncoding.EncodeToString([]byte(user+":"+password)) {
+			io.WriteString(conn, "HTTP/1.1 407 Proxy Authentication Required\r\n\r\n")
+			return
+		}
+		requests <- req.Host
+		upstream, err := net.Dial("tcp", target)
+		if err != nil {
+			io.WriteString(conn, "HTTP/1.1 502 Bad Gateway\r\n\r\n")
+			return
+		}
+		defer upstream.Close()
+		io.WriteString(conn, "HTTP/1.1 200 Connection established\r\n\r\n")
+		relay(conn, upstream)
+	})
+	return ln.Addr(), requests
+}
+
+func TestHTTPProxy(t *testing.T) {
+	target, hellos := startTLSTarget(t)
+	addr, requests := startHTTPProxy(t, nil, "user", "secret", target)
+
+	if err := dialTestFingerprint(t, "http://user:secret@"+addr.String(), target, nil); err != nil {
+		t.Fatal(err)
+	}
+	checkChromeHello(t, hellos)
+	_, port, _ := net.SplitHostPort(target)
+	if authority := <-requests; authority != net.JoinHostPort("localhost", port) {
+		t.Errorf("CONNECT to %q", authority)
+	}
+
+	err := dialTestFingerprint(t, "http://user:wrong@"+addr.String(), target, nil)
+	if errorCode(err) != errorProxy {
+		t.Errorf("wrong password: %v", err)
+	}
+}
+
+// TestHTTPProxyEarlyData checks that bytes the proxy sends in the same read
+// as its response aren't lost
+func TestHTTPProxyEarlyData(t *testing.T) {
+	ln := listenTest(t)
+	serveTest(ln, func(conn net.Conn) {
+		if _, err := http.ReadRequest(bufio.NewReader(conn)); err != nil {
+			return
+		}
+		io.WriteString(conn, "HTTP/1.1 200 Connection established\r\n\r\nearly")
+		io.Copy(io.Discard, conn)
+	})
+
+	proxyURL, _ := parseProxyURL("http://" + ln.Addr().String())
+	conn, err := dialTCP(context.Background(), "tcp", "target.example:443", proxyURL, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	buf := make([]byte, 5)
+	if _, err := io.ReadFull(conn, buf); err != nil || string(buf) != "early" {
+		t.Errorf("read %q, %v", buf, err)
+	}
+}
+
+func TestHTTPSProxy(t *testing.T) {
+	target, hellos := startTLSTarget(t)
+	ca := newTestCert(t, nil)
+	config := &stdtls.Config{Certificates: []stdtls.Certificate{newTestCert(t, ca, "localhost").tlsCertificate()}}
+	addr, _ := startHTTPProxy(t, config, "", "", target)
+	_, port, _ := net.SplitHostPort(addr.String())
+	proxy := "https://" + net.JoinHostPort("localhost", port)
+
+	// The proxy's certificate is verified against the system roots
+	if err := dialTestFingerprint(t, proxy, target, nil); errorCode(err) != errorProxy {
+		t.Fatalf("untrusted proxy: %v", err)
+	}
+
+	roots := x509.NewCertPool()
+	roots.AddCert(ca.cert)
+	if err := dialTestFingerprint(t, proxy, target, roots); err != nil {
+		t.Fatal(err)
+	}
+	checkChromeHello(t, hellos)
+}
+
+// startSOCKS5Proxy starts a SOCKS5 proxy that requires the credentials user
+// and password (RFC 1929) if user isn't empty, and relays every connection to
+// target. It reports the address of each CONNECT command as requested.
+func startSOCKS5Proxy(t *testing.T, user, password, target string) (net.Addr, <-chan string) {
+	requests := make(chan string, 4)
+	ln := listenTest(t)
+	serveTest(ln, func(conn net.Conn) {
+		header := make([]byte, 2)
+		if _, err := io.ReadFull(conn, header); err != nil {
+			return
+		}
+		methods := make([]byte, header[1])
+		if _, err := io.ReadFull(conn, methods); err != nil {
+			return
+		}
+		method := byte(socks5AuthNone)
+		if user != "" {
+			method = socks5AuthPassword
+		}
+		if !slices.Contains(methods, method) {
+			conn.Write([]byte{socks5Version, socks5AuthNoMethods})
+			return
+		}
+		conn.Write([]byte{socks5Version, method})
+
+		if method == socks5AuthPassword {
+			br := bufio.NewReader(conn)
+			version, _ := br.ReadByte()
+			length, _ := br.ReadByte()
+			gotUser := make([]byte, length)
+			io.ReadFull(br, gotUser)
+			length, _ = br.ReadByte()
+			gotPassword := make([]byte, length)
+			if _, err := io.ReadFull(br, gotPassword); err != nil || version != 0x01 {
+				return
+			}
+			if string(gotUser) != user || string(gotPassword) != password {
+				conn.Write([]byte{0x01, 0x01})
+				return
+			}
+			conn.Write([]byte{0x01, 0x00})
+		}
+
+		request := make([]byte, 4)
+		if _, err := io.ReadFull(conn, request); err != nil || request[1] != socks5CmdConnect {
+			return
+		}
+		var host string
+		switch request[3] {
+		case socks5AddrIPv4, socks5AddrIPv6:
+			ip := make(net.IP, net.IPv4len)
+			if request[3] == socks5AddrIPv6 {
+				ip = make(net.IP, net.IPv6len)
+			}
+			io.ReadFull(conn, ip)
+			host = ip.String()
+		case socks5AddrDomain:
+			length := make([]byte, 1)
+			io.ReadFull(conn, length)
+			name := make([]byte, length[0])
+			io.ReadFull(conn, name)
+			host = string(name)
+		}
+		port := make([]byte, 2)
+		if _, err := io.ReadFull(conn, port); err != nil {
+			return
+		}
+		requests <- net.JoinHostPort(host, strconv.Itoa(int(binary.BigEndian.Uint16(port))))
+
+		upstream, err := net.Dial("tcp", target)
+		if err != nil {
+			conn.Write([]byte{socks5Version, 0x05, 0x00, socks5AddrIPv4, 0, 0, 0, 0, 0, 0})
+			return
+		}
+		defer upstream.Close()
+		conn.Write([]byte{socks5Version, 0x00, 0x00, socks5AddrIPv4, 127, 0, 0, 1, 0, 0})
+		relay(conn, upstream)
+	})
+	return ln.Addr(), requests
+}
+
+func TestSOCKS5Proxy(t *testing.T) {
+	target, hellos := startTLSTarget(t)
+	_, port, _ := net.SplitHostPort(target)
+
+	tests := []struct {
+		name     string
+		user     string
+		password string
+		scheme   string
+		// remote tells whether the proxy resolves the host name
+		remote bool
+	}{
+		{"no auth, remote resolution", "", "", "socks5h", true},
+		{"no auth, local resolution", "", "", "socks5", false},
+		{"password auth", "user", "secret", "socks5h", true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			addr, requests := startSOCKS5Proxy(t, test.user, test.password, target)
+			proxy := url.URL{Scheme: test.scheme, Host: addr.String()}
+			if test.user != "" {
+				proxy.User = url.UserPassword(test.user, test.password)
+			}
+
+			if err := dialTestFingerprint(t, proxy.String(), target, nil); err != nil {
+				t.Fatal(err)
+			}
+			checkChromeHello(t, hellos)
+
+			host, gotPort, _ := net.SplitHostPort(<-requests)
+			switch {
+			case gotPort != port:
+				t.Errorf("CONNECT to port %s", gotPort)
+			case test.remote && host != "localhost":
+				t.Errorf("CONNECT to %q, want the host name", host)
+			case !test.remote && net.ParseIP(host) == nil:
+				t.Errorf("CONNECT to %q, want an IP address", host)
+			}
+		})
+	}
+
+	t.Run("wrong password", func(t *testing.T) {
+		addr, _ := startSOCKS5Proxy(t, "user", "secret", target)
+		err := dialTestFingerprint(t, "socks5h://user:wrong@"+addr.String(), target, nil)
+		if errorCode(err) != errorProxy {
+			t.Errorf("wrong password: %v", err)
+		}
+	})
+}
+
+func TestParseProxyURL(t *testing.T) {
+	for proxy, ok := range map[string]bool{
+		"":                       true,
+		"http://proxy:3128":      true,
+		"https://proxy":          true,
+		"socks5://u:p@proxy":     true,
+		"socks5h://proxy:1080":   true,
+		"ftp://proxy":            false,
+		"http://":                false,
+		"socks4://proxy.example": false,
+	} {
+		if _, err := parseProxyURL(proxy); (err == nil) != ok {
+			t.Errorf("parseProxyURL(%q) = %v", proxy, err)
+		}
+	}
+	if addr := proxyAddress(&url.URL{Scheme: "https", Host: "proxy"}); addr != "proxy:443" {
+		t.Errorf("https proxy address %s", addr)
+	}
+}
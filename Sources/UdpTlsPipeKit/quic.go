@@ -0,0 +1,603 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2024 AmneziaWG. All Rights Reserved.
+ */
+
+package main
+
+import (
+	"context"
+	stdtls "crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/quic-go/quic-go"
+	"github.com/quic-go/quic-go/http3"
+	"github.com/quic-go/quic-go/quicvarint"
+)
+
+// The QUIC transport opens a tunnel in the style of CONNECT-UDP (RFC 9298):
+// an HTTP/3 extended CONNECT request with the protocol quicProtocol on the
+// configured path, authenticated like the WebSocket upgrade. Datagrams then
+// travel as HTTP datagrams (RFC 9297), each payload being
+//
+//	<varint>: context ID, always 0
+//	<message>: the datagram framed by packMessage
+//
+// Padding is cut short where it alone keeps a payload from fitting in a QUIC
+// datagram. Datagrams that don't fit even so, or all of them if the peer
+// doesn't support HTTP datagrams, are sent on the request stream instead as
+// DATAGRAM capsules with the same payload. The server relays each tunnel from
+// a UDP socket of its own.
+//
+// QUIC uses crypto/tls, so the fingerprint profile only sets the User-Agent.
+
+// pipeTransport selects how datagrams are carried to the server
+type pipeTransport string
+
+const (
+	// transportWebSocket carries datagrams as WebSocket messages over TCP
+	transportWebSocket pipeTransport = "websocket"
+	// transportQUIC carries datagrams as HTTP/3 datagrams over QUIC
+	transportQUIC pipeTransport = "quic"
+)
+
+const (
+	quicProtocol = "connect-udp"
+	alpnHTTP3    = "h3"
+	// quicContextID is the context ID of udptlspipe payloads
+	quicContextID = 0
+	// quicIdleTimeout is how long a QUIC connection may go without packets
+	// from the peer; keepalives are sent at half that
+	quicIdleTimeout = 2 * defaultPingInterval
+)
+
+// quicPayload frames data for the tunnel
+func quicPayload(data []byte, p padder) []byte {
+	return append(quicvarint.Append(nil, quicContextID), packMessage(data, p)...)
+}
+
+// parseQUICPayload extracts the datagram from a tunnel payload. ok is false
+// for payloads of other contexts, which are ignored.
+func parseQUICPayload(payload []byte) (data []byte, ok bool, err error) {
+	contextID, n, err := quicvarint.Parse(payload)
+	if err != nil {
+		return nil, false, err
+	}
+	if contextID != quicContextID {
+		return nil, false, nil
+	}
+	data, err = unpackMessage(payload[n:])
+	return data, err == nil, err
+}
+
+// quicLink is the QUIC counterpart of wsLink: a tunnel to the server that is
+// redialed with backoff when it drops, until too many attempts in a row fail.
+type quicLink struct {
+	ctx    context.Context
+	cancel context.CancelFunc
+	cfg    *pipeConfig
+	label  string
+	// deliver is called with each datagram received from the server
+	deliver func(data []byte)
+	stats   *pipeStats
+	events  EventSink
+	logger  CLogger
+
+	mu        sync.Mutex
+	stream    *http3.RequestStream
+	datagrams bool          // whether the server accepts HTTP datagrams
+	up        chan struct{} // closed while stream is set
+}
+
+func newQUICLink(parentCtx context.Context, cfg *pipeConfig, label string, deliver func([]byte), stats *pipeStats, events EventSink, logger CLogger) *quicLink {
+	ctx, cancel := context.WithCancel(parentCtx)
+	return &quicLink{
+		ctx:     ctx,
+		cancel:  cancel,
+		cfg:     cfg,
+		label:   label,
+		deliver: deliver,
+		stats:   stats,
+		events:  events,
+		logger:  logger,
+		up:      make(chan struct{}),
+	}
+}
+
+// run keeps the link connected until it's closed or gives up reconnecting
+func (l *quicLink) run() {
+	defer l.cancel()
+	keepConnected(l.ctx, l.cfg, l.stats, l.logger, l.connectAndServe)
+}
+
+// connectAndServe dials the server once and relays traffic until the tunnel
+// fails or the link is closed. It reports whether the tunnel was established.
+func (l *quicLink) connectAndServe(attempt int) bool {
+	cfg := l.cfg
+	_, userAgent := cfg.fingerprints.pick(l.logger)
+
+	l.logger.Printf("udptlspipe: Connecting to %s over QUIC (SNI: %s, attempt %d)", cfg.Destination, cfg.serverName, attempt)
+	l.events.Emit(eventConnecting, 0, map[string]interface{}{
+		"client":      l.label,
+		"destination": cfg.Destination,
+		"attempt":     attempt,
+	})
+
+	conn, stream, datagrams, err := l.dial(userAgent)
+	if err != nil {
+		if l.ctx.Err() == nil {
+			l.events.ReportError(err)
+			l.stats.handshakeFailures.Add(1)
+			l.logger.Printf("udptlspipe: Failed to connect (attempt %d): %v", attempt, err)
+			l.emitDisconnected(disconnectDialFailed, err)
+		}
+		return false
+	}
+
+	// Closing the link closes the connection, which ends the read loops below
+	connCtx, connCancel := context.WithCancel(l.ctx)
+	context.AfterFunc(connCtx, func() {
+		conn.CloseWithError(0, "")
+	})
+	l.stats.connectionUp()
+	defer func() {
+		l.mu.Lock()
+		l.stream = nil
+		l.up = make(chan struct{})
+		l.mu.Unlock()
+		connCancel()
+		l.stats.connectionDown()
+	}()
+
+	l.mu.Lock()
+	l.stream = stream
+	l.datagrams = datagrams
+	close(l.up)
+	l.mu.Unlock()
+
+	l.logger.Printf("udptlspipe: Connected to %s over QUIC (attempt %d, datagrams: %t)", cfg.Destination, attempt, datagrams)
+	l.events.Emit(eventWebSocketUp, 0, map[string]interface{}{
+		"client":      l.label,
+		"destination": cfg.Destination,
+	})
+
+	// Datagrams may arrive both ways; the tunnel is over once the stream ends
+	if datagrams {
+		go func() {
+			for {
+				payload, err := stream.ReceiveDatagram(connCtx)
+				if err != nil {
+					return
+				}
+				l.handlePayload(payload)
+			}
+		}()
+	}
+
+	err = readCapsules(stream, l.handlePayload)
+	switch {
+	case l.ctx.Err() != nil:
+		l.emitDisconnected(disconnectClosed, nil)
+	case err == nil || errors.Is(err, io.EOF):
+		l.emitDisconnected(disconnectRemoteClosed, err)
+	default:
+		l.logger.Printf("udptlspipe: QUIC read error: %v", err)
+		l.emitDisconnected(disconnectReadError, err)
+	}
+	return true
+}
+
+// dial establishes the QUIC connection and the tunnel on it. datagrams tells
+// whether the server accepts HTTP datagrams.
+func (l *quicLink) dial(userAgent string) (*quic.Conn, *http3.RequestStream, bool, error) {
+	cfg := l.cfg
+
+	dialCtx, cancel := context.WithTimeout(l.ctx, dialTimeout)
+	defer cancel()
+
+	echConfigList, err := cfg.ech.configList(dialCtx, true, l.logger)
+	if err != nil {
+		return nil, nil, false, err
+	}
+	conn, err := l.handshake(dialCtx, echConfigList)
+	if retryList, retry := cfg.ech.rejected(err, echConfigList, cfg.trust, l.logger); retry {
+		conn, err = l.handshake(dialCtx, retryList)
+	}
+	if err != nil {
+		return nil, nil, false, err
+	}
+
+	stream, datagrams, err := l.openTunnel(dialCtx, conn, userAgent)
+	if err != nil {
+		conn.CloseWithError(0, "")
+		return nil, nil, false, err
+	}
+	return conn, stream, datagrams, nil
+}
+
+// handshake establishes the QUIC connection, with ECH if echConfigList isn't
+// nil
+func (l *quicLink) handshake(ctx context.Context, echConfigList []byte) (*quic.Conn, error) {
+	cfg := l.cfg
+
+	tlsConfig := &stdtls.Config{
+		ServerName:         cfg.serverName,
+		NextProtos:         []string{alpnHTTP3},
+		ClientSessionCache: cfg.stdSessions(l.logger),
+	}
+	cfg.trust.applyStd(tlsConfig)
+	if echConfigList != nil {
+		tlsConfig.EncryptedClientHelloConfigList = echConfigList
+		cfg.trust.applyStdECH(tlsConfig)
+	}
+
+	conn, err := quic.DialAddr(ctx, cfg.Destination, tlsConfig, &quic.Config{
+		EnableDatagrams: true,
+		MaxIdleTimeout:  quicIdleTimeout,
+		KeepAlivePeriod: quicIdleTimeout / 2,
+	})
+	if err != nil {
+		return nil, classifyQUICError(err)
+	}
+
+	state := conn.ConnectionState()
+	l.logger.Printf("udptlspipe: QUIC handshake completed (%s, resumed: %t, ECH: %t)", stdtls.VersionName(state.TLS.Version), state.TLS.DidResume, state.TLS.ECHAccepted)
+	if cfg.sessions != nil {
+		l.stats.addResumption(state.TLS.DidResume)
+	}
+	l.events.Emit(eventTLSHandshake, 0, map[string]interface{}{
+		"client":  l.label,
+		"version": stdtls.VersionName(state.TLS.Version),
+		"alpn":    state.TLS.NegotiatedProtocol,
+		"resumed": state.TLS.DidResume,
+		"ech":     state.TLS.ECHAccepted,
+	})
+	return conn, nil
+}
+
+// openTunnel sends the extended CONNECT request and checks the response
+func (l *quicLink) openTunnel(ctx context.Context, conn *quic.Conn, userAgent string) (*http3.RequestStream, bool, error) {
+	cfg := l.cfg
+
+	transport := &http3.Transport{EnableDatagrams: true}
+	clientConn := transport.NewClientConn(conn)
+
+	// Extended CONNECT may only be used once the server allowed it
+	select {
+	case <-clientConn.ReceivedSettings():
+	case <-ctx.Done():
+		return nil, false, newPipeError(errorConnect, fmt.Errorf("no HTTP/3 settings from server: %w", ctx.Err()))
+	}
+	settings := clientConn.Settings()
+	if !settings.EnableExtendedConnect {
+		return nil, false, newPipeError(errorConnect, errors.New("server doesn't support extended CONNECT over HTTP/3"))
+	}
+
+	tunnelURL := *cfg.wsURL
+	tunnelURL.Scheme = "https"
+	header := cfg.header.Clone()
+	if header.Get("User-Agent") == "" {
+		header.Set("User-Agent", userAgent)
+	}
+	header.Set("Capsule-Protocol", "?1")
+	l.stats.setFingerprint("", header.Get("User-Agent"))
+	switch {
+	case cfg.Password == "":
+	case cfg.AuthMode == authHMAC:
+		// The same token as in a WebSocket upgrade, in the same header
+		header.Set("Sec-Websocket-Protocol", authSubprotocol+", "+newAuthToken(cfg.Password, time.Now()))
+	default:
+		query := tunnelURL.Query()
+		query.Set("password", cfg.Password)
+		tunnelURL.RawQuery = query.Encode()
+	}
+
+	host := tunnelURL.Host
+	if h := header.Get("Host"); h != "" {
+		host = h
+		header.Del("Host")
+	}
+
+	stream, err := clientConn.OpenRequestStream(ctx)
+	if err != nil {
+		return nil, false, newPipeError(errorConnect, fmt.Errorf("failed to open request stream: %w", err))
+	}
+	req := &http.Request{
+		Method: http.MethodConnect,
+		Proto:  quicProtocol,
+		URL:    &tunnelURL,
+		Host:   host,
+		Header: header,
+	}
+	if err := stream.SendRequestHeader(req); err != nil {
+		return nil, false, newPipeError(errorConnect, fmt.Errorf("failed to send CONNECT request: %w", err))
+	}
+
+	// ReadResponse blocks on the stream, which the dial deadline doesn't cover
+	stop := context.AfterFunc(ctx, func() {
+		stream.CancelRead(quic.StreamErrorCode(http3.ErrCodeRequestCanceled))
+	})
+	resp, err := stream.ReadResponse()
+	stop()
+	if err != nil {
+		return nil, false, newPipeError(errorConnect, fmt.Errorf("failed to read CONNECT response: %w", err))
+	}
+	switch {
+	case resp.StatusCode == http.StatusUnauthorized || resp.StatusCode == http.StatusForbidden:
+		return nil, false, newPipeError(errorAuth, fmt.Errorf("server rejected tunnel: %s", resp.Status))
+	case resp.StatusCode < 200 || resp.StatusCode > 299:
+		return nil, false, newPipeError(errorConnect, fmt.Errorf("server rejected tunnel: %s", resp.Status))
+	}
+
+	return stream, settings.EnableDatagrams, nil
+}
+
+func (l *quicLink) handlePayload(payload []byte) {
+	data, ok, err := parseQUICPayload(payload)
+	if err != nil {
+		l.logger.Printf("udptlspipe: Failed to unpack message: %v", err)
+		return
+	}
+	if ok {
+		l.deliver(data)
+	}
+}
+
+func (l *quicLink) emitDisconnected(reason int, err error) {
+	detail := map[string]interface{}{
+		"client": l.label,
+	}
+	if err != nil {
+		detail["error"] = err.Error()
+		detail["error_code"] = int(errorCode(err))
+	}
+	l.events.Emit(eventDisconnected, reason, detail)
+}
+
+// waitUp blocks until the tunnel is established. It returns false once ctx
+// is done or the link has stopped.
+func (l *quicLink) waitUp(ctx context.Context) bool {
+	l.mu.Lock()
+	up := l.up
+	l.mu.Unlock()
+
+	select {
+	case <-up:
+		return true
+	case <-ctx.Done():
+		return false
+	case <-l.ctx.Done():
+		return false
+	}
+}
+
+func (l *quicLink) write(data []byte) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.stream == nil {
+		return errLinkDown
+	}
+
+	capsule, err := sendQUICPayload(l.stream, l.datagrams, data, l.cfg.padder)
+	if capsule {
+		l.stats.capsuleFallbacks.Add(1)
+	}
+	return err
+}
+
+// datagramStream is the request stream of a tunnel, on either end
+type datagramStream interface {
+	io.Writer
+	SendDatagram(payload []byte) error
+	SetWriteDeadline(t time.Time) error
+}
+
+// sendQUICPayload sends data on stream, as an HTTP datagram if datagrams is
+// set and it fits, or else as a DATAGRAM capsule. capsule reports whether it
+// went as a capsule.
+func sendQUICPayload(stream datagramStream, datagrams bool, data []byte, p padder) (capsule bool, err error) {
+	payload := quicPayload(data, p)
+	if datagrams {
+		err := stream.SendDatagram(payload)
+		var tooLarge *quic.DatagramTooLargeError
+		if !errors.As(err, &tooLarge) {
+			return false, err
+		}
+		limit := int(tooLarge.MaxDatagramPayloadSize) - quicvarint.Len(quicContextID) - messageHeaderSize
+		if len(data) <= limit {
+			err := stream.SendDatagram(quicPayload(data, cappedPadder{p, limit}))
+			if !errors.As(err, &tooLarge) {
+				return false, err
+			}
+		}
+		// Too large for the path even unpadded, the stream can take it
+	}
+	stream.SetWriteDeadline(time.Now().Add(writeTimeout))
+	return true, http3.WriteCapsule(quicvarint.NewWriter(stream), quicDatagramCapsule, payload)
+}
+
+// close stops the link and closes its connection
+func (l *quicLink) close() {
+	l.cancel()
+}
+
+// quicDatagramCapsule is the DATAGRAM capsule type of RFC 9297
+const quicDatagramCapsule http3.CapsuleType = 0x00
+
+// readCapsules passes the payloads of the DATAGRAM capsules read from r to
+// handle until r fails. Other capsules are skipped.
+func readCapsules(r io.Reader, handle func(payload []byte)) error {
+	reader := quicvarint.NewReader(r)
+	for {
+		capsuleType, value, err := http3.ParseCapsule(reader)
+		if err != nil {
+			return err
+		}
+		payload, err := io.ReadAll(io.LimitReader(value, bufferSize+maxQUICOverhead))
+		if err != nil {
+			return err
+		}
+		// Drain what's left of an oversized capsule
+		if _, err := io.Copy(io.Discard, value); err != nil {
+			return err
+		}
+		if capsuleType == quicDatagramCapsule {
+			handle(payload)
+		}
+	}
+}
+
+// maxQUICOverhead is the largest context ID and message header of a payload
+const maxQUICOverhead = 8 + 2 + MaxPaddingLength + 2
+
+// classifyQUICError tags an error returned by quic.DialAddr
+func classifyQUICError(err error) error {
+	var transportErr *quic.TransportError
+	if errors.As(err, &transportErr) && transportErr.ErrorCode.IsCryptoError() {
+		return newPipeError(errorTLS, fmt.Errorf("TLS handshake failed: %w", err))
+	}
+	return newPipeError(netErrorCode(err), err)
+}
+
+// isQUICTunnel reports whether r opens a QUIC tunnel
+func isQUICTunnel(r *http.Request) bool {
+	return r.ProtoMajor == 3 && r.Method == http.MethodConnect && r.Proto == quicProtocol
+}
+
+// listenQUIC serves handler over HTTP/3 on the UDP address addr until ctx is
+// done.
+func listenQUIC(ctx context.Context, addr string, cert stdtls.Certificate, handler http.Handler, logger CLogger) (*http3.Server, error) {
+	udpConn, err := net.ListenPacket("udp", addr)
+	if err != nil {
+		return nil, fmt.Errorf("failed to listen on UDP: %w", err)
+	}
+
+	server := &http3.Server{
+		Handler:         handler,
+		EnableDatagrams: true,
+		TLSConfig: http3.ConfigureTLSConfig(&stdtls.Config{
+			Certificates: []stdtls.Certificate{cert},
+		}),
+		QUICConfig: &quic.Config{
+			EnableDatagrams: true,
+			MaxIdleTimeout:  quicIdleTimeout,
+		},
+	}
+
+	go func() {
+		<-ctx.Done()
+		server.Close()
+	}()
+	go func() {
+		if err := server.Serve(udpConn); err != nil && ctx.Err() == nil && !errors.Is(err, http.ErrServerClosed) {
+			logger.Printf("udptlspipe: QUIC server failed: %v", err)
+		}
+	}()
+
+	logger.Printf("udptlspipe: QUIC server listening on %s", udpConn.LocalAddr())
+	return server, nil
+}
+
+// relayQUIC forwards datagrams between a QUIC tunnel and a fresh UDP socket
+// connected to the upstream until either side fails.
+func (p *pipeServer) relayQUIC(w http.ResponseWriter, r *http.Request) {
+	streamer, ok := w.(http3.HTTPStreamer)
+	if !ok {
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+	remoteAddr := r.RemoteAddr
+
+	udpConn, err := net.DialUDP("udp", nil, p.upstreamAddr)
+	if err != nil {
+		p.logger.Printf("udptlspipe: Failed to dial upstream for %s: %v", remoteAddr, err)
+		http.Error(w, http.StatusText(http.StatusBadGateway), http.StatusBadGateway)
+		return
+	}
+	defer udpConn.Close()
+
+	w.Header().Set("Capsule-Protocol", "?1")
+	w.WriteHeader(http.StatusOK)
+	stream := streamer.HTTPStream()
+	defer stream.Close()
+
+	p.logger.Printf("udptlspipe: Client %s connected (QUIC)", remoteAddr)
+
+	ctx, cancel := context.WithCancel(p.ctx)
+	defer cancel()
+	go func() {
+		<-ctx.Done()
+		stream.CancelRead(quic.StreamErrorCode(http3.ErrCodeNoError))
+		udpConn.Close()
+	}()
+
+	handle := func(payload []byte) {
+		data, ok, err := parseQUICPayload(payload)
+		if err != nil {
+			p.logger.Printf("udptlspipe: Failed to unpack message from %s: %v", remoteAddr, err)
+			return
+		}
+		if !ok {
+			return
+		}
+		if _, err := udpConn.Write(data); err != nil {
+			p.logger.Printf("udptlspipe: Upstream write error for %s: %v", remoteAddr, err)
+		}
+	}
+
+	// Upstream to client, as datagrams while they fit
+	go func() {
+		defer cancel()
+		buf := make([]byte, bufferSize)
+		for {
+			n, err := udpConn.Read(buf)
+			if err != nil {
+				if ctx.Err() == nil {
+					p.logger.Printf("udptlspipe: Upstream read error for %s: %v", remoteAddr, err)
+				}
+				return
+			}
+
+			if _, err := sendQUICPayload(stream, true, buf[:n], uniformPadder{}); err != nil {
+				if ctx.Err() == nil {
+					p.logger.Printf("udptlspipe: QUIC write error for %s: %v", remoteAddr, err)
+				}
+				return
+			}
+		}
+	}()
+
+	// Client to upstream
+	go func() {
+		for {
+			payload, err := stream.ReceiveDatagram(ctx)
+			if err != nil {
+				return
+			}
+			handle(payload)
+		}
+	}()
+	err = readCapsules(stream, handle)
+	if ctx.Err() == nil && err != nil && !errors.Is(err, io.EOF) && !isStreamCanceled(err) {
+		p.logger.Printf("udptlspipe: QUIC read error for %s: %v", remoteAddr, err)
+	}
+
+	p.logger.Printf("udptlspipe: Client %s disconnected", remoteAddr)
+}
+
+// isStreamCanceled reports whether err is the end of a QUIC stream or
+// connection closed by the peer without an error
+func isStreamCanceled(err error) bool {
+	var appErr *quic.ApplicationError
+	if errors.As(err, &appErr) && appErr.ErrorCode == 0 {
+		return true
+	}
+	var streamErr *quic.StreamError
+	return errors.As(err, &streamErr)
+}
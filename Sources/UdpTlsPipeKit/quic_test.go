@@ -0,0 +1,67 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2024 AmneziaWG. All Rights Reserved.
+ */
+
+package main
+
+import (
+	"bytes"
+	"testing"
+	"time"
+
+	"github.com/quic-go/quic-go"
+)
+
+// limitedStream takes datagrams of up to limit bytes, like a QUIC path
+type limitedStream struct {
+	bytes.Buffer // the capsules
+	limit        int
+	datagrams    [][]byte
+}
+
+func (s *limitedStream) SendDatagram(payload []byte) error {
+	if len(payload) > s.limit {
+		return &quic.DatagramTooLargeError{MaxDatagramPayloadSize: int64(s.limit)}
+	}
+	s.datagrams = append(s.datagrams, payload)
+	return nil
+}
+
+func (s *limitedStream) SetWriteDeadline(time.Time) error {
+	return nil
+}
+
+func TestSendQUICPayload(t *testing.T) {
+	const maxPayload = 1200
+	tests := []struct {
+		name    string
+		size    int
+		capsule bool
+	}{
+		{"small", 100, false},
+		// Fits only once the padding is cut short
+		{"padding cut", maxPayload - 5, false},
+		{"too large unpadded", maxPayload - 4, true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			stream := &limitedStream{limit: maxPayload}
+			data := bytes.Repeat([]byte{1}, test.size)
+			capsule, err := sendQUICPayload(stream, true, data, uniformPadder{})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if capsule != test.capsule || (stream.Len() > 0) != test.capsule {
+				t.Fatalf("capsule %t with %d bytes on the stream, want %t", capsule, stream.Len(), test.capsule)
+			}
+			if test.capsule {
+				return
+			}
+			got, ok, err := parseQUICPayload(stream.datagrams[0])
+			if err != nil || !ok || !bytes.Equal(got, data) {
+				t.Errorf("datagram carries %d bytes, ok %t, %v", len(got), ok, err)
+			}
+		})
+	}
+}
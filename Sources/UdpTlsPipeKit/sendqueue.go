@@ -0,0 +1,159 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2024 AmneziaWG. All Rights Reserved.
+ */
+
+package main
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// The send queue of a session holds datagrams while the connection is busy
+// or reconnecting. WireGuard handshake and cookie messages are queued apart
+// from the data and always sent first, so that a backlog of data can't delay
+// a handshake past its retry timeout; when the queue is full, the drop policy
+// decides which datagram is lost.
+
+// packetClass is the kind of a WireGuard datagram, by its message type
+type packetClass int
+
+const (
+	// classData is transport data (type 4), and anything that isn't WireGuard
+	classData packetClass = iota
+	// classControl is a handshake initiation (1), handshake response (2) or
+	// cookie reply (3)
+	classControl
+)
+
+// classifyPacket tells WireGuard handshake and cookie messages, which start
+// with their type and three zero bytes, from everything else. AmneziaWG
+// configurations with custom message headers are all classified as data.
+func classifyPacket(data []byte) packetClass {
+	if len(data) < 4 || data[1] != 0 || data[2] != 0 || data[3] != 0 {
+		return classData
+	}
+	switch data[0] {
+	case 1, 2, 3:
+		return classControl
+	default:
+		return classData
+	}
+}
+
+// dropPolicy decides which datagram is dropped when the send queue is full
+type dropPolicy string
+
+const (
+	// dropData drops the arriving datagram if it's data; control datagrams
+	// take the place of the oldest queued data instead
+	dropData dropPolicy = "drop_data"
+	// dropNewest drops the arriving datagram
+	dropNewest dropPolicy = "drop_newest"
+	// dropOldest drops the oldest queued datagram to make room
+	dropOldest dropPolicy = "drop_oldest"
+)
+
+// sendQueueSize is the number of datagrams a session can hold back
+const sendQueueSize = 256
+
+// queuedPacket is a datagram waiting to be written to the WebSocket
+type queuedPacket struct {
+	data     []byte
+	class    packetClass
+	queuedAt time.Time
+}
+
+// sendQueue is a bounded queue that serves control datagrams before data
+type sendQueue struct {
+	policy dropPolicy
+	// dropped is called with every datagram the queue drops
+	dropped func(packet queuedPacket)
+
+	mu      sync.Mutex
+	control []queuedPacket
+	data    []queuedPacket
+	ready   chan struct{} // signaled when a datagram is queued
+}
+
+func newSendQueue(policy dropPolicy, dropped func(queuedPacket)) *sendQueue {
+	return &sendQueue{
+		policy:  policy,
+		dropped: dropped,
+		ready:   make(chan struct{}, 1),
+	}
+}
+
+// push queues packet, or drops a datagram to make room for it as the policy
+// says. It reports whether packet was queued.
+func (q *sendQueue) push(packet queuedPacket) bool {
+	q.mu.Lock()
+	var evicted *queuedPacket
+	if len(q.control)+len(q.data) >= sendQueueSize {
+		var victim *[]queuedPacket
+		switch {
+		case q.policy == dropNewest:
+		case q.policy == dropOldest:
+			victim = &q.data
+			if len(q.control) > 0 && (len(q.data) == 0 || q.control[0].queuedAt.Before(q.data[0].queuedAt)) {
+				victim = &q.control
+			}
+		case packet.class == classControl && len(q.data) > 0:
+			victim = &q.data
+		case packet.class == classControl:
+			victim = &q.control
+		}
+		if victim == nil {
+			q.mu.Unlock()
+			q.dropped(packet)
+			return false
+		}
+		oldest := (*victim)[0]
+		*victim = (*victim)[1:]
+		evicted = &oldest
+	}
+
+	if packet.class == classControl {
+		q.control = append(q.control, packet)
+	} else {
+		q.data = append(q.data, packet)
+	}
+	q.mu.Unlock()
+
+	if evicted != nil {
+		q.dropped(*evicted)
+	}
+	select {
+	case q.ready <- struct{}{}:
+	default:
+	}
+	return true
+}
+
+// pop removes the next datagram, control first, waiting for one if the queue
+// is empty. It returns false once ctx is done.
+func (q *sendQueue) pop(ctx context.Context) (queuedPacket, bool) {
+	for {
+		q.mu.Lock()
+		var packet queuedPacket
+		var ok bool
+		switch {
+		case len(q.control) > 0:
+			packet, q.control, ok = q.control[0], q.control[1:], true
+		case len(q.data) > 0:
+			packet, q.data, ok = q.data[0], q.data[1:], true
+		}
+		q.mu.Unlock()
+		if ok {
+			return packet, true
+		}
+
+		select {
+		case <-ctx.Done():
+			return queuedPacket{}, false
+		case <-q.ready:
+		}
+	}
+}
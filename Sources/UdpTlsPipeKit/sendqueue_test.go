@@ -0,0 +1,164 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2024 AmneziaWG. All Rights Reserved.
+ */
+
+package main
+
+import (
+	"context"
+	"encoding/binary"
+	"testing"
+	"time"
+)
+
+func TestClassifyPacket(t *testing.T) {
+	tests := []struct {
+		name string
+		data []byte
+		want packetClass
+	}{
+		{"handshake initiation", []byte{1, 0, 0, 0, 0xaa}, classControl},
+		{"handshake response", []byte{2, 0, 0, 0, 0xaa}, classControl},
+		{"cookie reply", []byte{3, 0, 0, 0, 0xaa}, classControl},
+		{"transport data", []byte{4, 0, 0, 0, 0xaa}, classData},
+		{"initiation with reserved byte 1 set", []byte{1, 1, 0, 0}, classData},
+		{"response with reserved byte 2 set", []byte{2, 0, 1, 0}, classData},
+		{"cookie with reserved byte 3 set", []byte{3, 0, 0, 1}, classData},
+		{"type 0", []byte{0, 0, 0, 0}, classData},
+		{"custom header", []byte{0x5a, 0x1f, 0x3c, 0x9e}, classData},
+		{"too short", []byte{1, 0, 0}, classData},
+		{"empty", nil, classData},
+	}
+	for _, tt := range tests {
+		if got := classifyPacket(tt.data); got != tt.want {
+			t.Errorf("%s: classifyPacket = %d, want %d", tt.name, got, tt.want)
+		}
+	}
+}
+
+// testPacket returns datagram n of class, queued n milliseconds after the
+// others with a lower n
+func testPacket(class packetClass, n int) queuedPacket {
+	msgType := byte(4)
+	if class == classControl {
+		msgType = 1
+	}
+	data := []byte{msgType, 0, 0, 0, 0, 0}
+	binary.BigEndian.PutUint16(data[4:], uint16(n))
+	return queuedPacket{
+		data:     data,
+		class:    classifyPacket(data),
+		queuedAt: time.Unix(0, 0).Add(time.Duration(n) * time.Millisecond),
+	}
+}
+
+// packetNumber returns the n of a packet from testPacket
+func packetNumber(packet queuedPacket) int {
+	return int(binary.BigEndian.Uint16(packet.data[4:]))
+}
+
+func TestSendQueueFull(t *testing.T) {
+	const (
+		oldestControl = 0
+		oldestData    = 1
+		arriving      = sendQueueSize
+	)
+	tests := []struct {
+		name   string
+		policy dropPolicy
+		// onlyControl fills the queue with control datagrams only
+		onlyControl bool
+		class       packetClass
+		queued      bool
+		dropped     int
+	}{
+		{"drop_data drops arriving data", dropData, false, classData, false, arriving},
+		{"drop_data evicts data for control", dropData, false, classControl, true, oldestData},
+		{"drop_data evicts control without data", dropData, true, classControl, true, oldestControl},
+		{"drop_newest drops arriving data", dropNewest, false, classData, false, arriving},
+		{"drop_newest drops arriving control", dropNewest, false, classControl, false, arriving},
+		{"drop_oldest evicts the oldest for data", dropOldest, false, classData, true, oldestControl},
+		{"drop_oldest evicts the oldest for control", dropOldest, false, classControl, true, oldestControl},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var dropped []int
+			q := newSendQueue(tt.policy, func(packet queuedPacket) {
+				dropped = append(dropped, packetNumber(packet))
+			})
+			// The oldest datagram is control, the rest data unless onlyControl
+			q.push(testPacket(classControl, oldestControl))
+			for n := 1; n < sendQueueSize; n++ {
+				class := classData
+				if tt.onlyControl {
+					class = classControl
+				}
+				if !q.push(testPacket(class, n)) {
+					t.Fatalf("datagram %d dropped before the queue was full", n)
+				}
+			}
+
+			if got := q.push(testPacket(tt.class, arriving)); got != tt.queued {
+				t.Errorf("push = %t, want %t", got, tt.queued)
+			}
+			if len(dropped) != 1 || dropped[0] != tt.dropped {
+				t.Fatalf("dropped %v, want [%d]", dropped, tt.dropped)
+			}
+
+			// Everything but the dropped datagram is still there
+			ctx, cancel := context.WithCancel(context.Background())
+			cancel()
+			count := 0
+			for {
+				packet, ok := q.pop(ctx)
+				if !ok {
+					break
+				}
+				if packetNumber(packet) == tt.dropped {
+					t.Errorf("dropped datagram %d was popped", tt.dropped)
+				}
+				count++
+			}
+			if count != sendQueueSize {
+				t.Errorf("popped %d datagrams, want %d", count, sendQueueSize)
+			}
+		})
+	}
+}
+
+func TestSendQueueControlFirst(t *testing.T) {
+	q := newSendQueue(dropData, func(queuedPacket) { t.Error("datagram dropped") })
+	for n, class := range []packetClass{classData, classData, classControl, classData, classControl} {
+		q.push(testPacket(class, n))
+	}
+
+	// Control datagrams jump the queue, and each class stays in order
+	var order []int
+	for range 5 {
+		packet, ok := q.pop(context.Background())
+		if !ok {
+			t.Fatal("pop failed")
+		}
+		order = append(order, packetNumber(packet))
+	}
+	want := []int{2, 4, 0, 1, 3}
+	for i := range want {
+		if order[i] != want[i] {
+			t.Fatalf("popped %v, want %v", order, want)
+		}
+	}
+}
+
+func TestSendQueueWait(t *testing.T) {
+	q := newSendQueue(dropData, func(queuedPacket) {})
+	go func() {
+		time.Sleep(10 * time.Millisecond)
+		q.push(testPacket(classData, 7))
+	}()
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if packet, ok := q.pop(ctx); !ok || packetNumber(packet) != 7 {
+		t.Errorf("pop = %v, %t, want datagram 7", packet.data, ok)
+	}
+}
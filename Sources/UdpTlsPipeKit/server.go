@@ -0,0 +1,263 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2024 AmneziaWG. All Rights Reserved.
+ */
+
+package main
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/subtle"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"errors"
+	"fmt"
+	"math/big"
+	"net"
+	"net/http"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+const (
+	// Timeout for reading the HTTP upgrade request
+	serverReadHeaderTimeout = 10 * time.Second
+	// Timeout for graceful HTTP server shutdown
+	serverShutdownTimeout = 5 * time.Second
+)
+
+// runUdpTlsPipeServer runs the udptlspipe server that accepts TLS WebSocket
+// connections and relays the datagrams carried by each of them to a UDP
+// upstream. Every client session gets its own upstream UDP socket, mirroring
+// the one-connection-per-client model of runUdpTlsPipeClient, or one per flow
+// if the client multiplexes, see mux.go. The stripes of a session share its
+// sockets, see serversession.go.
+//
+// Upgrades are accepted on path only, over HTTP/1.1 or, if net/http has
+// extended CONNECT enabled, over HTTP/2, see h2.go. If quicAddr is not empty,
+// QUIC tunnels are accepted on that UDP address as well, see quic.go. Clients
+// authenticate with the password in the URL query or with an HMAC token, see
+// auth.go; requireHMAC rejects the former. If certFile and keyFile are empty,
+// a self-signed certificate is generated.
+func runUdpTlsPipeServer(
+	ctx context.Context,
+	listenAddr string,
+	quicAddr string,
+	path string,
+	upstream string,
+	password string,
+	requireHMAC bool,
+	certFile string,
+	keyFile string,
+	logger CLogger,
+) error {
+	upstreamAddr, err := net.ResolveUDPAddr("udp", upstream)
+	if err != nil {
+		return fmt.Errorf("invalid upstream address: %w", err)
+	}
+
+	cert, err := loadServerCertificate(certFile, keyFile)
+	if err != nil {
+		return err
+	}
+
+	listener, err := net.Listen("tcp", listenAddr)
+	if err != nil {
+		return fmt.Errorf("failed to listen on TCP: %w", err)
+	}
+
+	srv := &pipeServer{
+		ctx:          ctx,
+		upstreamAddr: upstreamAddr,
+		path:         path,
+		password:     password,
+		requireHMAC:  requireHMAC,
+		replay:       newReplayGuard(),
+		logger:       logger,
+		upgrader: websocket.Upgrader{
+			// Prefer multiplexing, then fragmentation, then
+			// authSubprotocol; the token itself is never selected
+			Subprotocols: pipeSubprotocols,
+			// udptlspipe clients are not browsers, there's no origin to check
+			CheckOrigin: func(r *http.Request) bool { return true },
+		},
+	}
+
+	// WebSockets over HTTP/2 need extended CONNECT; without it, h2 must not
+	// be offered or clients selecting it couldn't open a WebSocket
+	var protocols http.Protocols
+	protocols.SetHTTP1(true)
+	protocols.SetHTTP2(extendedConnectEnabled())
+
+	httpServer := &http.Server{
+		Handler:           srv,
+		ReadHeaderTimeout: serverReadHeaderTimeout,
+		Protocols:         &protocols,
+		TLSConfig: &tls.Config{
+			Certificates: []tls.Certificate{cert},
+			MinVersion:   tls.VersionTLS12,
+		},
+	}
+
+	if quicAddr != "" {
+		if _, err := listenQUIC(ctx, quicAddr, cert, srv, logger); err != nil {
+			listener.Close()
+			return err
+		}
+	}
+
+	go func() {
+		<-ctx.Done()
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), serverShutdownTimeout)
+		defer cancel()
+		httpServer.Shutdown(shutdownCtx)
+	}()
+
+	logger.Printf("udptlspipe: Server listening on %s, upstream %s (HTTP/2: %t)", listener.Addr(), upstreamAddr, protocols.HTTP2())
+
+	err = httpServer.ServeTLS(listener, "", "")
+	srv.wg.Wait()
+	if errors.Is(err, http.ErrServerClosed) {
+		return nil
+	}
+	return err
+}
+
+// pipeSubprotocols are the subprotocols the server selects from, in order of
+// preference. The auth token a client offers next to authSubprotocol is not
+// one of them, so it's never selected.
+var pipeSubprotocols = []string{muxFragmentSubprotocol, muxSubprotocol, fragmentSubprotocol, authSubprotocol}
+
+// pipeServer handles WebSocket upgrades for runUdpTlsPipeServer
+type pipeServer struct {
+	ctx          context.Context
+	upstreamAddr *net.UDPAddr
+	path         string
+	password     string
+	requireHMAC  bool
+	replay       *replayGuard
+	logger       CLogger
+	upgrader     websocket.Upgrader
+	// wg tracks hijacked connections, which http.Server.Shutdown doesn't wait for
+	wg sync.WaitGroup
+
+	// sessions are the striped sessions by ID, see serversession.go
+	sessionsMu sync.Mutex
+	sessions   map[string]*serverSession
+}
+
+func (p *pipeServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	extendedConnect := isExtendedConnect(r)
+	quicTunnel := isQUICTunnel(r)
+	if r.URL.Path != p.path || !(quicTunnel || extendedConnect || websocket.IsWebSocketUpgrade(r)) {
+		http.NotFound(w, r)
+		return
+	}
+
+	if p.password != "" {
+		if err := p.authenticate(r); err != nil {
+			p.logger.Printf("udptlspipe: Rejected client %s: %v", r.RemoteAddr, err)
+			http.Error(w, http.StatusText(http.StatusForbidden), http.StatusForbidden)
+			return
+		}
+	}
+
+	if quicTunnel {
+		p.wg.Add(1)
+		defer p.wg.Done()
+		p.relayQUIC(w, r)
+		return
+	}
+
+	var conn *websocket.Conn
+	var err error
+	if extendedConnect {
+		conn, err = upgradeExtendedConnect(&p.upgrader, w, r, nil)
+	} else {
+		conn, err = p.upgrader.Upgrade(w, r, nil)
+	}
+	if err != nil {
+		// Upgrade has already replied to the client
+		p.logger.Printf("udptlspipe: WebSocket upgrade failed for %s: %v", r.RemoteAddr, err)
+		return
+	}
+
+	p.wg.Add(1)
+	defer p.wg.Done()
+	frag := newFragmenter(fragmentsWith(conn.Subprotocol()))
+	p.serve(conn, r.RemoteAddr, frag, multiplexesWith(conn.Subprotocol()), offeredStripeSession(r))
+}
+
+// authenticate checks the HMAC token if the client offers one, or else the
+// password in the URL query.
+func (p *pipeServer) authenticate(r *http.Request) error {
+	protocols := websocket.Subprotocols(r)
+	if slices.Contains(protocols, authSubprotocol) {
+		// The token is the one subprotocol that isn't ours
+		for _, token := range protocols {
+			if !slices.Contains(pipeSubprotocols, token) && !isStripeSubprotocol(token) {
+				return p.replay.verify(p.password, token, time.Now())
+			}
+		}
+		return errors.New("missing auth token")
+	}
+
+	if p.requireHMAC {
+		return errors.New("no auth token")
+	}
+	got := r.URL.Query().Get("password")
+	if subtle.ConstantTimeCompare([]byte(got), []byte(p.password)) != 1 {
+		return errors.New("invalid password")
+	}
+	return nil
+}
+
+// loadServerCertificate loads the certificate from the given PEM files or,
+// if both are empty, generates a self-signed one.
+func loadServerCertificate(certFile, keyFile string) (tls.Certificate, error) {
+	if certFile != "" || keyFile != "" {
+		cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+		if err != nil {
+			return tls.Certificate{}, fmt.Errorf("failed to load TLS certificate: %w", err)
+		}
+		return cert, nil
+	}
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return tls.Certificate{}, fmt.Errorf("failed to generate key: %w", err)
+	}
+
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return tls.Certificate{}, fmt.Errorf("failed to generate serial number: %w", err)
+	}
+
+	now := time.Now()
+	template := &x509.Certificate{
+		SerialNumber:          serial,
+		Subject:               pkix.Name{CommonName: "udptlspipe"},
+		NotBefore:             now.Add(-time.Hour),
+		NotAfter:              now.AddDate(1, 0, 0),
+		KeyUsage:              x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		BasicConstraintsValid: true,
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		return tls.Certificate{}, fmt.Errorf("failed to create certificate: %w", err)
+	}
+
+	return tls.Certificate{
+		Certificate: [][]byte{der},
+		PrivateKey:  key,
+	}, nil
+}
@@ -0,0 +1,371 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2024 AmneziaWG. All Rights Reserved.
+ */
+
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// The server relays each client session from upstream sockets of its own:
+// one for the session, or one per flow if the client multiplexes. A session
+// usually arrives over a single WebSocket, but a striped one arrives over
+// several, each offering the subprotocol stripeSubprotocolPrefix followed by
+// the ID of the session. The server never selects it, but relays all the
+// stripes with the same ID as one session: the upstream sees a single peer,
+// and the datagrams to the client are spread over the stripes that are
+// connected. The session ends with its last stripe.
+
+// serverSession is a client session on the server, with the connections it
+// arrives over
+type serverSession struct {
+	p          *pipeServer
+	id         string // striped session ID, empty without striping
+	remoteAddr string
+	mux        bool
+	ctx        context.Context
+	cancel     context.CancelFunc
+
+	mu    sync.Mutex
+	conns []*serverConn
+	next  int // round robin position of the next datagram to the client
+
+	// udpConn is the upstream socket without multiplexing
+	udpConn *net.UDPConn
+	// flows are the upstream sockets by flow ID with multiplexing
+	flowsMu sync.Mutex
+	flows   map[uint32]*serverFlow
+}
+
+// serverConn is a WebSocket connection of a serverSession
+type serverConn struct {
+	conn *websocket.Conn
+	frag *fragmenter
+	// writeMu serializes writes, and the split of frag with them
+	writeMu sync.Mutex
+	// left is set once the connection left its session, after which it's
+	// not written anymore
+	left bool
+}
+
+// serverFlow is the upstream socket of one flow of a multiplexed session
+type serverFlow struct {
+	udpConn    *net.UDPConn
+	lastActive atomic.Int64 // unix nanoseconds of the last datagram from the client
+}
+
+// offeredStripeSession returns the striped session ID that the client of r
+// offers, or an empty string
+func offeredStripeSession(r *http.Request) string {
+	for _, protocol := range websocket.Subprotocols(r) {
+		if id, ok := strings.CutPrefix(protocol, stripeSubprotocolPrefix); ok {
+			return id
+		}
+	}
+	return ""
+}
+
+// isStripeSubprotocol reports whether protocol carries a striped session ID
+func isStripeSubprotocol(protocol string) bool {
+	return strings.HasPrefix(protocol, stripeSubprotocolPrefix)
+}
+
+// serve relays the datagrams of conn, as a stripe of the session stripeID if
+// it's not empty, until conn fails or the session ends.
+func (p *pipeServer) serve(conn *websocket.Conn, remoteAddr string, frag *fragmenter, mux bool, stripeID string) {
+	defer conn.Close()
+
+	sc := &serverConn{conn: conn, frag: frag}
+	s, err := p.joinSession(stripeID, remoteAddr, mux, sc)
+	if err != nil {
+		p.logger.Printf("udptlspipe: Rejected client %s: %v", remoteAddr, err)
+		return
+	}
+	defer func() {
+		p.leaveSession(s, sc)
+		// A datagram to the client may still be on its way to conn, which
+		// mustn't be written once the handler returns, as with HTTP/2
+		sc.writeMu.Lock()
+		sc.left = true
+		sc.writeMu.Unlock()
+	}()
+
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		select {
+		case <-s.ctx.Done():
+			conn.Close()
+		case <-done:
+		}
+	}()
+
+	for {
+		_, framedData, err := conn.ReadMessage()
+		if err != nil {
+			if s.ctx.Err() == nil && err != io.EOF && !websocket.IsCloseError(err, websocket.CloseNormalClosure) {
+				p.logger.Printf("udptlspipe: WebSocket read error for %s: %v", remoteAddr, err)
+			}
+			break
+		}
+
+		body, err := unpackMessage(framedData)
+		if err != nil {
+			p.logger.Printf("udptlspipe: Failed to unpack message from %s: %v", remoteAddr, err)
+			continue
+		}
+		if len(body) == 0 {
+			// Chaff
+			continue
+		}
+		data, ok, err := frag.join(body, time.Now())
+		if err != nil {
+			p.logger.Printf("udptlspipe: Failed to reassemble message from %s: %v", remoteAddr, err)
+			continue
+		}
+		if ok {
+			s.fromClient(data)
+		}
+	}
+
+	p.logger.Printf("udptlspipe: Client %s disconnected", remoteAddr)
+}
+
+// joinSession adds sc to the session stripeID, or to a new session if there's
+// none or stripeID is empty
+func (p *pipeServer) joinSession(stripeID, remoteAddr string, mux bool, sc *serverConn) (*serverSession, error) {
+	p.sessionsMu.Lock()
+	defer p.sessionsMu.Unlock()
+
+	if s := p.sessions[stripeID]; stripeID != "" && s != nil {
+		if s.mux != mux {
+			return nil, errors.New("stripe disagrees with its session on multiplexing")
+		}
+		s.mu.Lock()
+		s.conns = append(s.conns, sc)
+		stripes := len(s.conns)
+		s.mu.Unlock()
+		p.logger.Printf("udptlspipe: Client %s joined a striped session (%d stripes)", remoteAddr, stripes)
+		return s, nil
+	}
+
+	ctx, cancel := context.WithCancel(p.ctx)
+	s := &serverSession{
+		p:          p,
+		id:         stripeID,
+		remoteAddr: remoteAddr,
+		mux:        mux,
+		ctx:        ctx,
+		cancel:     cancel,
+		conns:      []*serverConn{sc},
+	}
+	if mux {
+		s.flows = make(map[uint32]*serverFlow)
+		go s.expireFlows()
+	} else {
+		udpConn, err := net.DialUDP("udp", nil, p.upstreamAddr)
+		if err != nil {
+			cancel()
+			return nil, fmt.Errorf("failed to dial upstream: %w", err)
+		}
+		s.udpConn = udpConn
+		go s.upstream(0, udpConn)
+	}
+	context.AfterFunc(ctx, s.closeUpstream)
+
+	if stripeID != "" {
+		if p.sessions == nil {
+			p.sessions = make(map[string]*serverSession)
+		}
+		p.sessions[stripeID] = s
+	}
+	if mux {
+		p.logger.Printf("udptlspipe: Client %s connected (multiplexed)", remoteAddr)
+	} else {
+		p.logger.Printf("udptlspipe: Client %s connected", remoteAddr)
+	}
+	return s, nil
+}
+
+// leaveSession removes sc from s, and ends s if it was its last connection
+func (p *pipeServer) leaveSession(s *serverSession, sc *serverConn) {
+	p.sessionsMu.Lock()
+	defer p.sessionsMu.Unlock()
+
+	s.mu.Lock()
+	if i := slices.Index(s.conns, sc); i >= 0 {
+		s.conns = append(s.conns[:i], s.conns[i+1:]...)
+	}
+	last := len(s.conns) == 0
+	s.mu.Unlock()
+
+	if last {
+		if s.id != "" && p.sessions[s.id] == s {
+			delete(p.sessions, s.id)
+		}
+		s.cancel()
+	}
+}
+
+// closeUpstream closes the upstream sockets once the session is over
+func (s *serverSession) closeUpstream() {
+	if s.udpConn != nil {
+		s.udpConn.Close()
+	}
+	s.flowsMu.Lock()
+	for id, flow := range s.flows {
+		flow.udpConn.Close()
+		delete(s.flows, id)
+	}
+	s.flowsMu.Unlock()
+}
+
+// fromClient relays a datagram of the client to the upstream
+func (s *serverSession) fromClient(data []byte) {
+	if !s.mux {
+		if _, err := s.udpConn.Write(data); err != nil {
+			s.p.logger.Printf("udptlspipe: Upstream write error for %s: %v", s.remoteAddr, err)
+		}
+		return
+	}
+
+	id, data, err := muxUnframe(data)
+	if err != nil {
+		s.p.logger.Printf("udptlspipe: Failed to unpack message from %s: %v", s.remoteAddr, err)
+		return
+	}
+
+	s.flowsMu.Lock()
+	flow, ok := s.flows[id]
+	if !ok {
+		if s.ctx.Err() != nil {
+			s.flowsMu.Unlock()
+			return
+		}
+		if len(s.flows) >= maxSessions {
+			s.flowsMu.Unlock()
+			s.p.logger.Printf("udptlspipe: Dropping datagram for new flow %d of %s: too many flows", id, s.remoteAddr)
+			return
+		}
+		udpConn, err := net.DialUDP("udp", nil, s.p.upstreamAddr)
+		if err != nil {
+			s.flowsMu.Unlock()
+			s.p.logger.Printf("udptlspipe: Failed to dial upstream for %s flow %d: %v", s.remoteAddr, id, err)
+			return
+		}
+		flow = &serverFlow{udpConn: udpConn}
+		s.flows[id] = flow
+		go s.upstream(id, udpConn)
+	}
+	flow.lastActive.Store(time.Now().UnixNano())
+	s.flowsMu.Unlock()
+
+	if _, err := flow.udpConn.Write(data); err != nil {
+		s.p.logger.Printf("udptlspipe: Upstream write error for %s flow %d: %v", s.remoteAddr, id, err)
+	}
+}
+
+// upstream relays the datagrams of an upstream socket to the client, for the
+// flow id if the session is multiplexed. Without multiplexing, the session
+// ends with its socket.
+func (s *serverSession) upstream(id uint32, udpConn *net.UDPConn) {
+	if s.mux {
+		defer func() {
+			s.flowsMu.Lock()
+			if flow := s.flows[id]; flow != nil && flow.udpConn == udpConn {
+				delete(s.flows, id)
+			}
+			s.flowsMu.Unlock()
+			udpConn.Close()
+		}()
+	} else {
+		defer s.cancel()
+	}
+
+	buf := make([]byte, bufferSize)
+	for {
+		n, err := udpConn.Read(buf)
+		if err != nil {
+			if s.ctx.Err() == nil && !errors.Is(err, net.ErrClosed) {
+				s.p.logger.Printf("udptlspipe: Upstream read error for %s: %v", s.remoteAddr, err)
+			}
+			return
+		}
+
+		frame := buf[:n]
+		if s.mux {
+			frame = muxFrame(id, frame)
+		}
+		if err := s.toClient(frame); err != nil {
+			if s.ctx.Err() == nil {
+				s.p.logger.Printf("udptlspipe: Dropping datagram of %d bytes for %s: %v", n, s.remoteAddr, err)
+			}
+		}
+	}
+}
+
+// toClient sends a datagram to the client on the next of its connections. A
+// connection that fails is closed, which takes it out of the session.
+func (s *serverSession) toClient(frame []byte) error {
+	s.mu.Lock()
+	if len(s.conns) == 0 {
+		s.mu.Unlock()
+		return errLinkDown
+	}
+	sc := s.conns[s.next%len(s.conns)]
+	s.next++
+	s.mu.Unlock()
+
+	sc.writeMu.Lock()
+	defer sc.writeMu.Unlock()
+	if sc.left {
+		return errLinkDown
+	}
+	bodies, err := sc.frag.split(frame)
+	if err != nil {
+		return err
+	}
+	for _, body := range bodies {
+		sc.conn.SetWriteDeadline(time.Now().Add(writeTimeout))
+		if err := sc.conn.WriteMessage(websocket.BinaryMessage, packMessage(body, uniformPadder{})); err != nil {
+			sc.conn.Close()
+			return fmt.Errorf("WebSocket write error: %w", err)
+		}
+	}
+	return nil
+}
+
+// expireFlows closes the upstream sockets of flows the client stopped using
+func (s *serverSession) expireFlows() {
+	ticker := time.NewTicker(sessionJanitorInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-s.ctx.Done():
+			return
+		case <-ticker.C:
+			s.flowsMu.Lock()
+			for id, flow := range s.flows {
+				if time.Duration(time.Now().UnixNano()-flow.lastActive.Load()) >= sessionIdleTimeout {
+					flow.udpConn.Close()
+					delete(s.flows, id)
+				}
+			}
+			s.flowsMu.Unlock()
+		}
+	}
+}
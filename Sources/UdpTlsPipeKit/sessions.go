@@ -0,0 +1,343 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2024 AmneziaWG. All Rights Reserved.
+ */
+
+package main
+
+import (
+	"crypto/sha256"
+	stdtls "crypto/tls"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	tls "github.com/refraction-networking/utls"
+)
+
+// TLS sessions are kept for resumption, so that a reconnect skips the
+// certificate exchange like a browser coming back to a site would. The
+// sessions of every destination live in a sessionStore shared by all handles
+// with the same session_cache_file, or by all those without one, and outlive
+// the handles; a store with a file is written back to it whenever a session
+// is added, and read from it when first opened.
+//
+// No early data is sent on resumption: uTLS can't send it, and the upgrade
+// request that would go in it carries the password or a single-use token,
+// neither of which should be replayable.
+
+const (
+	// sessionFileVersion is the version of the session cache file format
+	sessionFileVersion = 1
+	// maxStoredSessions is the number of sessions a store keeps, beyond
+	// which the least recently used are dropped
+	maxStoredSessions = 64
+)
+
+// storedSession is a session in the form of ClientSessionState.ResumptionState
+type storedSession struct {
+	Ticket []byte    `json:"ticket"`
+	State  []byte    `json:"state"`
+	Used   time.Time `json:"used"`
+}
+
+// sessionFile is the content of a session cache file
+type sessionFile struct {
+	Version  int                       `json:"version"`
+	Sessions map[string]*storedSession `json:"sessions"`
+}
+
+// sessionStore holds TLS sessions by destination
+type sessionStore struct {
+	path string // empty if the store isn't persisted
+
+	mu       sync.Mutex
+	sessions map[string]*storedSession
+	// saving is set while a goroutine writes the store to path, and dirty if
+	// it has to write it again once done
+	saving bool
+	dirty  bool
+}
+
+var (
+	sessionStoresMu sync.Mutex
+	sessionStores   = make(map[string]*sessionStore)
+)
+
+// openSessionStore returns the store for path, reading it from the file the
+// first time. An empty path is the store kept in memory only. A missing file,
+// or one that doesn't hold sessions, is taken as empty since it's only a
+// cache.
+func openSessionStore(path string) (*sessionStore, error) {
+	if path != "" {
+		var err error
+		if path, err = filepath.Abs(path); err != nil {
+			return nil, err
+		}
+	}
+
+	sessionStoresMu.Lock()
+	defer sessionStoresMu.Unlock()
+	if store := sessionStores[path]; store != nil {
+		return store, nil
+	}
+
+	store := &sessionStore{
+		path:     path,
+		sessions: make(map[string]*storedSession),
+	}
+	if path != "" {
+		if info, err := os.Stat(filepath.Dir(path)); err != nil || !info.IsDir() {
+			return nil, fmt.Errorf("no directory for %s", path)
+		}
+		data, err := os.ReadFile(path)
+		switch {
+		case errors.Is(err, fs.ErrNotExist):
+		case err != nil:
+			return nil, err
+		default:
+			var file sessionFile
+			if json.Unmarshal(data, &file) == nil && file.Version == sessionFileVersion {
+				for key, session := range file.Sessions {
+					if session != nil {
+						store.sessions[key] = session
+					}
+				}
+			}
+		}
+	}
+	sessionStores[path] = store
+	return store, nil
+}
+
+func (s *sessionStore) get(key string) *storedSession {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	session := s.sessions[key]
+	if session != nil {
+		session.Used = time.Now()
+	}
+	return session
+}
+
+// put stores session under key, or removes key if session is nil
+func (s *sessionStore) put(key string, session *storedSession, logger CLogger) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if session == nil {
+		if s.sessions[key] == nil {
+			return
+		}
+		delete(s.sessions, key)
+	} else {
+		session.Used = time.Now()
+		s.sessions[key] = session
+		s.evict()
+	}
+
+	if s.path == "" {
+		return
+	}
+	if s.saving {
+		s.dirty = true
+		return
+	}
+	s.saving = true
+	go s.save(logger)
+}
+
+// evict drops the least recently used sessions beyond maxStoredSessions
+func (s *sessionStore) evict() {
+	if len(s.sessions) <= maxStoredSessions {
+		return
+	}
+	keys := make([]string, 0, len(s.sessions))
+	for key := range s.sessions {
+		keys = append(keys, key)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		return s.sessions[keys[i]].Used.Before(s.sessions[keys[j]].Used)
+	})
+	for _, key := range keys[:len(keys)-maxStoredSessions] {
+		delete(s.sessions, key)
+	}
+}
+
+// save writes the store to its file until no change is left unsaved. The
+// file holds session secrets, so only the owner may read it.
+func (s *sessionStore) save(logger CLogger) {
+	for {
+		s.mu.Lock()
+		data, err := json.Marshal(sessionFile{Version: sessionFileVersion, Sessions: s.sessions})
+		s.dirty = false
+		s.mu.Unlock()
+
+		if err == nil {
+			err = writeFileAtomic(s.path, data, 0o600)
+		}
+		if err != nil {
+			logger.Printf("udptlspipe: Failed to save TLS sessions to %s: %v", s.path, err)
+		}
+
+		s.mu.Lock()
+		if !s.dirty {
+			s.saving = false
+			s.mu.Unlock()
+			return
+		}
+		s.mu.Unlock()
+	}
+}
+
+// writeFileAtomic replaces the file at path with data, so that readers never
+// see it half written
+func writeFileAtomic(path string, data []byte, perm os.FileMode) error {
+	tmp, err := os.CreateTemp(filepath.Dir(path), "."+filepath.Base(path)+".*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if err := tmp.Chmod(perm); err != nil {
+		tmp.Close()
+		return err
+	}
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+// sessionCachePrefix namespaces the sessions of cfg in a store. Besides the
+// destination it covers the transport, whose sessions differ, and the trust
+// settings, since a resumed session isn't verified again.
+func sessionCachePrefix(cfg *pipeConfig, transport pipeTransport) string {
+	hash := sha256.New()
+	fmt.Fprintf(hash, "%t\x00%s\x00%s\x00%s", cfg.Secure, cfg.VerifyName, strings.Join(cfg.PinnedSPKI, ","), cfg.CAPEM)
+	return fmt.Sprintf("%s %s %s ", transport, cfg.Destination, hex.EncodeToString(hash.Sum(nil)[:8]))
+}
+
+// addPSKExtension adds the pre_shared_key extension that TLS 1.3 resumption
+// needs to spec, if it offers TLS 1.3 resumption without one. The parrots
+// leave it out because browsers only send it when resuming; it's omitted from
+// the ClientHello in the same way when there's no session. It goes last, as
+// RFC 8446 requires.
+func addPSKExtension(spec *tls.ClientHelloSpec) {
+	resumes := false
+	for _, ext := range spec.Extensions {
+		switch ext.(type) {
+		case tls.PreSharedKeyExtension:
+			return
+		case *tls.PSKKeyExchangeModesExtension:
+			resumes = true
+		}
+	}
+	if resumes {
+		spec.Extensions = append(spec.Extensions, &tls.UtlsPreSharedKeyExtension{})
+	}
+}
+
+// utlsSessions returns the session cache for the uTLS connections of c, or nil
+// if session resumption is disabled
+func (c *pipeConfig) utlsSessions(logger CLogger) tls.ClientSessionCache {
+	if c.sessions == nil {
+		return nil
+	}
+	return &utlsSessionCache{store: c.sessions, prefix: sessionCachePrefix(c, transportWebSocket), logger: logger}
+}
+
+// stdSessions returns the session cache for the QUIC connections of c, or nil
+// if session resumption is disabled
+func (c *pipeConfig) stdSessions(logger CLogger) stdtls.ClientSessionCache {
+	if c.sessions == nil {
+		return nil
+	}
+	return &stdSessionCache{store: c.sessions, prefix: sessionCachePrefix(c, transportQUIC), logger: logger}
+}
+
+// utlsSessionCache is a tls.ClientSessionCache over a sessionStore, for the
+// uTLS connections of one configuration
+type utlsSessionCache struct {
+	store  *sessionStore
+	prefix string
+	logger CLogger
+}
+
+func (c *utlsSessionCache) Get(key string) (*tls.ClientSessionState, bool) {
+	stored := c.store.get(c.prefix + key)
+	if stored == nil {
+		return nil, false
+	}
+	state, err := tls.ParseSessionState(stored.State)
+	if err != nil {
+		return nil, false
+	}
+	session, err := tls.NewResumptionState(stored.Ticket, state)
+	if err != nil {
+		return nil, false
+	}
+	return session, true
+}
+
+func (c *utlsSessionCache) Put(key string, session *tls.ClientSessionState) {
+	if session == nil {
+		c.store.put(c.prefix+key, nil, c.logger)
+	} else if stored := newStoredSession(session.ResumptionState()); stored != nil {
+		c.store.put(c.prefix+key, stored, c.logger)
+	}
+}
+
+// stdSessionCache is the crypto/tls counterpart of utlsSessionCache, for QUIC
+type stdSessionCache struct {
+	store  *sessionStore
+	prefix string
+	logger CLogger
+}
+
+func (c *stdSessionCache) Get(key string) (*stdtls.ClientSessionState, bool) {
+	stored := c.store.get(c.prefix + key)
+	if stored == nil {
+		return nil, false
+	}
+	state, err := stdtls.ParseSessionState(stored.State)
+	if err != nil {
+		return nil, false
+	}
+	session, err := stdtls.NewResumptionState(stored.Ticket, state)
+	if err != nil {
+		return nil, false
+	}
+	return session, true
+}
+
+func (c *stdSessionCache) Put(key string, session *stdtls.ClientSessionState) {
+	if session == nil {
+		c.store.put(c.prefix+key, nil, c.logger)
+	} else if stored := newStoredSession(session.ResumptionState()); stored != nil {
+		c.store.put(c.prefix+key, stored, c.logger)
+	}
+}
+
+// newStoredSession encodes the result of the ResumptionState method of a uTLS
+// or crypto/tls session, or returns nil if it can't be
+func newStoredSession(ticket []byte, state interface{ Bytes() ([]byte, error) }, err error) *storedSession {
+	if err != nil {
+		return nil
+	}
+	data, err := state.Bytes()
+	if err != nil {
+		return nil
+	}
+	return &storedSession{Ticket: ticket, State: data}
+}
@@ -0,0 +1,217 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2024 AmneziaWG. All Rights Reserved.
+ */
+
+package main
+
+import (
+	"encoding/json"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// pipeStats holds traffic and health counters for a single udptlspipe handle.
+// All methods are safe for concurrent use and cheap enough for the data path.
+type pipeStats struct {
+	bytesSent         atomic.Uint64
+	bytesReceived     atomic.Uint64
+	datagramsSent     atomic.Uint64
+	datagramsReceived atomic.Uint64
+	droppedPackets    atomic.Uint64
+	droppedControl    atomic.Uint64
+	droppedData       atomic.Uint64
+	// Datagrams too large to send or receive, and fragmented datagrams
+	// given up on before all their fragments arrived
+	oversizeDropped    atomic.Uint64
+	reassemblyFailures atomic.Uint64
+	reconnects         atomic.Uint64
+	handshakeFailures  atomic.Uint64
+	sessions           atomic.Int64
+	lastRTT            atomic.Int64 // nanoseconds, 0 if no pong was received yet
+	missedPongs        atomic.Uint64
+	// TLS handshakes that resumed a session, and full ones while resumption
+	// was enabled
+	resumptionHits   atomic.Uint64
+	resumptionMisses atomic.Uint64
+	// Datagrams sent over QUIC as DATAGRAM capsules on the request stream
+	capsuleFallbacks atomic.Uint64
+
+	// connectedSince is the time the handle went from zero to one established
+	// WebSocket connection; it is reset when the last connection goes away.
+	connMu         sync.Mutex
+	connections    int
+	connectedSince time.Time
+
+	// stripes has the counters of each stripe position, summed over all
+	// sessions; it's empty without striping
+	stripes []stripeStats
+
+	// fingerprint is the one of the latest connection, nil before the first
+	fingerprint atomic.Pointer[usedFingerprint]
+}
+
+// usedFingerprint is the fingerprint a connection was made with
+type usedFingerprint struct {
+	clientHello string // empty over QUIC, which has the Go ClientHello
+	userAgent   string
+}
+
+func newPipeStats(stripes int) *pipeStats {
+	s := &pipeStats{}
+	if stripes > 1 {
+		s.stripes = make([]stripeStats, stripes)
+	}
+	return s
+}
+
+// stripeStats holds the counters of one stripe position
+type stripeStats struct {
+	bytesSent         atomic.Uint64
+	bytesReceived     atomic.Uint64
+	datagramsSent     atomic.Uint64
+	datagramsReceived atomic.Uint64
+	queued            atomic.Int64
+	connections       atomic.Int64
+}
+
+// pipeStatsSnapshot is the JSON representation returned by udptlspipeGetStats
+type pipeStatsSnapshot struct {
+	BytesSent          uint64  `json:"bytes_sent"`
+	BytesReceived      uint64  `json:"bytes_received"`
+	DatagramsSent      uint64  `json:"datagrams_sent"`
+	DatagramsReceived  uint64  `json:"datagrams_received"`
+	DroppedPackets     uint64  `json:"dropped_packets"`
+	DroppedControl     uint64  `json:"dropped_control"`
+	DroppedData        uint64  `json:"dropped_data"`
+	OversizeDropped    uint64  `json:"oversize_dropped"`
+	ReassemblyFailures uint64  `json:"reassembly_failures"`
+	Reconnects         uint64  `json:"reconnects"`
+	HandshakeFailures  uint64  `json:"handshake_failures"`
+	Sessions           int64   `json:"sessions"`
+	Connections        int     `json:"connections"`
+	LastRTTMs          float64 `json:"last_rtt_ms"`
+	MissedPongs        uint64  `json:"missed_pongs"`
+	ResumptionHits     uint64  `json:"resumption_hits"`
+	ResumptionMisses   uint64  `json:"resumption_misses"`
+	CapsuleFallbacks   uint64  `json:"capsule_fallbacks"`
+	UptimeSeconds      float64 `json:"uptime_seconds"`
+	Fingerprint        string  `json:"fingerprint"`
+	UserAgent          string  `json:"user_agent"`
+
+	Stripes []stripeStatsSnapshot `json:"stripes,omitempty"`
+}
+
+type stripeStatsSnapshot struct {
+	BytesSent         uint64 `json:"bytes_sent"`
+	BytesReceived     uint64 `json:"bytes_received"`
+	DatagramsSent     uint64 `json:"datagrams_sent"`
+	DatagramsReceived uint64 `json:"datagrams_received"`
+	Queued            int64  `json:"queued"`
+	Connections       int64  `json:"connections"`
+}
+
+func (s *pipeStats) addSent(n int) {
+	s.bytesSent.Add(uint64(n))
+	s.datagramsSent.Add(1)
+}
+
+func (s *pipeStats) addReceived(n int) {
+	s.bytesReceived.Add(uint64(n))
+	s.datagramsReceived.Add(1)
+}
+
+// addDropped counts a datagram of the given class dropped by a session
+func (s *pipeStats) addDropped(class packetClass) {
+	s.droppedPackets.Add(1)
+	if class == classControl {
+		s.droppedControl.Add(1)
+	} else {
+		s.droppedData.Add(1)
+	}
+}
+
+// addResumption counts a TLS handshake by whether it resumed a session
+func (s *pipeStats) addResumption(resumed bool) {
+	if resumed {
+		s.resumptionHits.Add(1)
+	} else {
+		s.resumptionMisses.Add(1)
+	}
+}
+
+// setFingerprint records the fingerprint a connection is made with
+func (s *pipeStats) setFingerprint(clientHello, userAgent string) {
+	s.fingerprint.Store(&usedFingerprint{clientHello: clientHello, userAgent: userAgent})
+}
+
+func (s *pipeStats) connectionUp() {
+	s.connMu.Lock()
+	defer s.connMu.Unlock()
+	if s.connections == 0 {
+		s.connectedSince = time.Now()
+	}
+	s.connections++
+}
+
+func (s *pipeStats) connectionDown() {
+	s.connMu.Lock()
+	defer s.connMu.Unlock()
+	s.connections--
+	if s.connections == 0 {
+		s.connectedSince = time.Time{}
+	}
+}
+
+func (s *pipeStats) snapshot() pipeStatsSnapshot {
+	snap := pipeStatsSnapshot{
+		BytesSent:          s.bytesSent.Load(),
+		BytesReceived:      s.bytesReceived.Load(),
+		DatagramsSent:      s.datagramsSent.Load(),
+		DatagramsReceived:  s.datagramsReceived.Load(),
+		DroppedPackets:     s.droppedPackets.Load(),
+		DroppedControl:     s.droppedControl.Load(),
+		DroppedData:        s.droppedData.Load(),
+		OversizeDropped:    s.oversizeDropped.Load(),
+		ReassemblyFailures: s.reassemblyFailures.Load(),
+		Reconnects:         s.reconnects.Load(),
+		HandshakeFailures:  s.handshakeFailures.Load(),
+		Sessions:           s.sessions.Load(),
+		LastRTTMs:          float64(s.lastRTT.Load()) / float64(time.Millisecond),
+		MissedPongs:        s.missedPongs.Load(),
+		ResumptionHits:     s.resumptionHits.Load(),
+		ResumptionMisses:   s.resumptionMisses.Load(),
+		CapsuleFallbacks:   s.capsuleFallbacks.Load(),
+	}
+
+	if fingerprint := s.fingerprint.Load(); fingerprint != nil {
+		snap.Fingerprint = fingerprint.clientHello
+		snap.UserAgent = fingerprint.userAgent
+	}
+
+	s.connMu.Lock()
+	snap.Connections = s.connections
+	if s.connections > 0 {
+		snap.UptimeSeconds = time.Since(s.connectedSince).Seconds()
+	}
+	s.connMu.Unlock()
+
+	for i := range s.stripes {
+		st := &s.stripes[i]
+		snap.Stripes = append(snap.Stripes, stripeStatsSnapshot{
+			BytesSent:         st.bytesSent.Load(),
+			BytesReceived:     st.bytesReceived.Load(),
+			DatagramsSent:     st.datagramsSent.Load(),
+			DatagramsReceived: st.datagramsReceived.Load(),
+			Queued:            st.queued.Load(),
+			Connections:       st.connections.Load(),
+		})
+	}
+
+	return snap
+}
+
+func (s *pipeStats) marshalJSON() ([]byte, error) {
+	return json.Marshal(s.snapshot())
+}
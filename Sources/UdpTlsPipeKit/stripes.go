@@ -0,0 +1,302 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2024 AmneziaWG. All Rights Reserved.
+ */
+
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// stripePolicy selects the stripe each datagram is sent on
+type stripePolicy string
+
+const (
+	// stripeRoundRobin takes the connected stripes in turn
+	stripeRoundRobin stripePolicy = "round_robin"
+	// stripeLeastQueued takes the connected stripe with the fewest datagrams
+	// waiting, which steers around a stripe stalled by TCP retransmissions
+	stripeLeastQueued stripePolicy = "least_queued"
+)
+
+const (
+	// Maximum number of stripes per session
+	maxStripes = 16
+	// Datagrams that may wait for a single stripe
+	stripeQueueSize = 64
+	// stripeSubprotocolPrefix, followed by the ID of a stripeSet, is offered
+	// by each of its stripes, so that the server relays them as one session
+	stripeSubprotocolPrefix = "udptlspipe-stripe-v1."
+	// stripeSessionIDSize is the size of the random ID of a stripeSet
+	stripeSessionIDSize = 16
+)
+
+// connection is the path of a session to the server: a single link, or a
+// stripeSet of them.
+type connection interface {
+	transport
+	// run keeps the connection up until it's closed or gives up
+	run()
+	close()
+}
+
+// newConnection creates the connection for a session, striped or over QUIC if
+// the configuration asks for it. setup, if not nil, is applied to every
+// WebSocket link.
+func newConnection(ctx context.Context, cfg *pipeConfig, label string, deliver func([]byte), stats *pipeStats, events EventSink, logger CLogger, setup func(*wsLink)) connection {
+	if cfg.Transport == transportQUIC {
+		return newQUICLink(ctx, cfg, label, deliver, stats, events, logger)
+	}
+	if cfg.Stripes > 1 {
+		return newStripeSet(ctx, cfg, label, deliver, stats, events, logger, setup)
+	}
+
+	link := newWSLink(ctx, cfg, label, deliver, stats, events, logger)
+	if setup != nil {
+		setup(link)
+	}
+	return link
+}
+
+// stripeSet spreads the datagrams of a session over several WebSocket
+// connections, so that a lost TCP segment only holds up the datagrams of one
+// of them. Every stripe has its own queue and is redialed on its own. The
+// stripes share an ID, by which the server relays them as one session and
+// spreads the datagrams to the client over them as well.
+type stripeSet struct {
+	id      string
+	ctx     context.Context
+	cancel  context.CancelFunc
+	cfg     *pipeConfig
+	label   string
+	deliver func([]byte)
+	stats   *pipeStats
+	events  EventSink
+	logger  CLogger
+	setup   func(*wsLink)
+	stripes []*stripe
+	next    atomic.Uint32 // round robin position
+
+	mu sync.Mutex
+	// wake is closed and replaced whenever a stripe connects or disconnects
+	wake chan struct{}
+}
+
+// stripe is one connection of a stripeSet. Its link is replaced when it
+// has to be restarted.
+type stripe struct {
+	index int
+	link  atomic.Pointer[wsLink]
+	queue chan []byte
+	stats *stripeStats
+}
+
+func newStripeSet(parentCtx context.Context, cfg *pipeConfig, label string, deliver func([]byte), stats *pipeStats, events EventSink, logger CLogger, setup func(*wsLink)) *stripeSet {
+	ctx, cancel := context.WithCancel(parentCtx)
+	id := make([]byte, stripeSessionIDSize)
+	rand.Read(id)
+	t := &stripeSet{
+		id:      hex.EncodeToString(id),
+		ctx:     ctx,
+		cancel:  cancel,
+		cfg:     cfg,
+		label:   label,
+		deliver: deliver,
+		stats:   stats,
+		events:  events,
+		logger:  logger,
+		setup:   setup,
+		wake:    make(chan struct{}),
+	}
+	for i := 0; i < cfg.Stripes; i++ {
+		t.stripes = append(t.stripes, &stripe{
+			index: i,
+			queue: make(chan []byte, stripeQueueSize),
+			stats: &stats.stripes[i],
+		})
+	}
+	return t
+}
+
+// run keeps every stripe connected. A stripe that gives up is restarted
+// after a while as long as another one is still running; once all of them
+// have given up, run returns.
+func (t *stripeSet) run() {
+	defer t.cancel()
+
+	var running atomic.Int32
+	running.Store(int32(len(t.stripes)))
+
+	var wg sync.WaitGroup
+	for _, st := range t.stripes {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				t.runStripe(st)
+				if t.ctx.Err() != nil {
+					return
+				}
+				if running.Add(-1) == 0 {
+					t.logger.Printf("udptlspipe: All %d stripes of %s gave up", len(t.stripes), t.label)
+					t.cancel()
+					return
+				}
+
+				timer := time.NewTimer(reconnectMaxDelay)
+				select {
+				case <-t.ctx.Done():
+					timer.Stop()
+					return
+				case <-timer.C:
+				}
+				running.Add(1)
+				t.logger.Printf("udptlspipe: Restarting stripe %d of %s", st.index, t.label)
+			}
+		}()
+	}
+	wg.Wait()
+
+	// Datagrams left in the queues are gone with the session
+	for _, st := range t.stripes {
+		st.stats.queued.Add(-int64(len(st.queue)))
+	}
+}
+
+// runStripe runs one link for st until it gives up
+func (t *stripeSet) runStripe(st *stripe) {
+	link := newWSLink(t.ctx, t.cfg, t.label, func(data []byte) {
+		st.stats.bytesReceived.Add(uint64(len(data)))
+		st.stats.datagramsReceived.Add(1)
+		t.deliver(data)
+	}, t.stats, t.events, t.logger)
+	link.stripeSession = t.id
+	if t.setup != nil {
+		t.setup(link)
+	}
+	link.onStateChange = func(up bool) {
+		if up {
+			st.stats.connections.Add(1)
+		} else {
+			st.stats.connections.Add(-1)
+		}
+		t.mu.Lock()
+		close(t.wake)
+		t.wake = make(chan struct{})
+		t.mu.Unlock()
+	}
+	st.link.Store(link)
+
+	go t.drain(st, link)
+	link.run()
+}
+
+// drain writes the queue of st to link until the link stops. Datagrams still
+// queued then are left for the next link of the stripe.
+func (t *stripeSet) drain(st *stripe, link *wsLink) {
+	for {
+		if !link.waitUp(link.ctx) {
+			return
+		}
+
+		var data []byte
+		select {
+		case <-link.ctx.Done():
+			return
+		case data = <-st.queue:
+		}
+		st.stats.queued.Add(-1)
+
+		if err := link.write(data); err != nil {
+			if errors.Is(err, errDatagramTooLarge) {
+				t.stats.oversizeDropped.Add(1)
+				continue
+			}
+			t.stats.droppedPackets.Add(1)
+			if !errors.Is(err, errLinkDown) {
+				t.logger.Printf("udptlspipe: WebSocket write error on stripe %d: %v", st.index, err)
+			}
+			continue
+		}
+		st.stats.bytesSent.Add(uint64(len(data)))
+		st.stats.datagramsSent.Add(1)
+	}
+}
+
+// connected reports whether the current link of st is up
+func (st *stripe) connected() bool {
+	link := st.link.Load()
+	return link != nil && link.isUp()
+}
+
+// waitUp blocks until at least one stripe is connected
+func (t *stripeSet) waitUp(ctx context.Context) bool {
+	for {
+		t.mu.Lock()
+		wake := t.wake
+		t.mu.Unlock()
+
+		for _, st := range t.stripes {
+			if st.connected() {
+				return true
+			}
+		}
+
+		select {
+		case <-ctx.Done():
+			return false
+		case <-t.ctx.Done():
+			return false
+		case <-wake:
+		}
+	}
+}
+
+// write queues data on a connected stripe chosen by the configured policy.
+// When that stripe's queue is full it blocks, which leaves further datagrams
+// in the session's queue where stale ones are discarded.
+func (t *stripeSet) write(data []byte) error {
+	// Start at the round robin position either way, so that ties between
+	// equally loaded stripes are spread too
+	start := int(t.next.Add(1)-1) % len(t.stripes)
+
+	var chosen *stripe
+	for i := range t.stripes {
+		st := t.stripes[(start+i)%len(t.stripes)]
+		if !st.connected() {
+			continue
+		}
+		if t.cfg.StripePolicy == stripeRoundRobin {
+			chosen = st
+			break
+		}
+		if chosen == nil || len(st.queue) < len(chosen.queue) {
+			chosen = st
+		}
+	}
+	if chosen == nil {
+		return errLinkDown
+	}
+
+	link := chosen.link.Load()
+	select {
+	case chosen.queue <- data:
+		chosen.stats.queued.Add(1)
+		return nil
+	case <-link.ctx.Done():
+		return errLinkDown
+	case <-t.ctx.Done():
+		return errLinkDown
+	}
+}
+
+func (t *stripeSet) close() {
+	t.cancel()
+}
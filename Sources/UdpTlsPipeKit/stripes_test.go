@@ -0,0 +1,272 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2024 AmneziaWG. All Rights Reserved.
+ */
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// testStripeSet is a stripeSet whose stripes look connected but don't drain
+// their queues
+func testStripeSet(t *testing.T, policy stripePolicy, stripes int) *stripeSet {
+	t.Helper()
+	cfg := &pipeConfig{Stripes: stripes, StripePolicy: policy}
+	stats := newPipeStats(stripes)
+	set := newStripeSet(context.Background(), cfg, "test", func([]byte) {}, stats, EventSink(0), CLogger(0), nil)
+	t.Cleanup(set.close)
+	for _, st := range set.stripes {
+		link := newWSLink(set.ctx, cfg, "test", nil, stats, EventSink(0), CLogger(0))
+		link.conn = &websocket.Conn{}
+		st.link.Store(link)
+	}
+	return set
+}
+
+// queued returns the number of datagrams queued on each stripe, checking the
+// per-stripe stats against the queues
+func queued(t *testing.T, set *stripeSet) []int {
+	t.Helper()
+	var counts []int
+	for i, st := range set.stripes {
+		counts = append(counts, len(st.queue))
+		if got := set.stats.snapshot().Stripes[i].Queued; got != int64(len(st.queue)) {
+			t.Errorf("stripe %d: queued stat %d, queue holds %d", i, got, len(st.queue))
+		}
+	}
+	return counts
+}
+
+func TestStripePick(t *testing.T) {
+	t.Run("round robin", func(t *testing.T) {
+		set := testStripeSet(t, stripeRoundRobin, 3)
+		for range 6 {
+			if err := set.write([]byte{1}); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if got := fmt.Sprint(queued(t, set)); got != "[2 2 2]" {
+			t.Errorf("queued %s, want [2 2 2]", got)
+		}
+	})
+
+	t.Run("round robin skips dead stripes", func(t *testing.T) {
+		set := testStripeSet(t, stripeRoundRobin, 3)
+		set.stripes[1].link.Load().conn = nil
+		for range 4 {
+			if err := set.write([]byte{1}); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if got := fmt.Sprint(queued(t, set)); got != "[2 0 2]" {
+			t.Errorf("queued %s, want [2 0 2]", got)
+		}
+	})
+
+	t.Run("least queued", func(t *testing.T) {
+		set := testStripeSet(t, stripeLeastQueued, 3)
+		// Stripe 0 is stalled with 3 datagrams, stripe 1 has 1
+		for _, i := range []int{0, 0, 0, 1} {
+			set.stripes[i].queue <- []byte{1}
+			set.stripes[i].stats.queued.Add(1)
+		}
+		for range 3 {
+			if err := set.write([]byte{1}); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if got := fmt.Sprint(queued(t, set)); got != "[3 2 2]" {
+			t.Errorf("queued %s, want [3 2 2]", got)
+		}
+	})
+
+	t.Run("all down", func(t *testing.T) {
+		set := testStripeSet(t, stripeLeastQueued, 2)
+		for _, st := range set.stripes {
+			st.link.Load().conn = nil
+		}
+		if err := set.write([]byte{1}); err != errLinkDown {
+			t.Errorf("write = %v, want errLinkDown", err)
+		}
+	})
+}
+
+// testUpstream is a UDP upstream that records where datagrams come from
+type testUpstream struct {
+	conn *net.UDPConn
+
+	mu      sync.Mutex
+	sources map[string]int
+	last    *net.UDPAddr
+}
+
+func startTestUpstream(t *testing.T) *testUpstream {
+	t.Helper()
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	u := &testUpstream{conn: conn, sources: make(map[string]int)}
+	go func() {
+		buf := make([]byte, bufferSize)
+		for {
+			_, addr, err := conn.ReadFromUDP(buf)
+			if err != nil {
+				return
+			}
+			u.mu.Lock()
+			u.sources[addr.String()]++
+			u.last = addr
+			u.mu.Unlock()
+		}
+	}()
+	return u
+}
+
+// received returns the number of datagrams received from each source
+func (u *testUpstream) received() map[string]int {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	counts := make(map[string]int, len(u.sources))
+	for source, n := range u.sources {
+		counts[source] = n
+	}
+	return counts
+}
+
+// startTestPipeServer runs a pipe server relaying to upstream over TLS
+func startTestPipeServer(t *testing.T, upstream *net.UDPAddr) (*pipeServer, string) {
+	t.Helper()
+	ctx, cancel := context.WithCancel(context.Background())
+	p := &pipeServer{
+		ctx:          ctx,
+		upstreamAddr: upstream,
+		path:         "/",
+		password:     "secret",
+		replay:       newReplayGuard(),
+		logger:       CLogger(0),
+		upgrader:     websocket.Upgrader{Subprotocols: pipeSubprotocols},
+	}
+	server := httptest.NewTLSServer(p)
+	t.Cleanup(func() {
+		cancel()
+		server.Close()
+		p.wg.Wait()
+	})
+	return p, server.Listener.Addr().String()
+}
+
+// eventually polls cond until it holds or a few seconds passed
+func eventually(t *testing.T, what string, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(10 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting until %s", what)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestStripedSession(t *testing.T) {
+	upstream := startTestUpstream(t)
+	p, addr := startTestPipeServer(t, upstream.conn.LocalAddr().(*net.UDPAddr))
+
+	cfg, err := parseConfig(fmt.Sprintf(`{"destination": %q, "password": "secret", "fingerprint_profile": "chrome", "stripes": 2}`, addr))
+	if err != nil {
+		t.Fatal(err)
+	}
+	stats := newPipeStats(cfg.Stripes)
+	var receivedMu sync.Mutex
+	received := 0
+	set := newStripeSet(context.Background(), cfg, "test", func([]byte) {
+		receivedMu.Lock()
+		received++
+		receivedMu.Unlock()
+	}, stats, EventSink(0), CLogger(0), nil)
+	go set.run()
+	t.Cleanup(set.close)
+
+	connected := func() bool {
+		for _, st := range stats.snapshot().Stripes {
+			if st.Connections != 1 {
+				return false
+			}
+		}
+		return true
+	}
+	eventually(t, "both stripes are connected", connected)
+
+	// Both stripes carry datagrams to the same upstream peer
+	send := func(n int) {
+		t.Helper()
+		for range n {
+			if err := set.write(make([]byte, 100)); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	send(4)
+	eventually(t, "the upstream received 4 datagrams", func() bool {
+		return len(upstream.received()) == 1 && upstream.received()[upstream.last.String()] == 4
+	})
+	for i, st := range stats.snapshot().Stripes {
+		if st.DatagramsSent != 2 || st.BytesSent != 200 {
+			t.Errorf("stripe %d sent %d datagrams of %d bytes, want 2 of 200", i, st.DatagramsSent, st.BytesSent)
+		}
+	}
+	p.sessionsMu.Lock()
+	sessions := len(p.sessions)
+	p.sessionsMu.Unlock()
+	if sessions != 1 {
+		t.Errorf("server has %d striped sessions, want 1", sessions)
+	}
+
+	// and the server spreads datagrams to the client over both
+	for range 4 {
+		if _, err := upstream.conn.WriteToUDP(make([]byte, 50), upstream.last); err != nil {
+			t.Fatal(err)
+		}
+	}
+	eventually(t, "the client received 4 datagrams", func() bool {
+		receivedMu.Lock()
+		defer receivedMu.Unlock()
+		return received == 4
+	})
+	for i, st := range stats.snapshot().Stripes {
+		if st.DatagramsReceived != 2 {
+			t.Errorf("stripe %d received %d datagrams, want 2", i, st.DatagramsReceived)
+		}
+	}
+
+	// A dead stripe reconnects on its own, into the same session
+	link := set.stripes[0].link.Load()
+	link.mu.Lock()
+	link.conn.Close()
+	link.mu.Unlock()
+	eventually(t, "the stripe reconnected", func() bool {
+		return stats.reconnects.Load() > 0 && connected()
+	})
+	send(4)
+	eventually(t, "the upstream received 8 datagrams", func() bool {
+		total := 0
+		for _, n := range upstream.received() {
+			total += n
+		}
+		return total == 8
+	})
+	if sources := upstream.received(); len(sources) != 1 {
+		t.Errorf("upstream saw %d peers, want 1: %v", len(sources), sources)
+	}
+}
@@ -0,0 +1,208 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2024 AmneziaWG. All Rights Reserved.
+ */
+
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	stdtls "crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strings"
+
+	tls "github.com/refraction-networking/utls"
+)
+
+// tlsTrust describes how the server certificate is verified
+type tlsTrust struct {
+	// secure enables chain verification against the system roots, or against
+	// roots if set
+	secure bool
+	// roots replaces the system roots when not nil, and implies chain
+	// verification
+	roots *x509.CertPool
+	// verifyName is the host name the certificate must be valid for, if it
+	// differs from the SNI
+	verifyName string
+	// pins are SHA-256 hashes of acceptable SubjectPublicKeyInfos. Any
+	// certificate of a verified chain may match; without chain verification
+	// only the leaf may, since the rest of the chain is unchecked
+	pins [][]byte
+	// proxyRoots replaces the system roots in the verification of an https
+	// proxy when not nil
+	proxyRoots *x509.CertPool
+}
+
+// newTLSTrust builds a tlsTrust from the user options. pins are SHA-256 SPKI
+// hashes in base64 (optionally prefixed with "sha256/") or hex, and caPEM is a
+// PEM bundle of CA certificates.
+func newTLSTrust(secure bool, pins []string, caPEM string, verifyName string) (*tlsTrust, error) {
+	trust := &tlsTrust{
+		secure:     secure,
+		verifyName: verifyName,
+	}
+
+	for _, pin := range pins {
+		hash, err := parseSPKIPin(pin)
+		if err != nil {
+			return nil, newPipeError(errorInvalidConfig, err)
+		}
+		trust.pins = append(trust.pins, hash)
+	}
+
+	if caPEM != "" {
+		trust.roots = x509.NewCertPool()
+		if !trust.roots.AppendCertsFromPEM([]byte(caPEM)) {
+			return nil, newPipeError(errorInvalidConfig, errors.New("no certificates found in CA bundle"))
+		}
+	}
+
+	return trust, nil
+}
+
+func parseSPKIPin(pin string) ([]byte, error) {
+	pin = strings.TrimPrefix(strings.TrimSpace(pin), "sha256/")
+	if hash, err := hex.DecodeString(pin); err == nil && len(hash) == sha256.Size {
+		return hash, nil
+	}
+	if hash, err := base64.StdEncoding.DecodeString(pin); err == nil && len(hash) == sha256.Size {
+		return hash, nil
+	}
+	return nil, fmt.Errorf("invalid SPKI pin %q: expected a base64 or hex SHA-256 hash", pin)
+}
+
+// verifiesChain reports whether the certificate chain must lead to a trusted root
+func (t *tlsTrust) verifiesChain() bool {
+	return t.secure || t.roots != nil
+}
+
+// apply configures certificate verification in a uTLS config. The built-in
+// verifier is only used for plain "secure" mode; everything else goes through
+// VerifyPeerCertificate, since the built-in one can neither pin keys nor check
+// a name other than the SNI.
+func (t *tlsTrust) apply(config *tls.Config) {
+	config.InsecureSkipVerify, config.VerifyPeerCertificate = t.settings(config.ServerName)
+}
+
+// applyStd is apply for a crypto/tls config, as used by QUIC
+func (t *tlsTrust) applyStd(config *stdtls.Config) {
+	config.InsecureSkipVerify, config.VerifyPeerCertificate = t.settings(config.ServerName)
+}
+
+// verifyECHRejection checks the certificate of a server that rejected ECH
+// against the public name of the ECH configuration, which it answers for
+// instead of the SNI. The pins and verify_name are for the real server and
+// don't apply; without chain verification anything goes, and the retry
+// configurations of the server aren't used.
+func (t *tlsTrust) verifyECHRejection(certs []*x509.Certificate, publicName string) error {
+	if !t.verifiesChain() {
+		return nil
+	}
+	if len(certs) == 0 {
+		return errors.New("server sent no certificate")
+	}
+	intermediates := x509.NewCertPool()
+	for _, cert := range certs[1:] {
+		intermediates.AddCert(cert)
+	}
+	if _, err := certs[0].Verify(x509.VerifyOptions{
+		Roots:         t.roots,
+		Intermediates: intermediates,
+		DNSName:       publicName,
+	}); err != nil {
+		return fmt.Errorf("certificate verification for ECH public name failed: %w", err)
+	}
+	return nil
+}
+
+// applyStdECH configures the check of a server that rejects ECH in a
+// crypto/tls config. Unlike uTLS, crypto/tls does verifyECHRejection itself
+// when there's no callback, even with InsecureSkipVerify; the callback can't
+// do it, as it runs before the certificates are known.
+func (t *tlsTrust) applyStdECH(config *stdtls.Config) {
+	if t.verifiesChain() {
+		config.RootCAs = t.roots
+	} else {
+		config.EncryptedClientHelloRejectionVerify = func(stdtls.ConnectionState) error { return nil }
+	}
+}
+
+// settings returns the InsecureSkipVerify and VerifyPeerCertificate settings
+// for a connection to serverName
+func (t *tlsTrust) settings(serverName string) (bool, func([][]byte, [][]*x509.Certificate) error) {
+	if t.roots == nil && t.verifyName == "" && len(t.pins) == 0 {
+		return !t.secure, nil
+	}
+
+	name := t.verifyName
+	if name == "" {
+		name = serverName
+	}
+
+	return true, func(rawCerts [][]byte, _ [][]*x509.Certificate) error {
+		return t.verify(rawCerts, name)
+	}
+}
+
+func (t *tlsTrust) verify(rawCerts [][]byte, name string) error {
+	if len(rawCerts) == 0 {
+		return errors.New("server sent no certificate")
+	}
+
+	certs := make([]*x509.Certificate, len(rawCerts))
+	for i, raw := range rawCerts {
+		cert, err := x509.ParseCertificate(raw)
+		if err != nil {
+			return fmt.Errorf("failed to parse server certificate: %w", err)
+		}
+		certs[i] = cert
+	}
+
+	// Candidates for pin matching: the leaf, or the verified chains when the
+	// chain is checked, so a pinned root also matches. Other certificates the
+	// server sends prove nothing unless the chain is verified: anyone can send
+	// a copy of a pinned CA next to their own leaf.
+	candidates := certs[:1]
+	if t.verifiesChain() {
+		intermediates := x509.NewCertPool()
+		for _, cert := range certs[1:] {
+			intermediates.AddCert(cert)
+		}
+		chains, err := certs[0].Verify(x509.VerifyOptions{
+			Roots:         t.roots,
+			Intermediates: intermediates,
+			DNSName:       name,
+		})
+		if err != nil {
+			return fmt.Errorf("certificate verification failed: %w", err)
+		}
+		candidates = nil
+		for _, chain := range chains {
+			candidates = append(candidates, chain...)
+		}
+	} else if t.verifyName != "" {
+		// Without chain verification the name is still checked if asked for
+		if err := certs[0].VerifyHostname(name); err != nil {
+			return fmt.Errorf("certificate verification failed: %w", err)
+		}
+	}
+
+	if len(t.pins) == 0 {
+		return nil
+	}
+	for _, cert := range candidates {
+		hash := sha256.Sum256(cert.RawSubjectPublicKeyInfo)
+		for _, pin := range t.pins {
+			if bytes.Equal(hash[:], pin) {
+				return nil
+			}
+		}
+	}
+	return errors.New("certificate verification failed: no certificate matches the pinned public keys")
+}
@@ -0,0 +1,132 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2024 AmneziaWG. All Rights Reserved.
+ */
+
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"encoding/pem"
+	"math/big"
+	"testing"
+	"time"
+)
+
+// testCert is a certificate with its key, for building test chains
+type testCert struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+}
+
+// newTestCert issues a certificate for names, signed by parent or self-signed
+// if parent is nil. Without names it's a CA.
+func newTestCert(t *testing.T, parent *testCert, names ...string) *testCert {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: "udptlspipe test"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		DNSNames:     names,
+		KeyUsage:     x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	if len(names) == 0 {
+		template.IsCA = true
+		template.BasicConstraintsValid = true
+	}
+	signer, signerKey := template, key
+	if parent != nil {
+		signer, signerKey = parent.cert, parent.key
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, signer, &key.PublicKey, signerKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &testCert{cert: cert, key: key}
+}
+
+func (c *testCert) pin() string {
+	hash := sha256.Sum256(c.cert.RawSubjectPublicKeyInfo)
+	return base64.StdEncoding.EncodeToString(hash[:])
+}
+
+func (c *testCert) pem() string {
+	return string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: c.cert.Raw}))
+}
+
+func rawChain(certs ...*testCert) [][]byte {
+	raw := make([][]byte, len(certs))
+	for i, cert := range certs {
+		raw[i] = cert.cert.Raw
+	}
+	return raw
+}
+
+func TestTrustPins(t *testing.T) {
+	ca := newTestCert(t, nil)
+	leaf := newTestCert(t, ca, "server.example")
+	attacker := newTestCert(t, nil, "server.example")
+
+	tests := []struct {
+		name   string
+		secure bool
+		pins   []string
+		caPEM  string
+		chain  [][]byte
+		ok     bool
+	}{
+		{"leaf pin", false, []string{leaf.pin()}, "", rawChain(leaf, ca), true},
+		{"leaf pin, other key", false, []string{leaf.pin()}, "", rawChain(attacker), false},
+		// Without chain verification a copy of the pinned CA proves nothing
+		{"unverified CA pin", false, []string{ca.pin()}, "", rawChain(attacker, ca), false},
+		{"verified CA pin", false, []string{ca.pin()}, ca.pem(), rawChain(leaf, ca), true},
+		{"verified CA pin, forged chain", false, []string{ca.pin()}, ca.pem(), rawChain(attacker, ca), false},
+		{"verified root only", false, []string{ca.pin()}, ca.pem(), rawChain(leaf), true},
+		{"secure with CA, no pins", true, nil, ca.pem(), rawChain(leaf), true},
+		{"wrong name", true, nil, ca.pem(), rawChain(newTestCert(t, ca, "other.example")), false},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			trust, err := newTLSTrust(test.secure, test.pins, test.caPEM, "")
+			if err != nil {
+				t.Fatal(err)
+			}
+			err = trust.verify(test.chain, "server.example")
+			if (err == nil) != test.ok {
+				t.Errorf("verify = %v, want ok %t", err, test.ok)
+			}
+		})
+	}
+}
+
+func TestParseSPKIPin(t *testing.T) {
+	hash := sha256.Sum256([]byte("key"))
+	for _, pin := range []string{
+		base64.StdEncoding.EncodeToString(hash[:]),
+		"sha256/" + base64.StdEncoding.EncodeToString(hash[:]),
+		" " + base64.StdEncoding.EncodeToString(hash[:]) + " ",
+	} {
+		if got, err := parseSPKIPin(pin); err != nil || string(got) != string(hash[:]) {
+			t.Errorf("parseSPKIPin(%q) = %x, %v", pin, got, err)
+		}
+	}
+	if _, err := parseSPKIPin("AAAA"); err == nil {
+		t.Error("short pin accepted")
+	}
+}
@@ -8,6 +8,17 @@
 
 #include <stdint.h>
 
+/* Error codes, see udptlspipeGetErrorCode() and udptlspipeStart() */
+#define UDPTLSPIPE_ERROR_NONE 0
+#define UDPTLSPIPE_ERROR_INTERNAL 1       /* Unexpected internal failure */
+#define UDPTLSPIPE_ERROR_INVALID_CONFIG 2 /* Invalid parameters */
+#define UDPTLSPIPE_ERROR_BIND 3           /* Local UDP listener could not be bound or failed */
+#define UDPTLSPIPE_ERROR_DNS 4            /* Server name could not be resolved */
+#define UDPTLSPIPE_ERROR_CONNECT 5        /* TCP connection or WebSocket handshake failed */
+#define UDPTLSPIPE_ERROR_TLS 6            /* TLS handshake or certificate verification failed */
+#define UDPTLSPIPE_ERROR_AUTH 7           /* Server rejected the password */
+#define UDPTLSPIPE_ERROR_PROXY 8          /* Connection through the proxy failed */
+
 typedef void(*udptlspipe_logger_fn_t)(void *context, int level, const char *msg);
 
 /**
@@ -18,17 +29,66 @@ typedef void(*udptlspipe_logger_fn_t)(void *context, int level, const char *msg)
  */
 void udptlspipeSetLogger(void *context, udptlspipe_logger_fn_t logger_fn);
 
+/* Connection state change events, see udptlspipeSetEventCallback() */
+#define UDPTLSPIPE_EVENT_CONNECTING 1     /* Dialing the server; detail: client, destination, attempt */
+#define UDPTLSPIPE_EVENT_TLS_HANDSHAKE 2  /* TLS handshake done; detail: client, version, alpn, resumed, ech */
+#define UDPTLSPIPE_EVENT_WEBSOCKET_UP 3   /* WebSocket established; detail: client, destination */
+#define UDPTLSPIPE_EVENT_DISCONNECTED 4   /* Connection or attempt ended; code: UDPTLSPIPE_DISCONNECT_*; detail: client, error */
+#define UDPTLSPIPE_EVENT_LISTENER_ERROR 5 /* Fatal UDP listener error, the handle stops relaying; detail: error */
+#define UDPTLSPIPE_EVENT_SESSION_REAPED 6 /* Session closed and evicted; code: UDPTLSPIPE_REAP_*; detail: client, idle_seconds */
+#define UDPTLSPIPE_EVENT_CONFIG_WARNING 7 /* Accepted configuration unlikely to work, at start; detail: field, warning */
+
+/* Reason codes for UDPTLSPIPE_EVENT_DISCONNECTED */
+#define UDPTLSPIPE_DISCONNECT_CLOSED 0        /* Closed locally */
+#define UDPTLSPIPE_DISCONNECT_DIAL_FAILED 1   /* TCP, TLS or WebSocket handshake failed */
+#define UDPTLSPIPE_DISCONNECT_READ_ERROR 2    /* Connection broke while reading */
+#define UDPTLSPIPE_DISCONNECT_REMOTE_CLOSED 3 /* Server closed the connection */
+#define UDPTLSPIPE_DISCONNECT_PING_TIMEOUT 4  /* Server stopped answering pings, see max_missed_pongs */
+
+/* Reason codes for UDPTLSPIPE_EVENT_SESSION_REAPED */
+#define UDPTLSPIPE_REAP_IDLE 0          /* No traffic for the idle timeout */
+#define UDPTLSPIPE_REAP_SESSION_LIMIT 1 /* Evicted to make room for a new session */
+
+/* The "client" detail is the address of the local UDP client, or "*" for the
+ * connection shared by all clients when multiplexing */
+
+typedef void(*udptlspipe_event_fn_t)(void *context, int handle, int event, int code, const char *detail);
+
 /**
- * Start a udptlspipe client.
+ * Set the event callback for udptlspipe connection state changes.
+ *
+ * The callback may be invoked from any thread, and may itself call this
+ * function. It must not call udptlspipeStop() for the handle it was invoked
+ * for, which waits for the invocation to return; hand that over to another
+ * thread. An invocation that began before the callback was replaced or
+ * unregistered may still be running when this function returns, so keep the
+ * context valid until every handle is stopped.
+ *
+ * @param context User context pointer passed to the callback.
+ * @param event_fn Callback function pointer, or NULL to unregister. It receives
+ *                 the handle ID, one of UDPTLSPIPE_EVENT_*, an event-specific
+ *                 code and a JSON object with details (valid only during the call).
+ */
+void udptlspipeSetEventCallback(void *context, udptlspipe_event_fn_t event_fn);
+
+/**
+ * Start a udptlspipe client listening on 127.0.0.1.
+ *
+ * Returns once the local UDP listener is bound, so bind failures are reported
+ * through the return value. Later errors are available per handle through
+ * udptlspipeGetError() and udptlspipeGetErrorCode().
  *
  * @param destination Remote server address (e.g., "server.example.com:443")
  * @param password Password for authentication (can be NULL or empty)
  * @param tls_server_name TLS server name for SNI (can be NULL to use destination host)
  * @param secure If non-zero, enables TLS certificate verification
- * @param proxy Proxy URL (can be NULL or empty)
+ * @param proxy Proxy URL: "http://[user:pass@]host:port" (HTTP CONNECT),
+ *              "https://" (HTTP CONNECT over TLS, the proxy certificate is
+ *              verified against the system roots), or "socks5://" or
+ *              "socks5h://[user:pass@]host:port" (can be NULL or empty)
  * @param fingerprint_profile TLS fingerprint profile ("chrome", "firefox", "safari", "edge", "okhttp", "ios", "randomized")
  * @param listen_port Local port to listen on (0 for auto-assign)
- * @return Handle ID on success (> 0), or negative error code on failure
+ * @return Handle ID on success (> 0), or a negated UDPTLSPIPE_ERROR_* code on failure
  */
 int udptlspipeStart(const char *destination,
                     const char *password,
@@ -38,6 +98,229 @@ int udptlspipeStart(const char *destination,
                     const char *fingerprint_profile,
                     int listen_port);
 
+/**
+ * Start a udptlspipe client listening on a specific local address.
+ *
+ * Same as udptlspipeStart(), which listens on 127.0.0.1, but with a choice of
+ * local bind address.
+ *
+ * @param listen_address Local IP address to bind to: NULL or empty for 127.0.0.1,
+ *                       "::1" for IPv6 loopback, "::" for dual-stack on all
+ *                       interfaces, or the address of a specific interface
+ * @param listen_port Local port to listen on (0 for auto-assign)
+ * @return Handle ID on success (> 0), or a negated UDPTLSPIPE_ERROR_* code on failure
+ */
+int udptlspipeStartOnAddress(const char *destination,
+                             const char *password,
+                             const char *tls_server_name,
+                             int secure,
+                             const char *proxy,
+                             const char *fingerprint_profile,
+                             const char *listen_address,
+                             int listen_port);
+
+/**
+ * Start a udptlspipe client from a JSON configuration object.
+ *
+ * This is the preferred entry point; options added in later versions are only
+ * available here. Supported fields (only "destination" is required):
+ *
+ *   version                       Schema version, currently 1 (default: 1)
+ *   destination                   Remote server address "host:port"
+ *   password                      Password for authentication
+ *   tls_server_name               TLS server name for SNI (default: destination host)
+ *   secure                        Verify the server certificate chain (bool)
+ *   proxy                         Proxy URL, as for udptlspipeStart()
+ *   fingerprint_profile           TLS fingerprint profile, predefined or custom
+ *                                 (default: "okhttp")
+ *   listen_address                Local bind address, as for udptlspipeStartOnAddress()
+ *   listen_port                   Local port (default: 0, auto-assign)
+ *   pinned_spki                   Array of SHA-256 SPKI hashes, base64 (optionally
+ *                                 "sha256/"-prefixed) or hex. With chain
+ *                                 verification any certificate of the verified
+ *                                 chain may match, so a CA can be pinned;
+ *                                 without it only the server certificate may
+ *   ca_pem                        PEM bundle of CA certificates replacing the
+ *                                 system roots, implies chain verification
+ *   verify_name                   Host name the certificate must be valid for, if
+ *                                 it differs from the SNI
+ *   session_idle_timeout_seconds  Idle time after which a session is closed
+ *                                 (default: 180)
+ *   max_sessions                  Maximum concurrent sessions (default: 64)
+ *   ping_interval_seconds         Interval of the WebSocket pings that measure the
+ *                                 round-trip time and detect dead connections
+ *                                 (default: 30)
+ *   pong_timeout_seconds          Time a pong may take before its ping counts as
+ *                                 missed, at most the ping interval (default: 10,
+ *                                 or the ping interval if shorter)
+ *   max_missed_pongs              Missed pongs in a row after which the connection
+ *                                 is closed and redialed (default: 3). It is also
+ *                                 closed if no pong arrives for max_missed_pongs + 1
+ *                                 ping intervals, even if pings can't be sent. QUIC
+ *                                 connections rely on the QUIC idle timeout instead
+ *   ws_path                       WebSocket request path, may include a query
+ *                                 string (default: "/")
+ *   auth_mode                     "query" (default) sends the password in the URL
+ *                                 query, as older servers expect; "hmac" sends a
+ *                                 single-use token derived from the password in
+ *                                 the Sec-WebSocket-Protocol header instead, which
+ *                                 the server only accepts within 2 minutes of the
+ *                                 client's clock
+ *   multiplex                     Carry all local UDP clients over one shared
+ *                                 connection instead of one connection each
+ *                                 (bool). Falls back to one connection per client
+ *                                 if the server doesn't support it
+ *   stripes                       Number of WebSocket connections each session
+ *                                 (or the shared connection when multiplexing)
+ *                                 spreads its datagrams over, 1 to 16
+ *                                 (default: 1). More stripes avoid head-of-line
+ *                                 blocking on lossy links. The server relays
+ *                                 the stripes of a session from one UDP socket
+ *                                 and spreads its datagrams back over them;
+ *                                 servers from before striping relay each
+ *                                 stripe as a session of its own
+ *   stripe_policy                 "round_robin" (default) takes the connected
+ *                                 stripes in turn; "least_queued" takes the one
+ *                                 with the fewest datagrams waiting
+ *   http_version                  "auto" (default) offers the ALPN protocols of the
+ *                                 fingerprint profile and opens the WebSocket over
+ *                                 HTTP/2 (RFC 8441 extended CONNECT) if the server
+ *                                 selects h2, or else with an HTTP/1.1 Upgrade.
+ *                                 Once a server selects h2 without supporting
+ *                                 WebSockets over it, only http/1.1 is offered.
+ *                                 "1.1" only offers http/1.1; "2" only offers h2
+ *   transport                     "websocket" (default), or "quic" to tunnel the
+ *                                 datagrams as HTTP/3 datagrams (RFC 9297) of an
+ *                                 extended CONNECT request to ws_path over QUIC,
+ *                                 authenticated like the WebSocket. QUIC uses
+ *                                 the Go TLS stack, so the fingerprint profile
+ *                                 only sets the User-Agent, and http_version is
+ *                                 ignored. Not supported with multiplex, stripes
+ *                                 or proxy. UDPTLSPIPE_EVENT_WEBSOCKET_UP is
+ *                                 emitted when the tunnel is open
+ *   padding_policy                How the messages sent to the server are padded:
+ *                                 "uniform" (default) to at least 100 bytes with a
+ *                                 random length up to 256; "bucket" to the next of
+ *                                 padding_buckets; "https" to sizes drawn from a
+ *                                 model of browser HTTPS record sizes;
+ *                                 "constant_rate" to 1320 bytes, also sending an
+ *                                 empty message whenever nothing was sent for
+ *                                 chaff_interval_ms. Datagrams are split into
+ *                                 fragments that fit the largest size, so over
+ *                                 WebSocket all but "uniform" need a server that
+ *                                 supports fragmentation; larger QUIC messages are
+ *                                 padded to a multiple of it. constant_rate isn't
+ *                                 supported with transport "quic"
+ *   padding_buckets               Ascending array of message sizes for "bucket",
+ *                                 from 9 to 1320 (default: [128, 256, 512, 1024,
+ *                                 1320])
+ *   chaff_interval_ms             Idle time before an empty message is sent with
+ *                                 "constant_rate" (default: 100)
+ *   drop_policy                   Which datagram is dropped when the 256-datagram
+ *                                 send queue of a session is full: "drop_data"
+ *                                 (default) drops arriving data, and makes room
+ *                                 for WireGuard handshake and cookie messages by
+ *                                 dropping the oldest data; "drop_newest" drops
+ *                                 the arriving datagram; "drop_oldest" the oldest
+ *                                 queued one. Handshake and cookie messages are
+ *                                 always sent ahead of queued data
+ *   disable_session_resumption    Always do full TLS handshakes (bool). By default
+ *                                 TLS sessions are kept per destination, shared by
+ *                                 all handles, and resumed on later connections
+ *                                 like a browser would. The pre_shared_key
+ *                                 extension is added to TLS 1.3 profiles for
+ *                                 this, but only sent when resuming. Profiles
+ *                                 without session tickets, such as "okhttp",
+ *                                 can't resume with most servers. No early
+ *                                 (0-RTT) data is sent
+ *   session_cache_file            File to keep the TLS sessions in across restarts,
+ *                                 shared by all handles using the same file
+ *                                 (default: sessions are only kept in memory).
+ *                                 Its directory must exist; the file holds
+ *                                 session secrets and is only readable by its
+ *                                 owner
+ *   ech_mode                      Encrypted Client Hello: "off" (default);
+ *                                 "prefer" uses ECH when a configuration is
+ *                                 available, and otherwise, or for 10 minutes
+ *                                 after the server rejects it, connects with
+ *                                 the plaintext SNI; "strict" never sends the
+ *                                 SNI in plaintext and fails the connection
+ *                                 instead. A rejecting server's retry
+ *                                 configurations are used once if its
+ *                                 certificate is valid for the public name of
+ *                                 the configuration, which needs chain
+ *                                 verification. Needs a TLS 1.3 profile, so not
+ *                                 "okhttp". TLS sessions aren't resumed with
+ *                                 ECH over WebSocket
+ *   ech_config_list               ECHConfigList in base64, as published in the
+ *                                 "ech" parameter of the server's HTTPS record
+ *   ech_resolver                  Resolver to look the HTTPS record of
+ *                                 tls_server_name up in instead, as a DNS
+ *                                 server "host[:port]" (port 53 by default, not
+ *                                 allowed with proxy, which it would bypass) or
+ *                                 a DNS-over-HTTPS URL "https://..." (through
+ *                                 the proxy). The configuration is cached for the
+ *                                 record's TTL, from 1 minute to 1 day, and a
+ *                                 failed lookup is UDPTLSPIPE_ERROR_DNS in
+ *                                 strict mode
+ *   host                          Host header (default: the destination, even
+ *                                 with tls_server_name set, so a pipe dialing a
+ *                                 pinned address sets it to the name the server
+ *                                 expects). For domain fronting, destination
+ *                                 is the address dialed, such as a CDN edge IP,
+ *                                 tls_server_name a domain the CDN serves that
+ *                                 may appear in the clear, and host the backend
+ *                                 the CDN routes to. Whether the CDN allows it is
+ *                                 up to the CDN; names that can't work together,
+ *                                 such as an IP address as SNI or host, or a
+ *                                 destination or verify_name naming the backend,
+ *                                 are reported with UDPTLSPIPE_EVENT_CONFIG_WARNING
+ *   headers                       Object of extra request headers, e.g. cookies;
+ *                                 a User-Agent here replaces the profile's. All
+ *                                 headers are sent in the order used by the
+ *                                 browser of the fingerprint profile
+ *   custom_profiles               Object of custom fingerprint profiles by name
+ *                                 (lowercase letters, digits, '-', '_' and '.').
+ *                                 Each has a "user_agent", and either a
+ *                                 "client_hello" uTLS ClientHelloSpec in JSON, as
+ *                                 published by tlsfingerprint.io, or a
+ *                                 "client_hello_hex" captured ClientHello in hex,
+ *                                 with or without its record header (colons and
+ *                                 whitespace are ignored). Headers are sent in
+ *                                 the order of the browser the user agent names.
+ *                                 Profiles are checked when the pipe starts and
+ *                                 can only be selected by this handle. With
+ *                                 transport "quic" only the user agent is used
+ *   fingerprint_policy            How the "randomized" profile picks, for this
+ *                                 handle: "process" (default) keeps one pick
+ *                                 shared by all handles with this policy until
+ *                                 udptlspipeResetFingerprint(); "connection"
+ *                                 picks again for each connection;
+ *                                 "destination" keeps one pick per destination,
+ *                                 in fingerprint_state_file if set; "weighted"
+ *                                 picks one of fingerprint_weights when the
+ *                                 handle starts and keeps it. Setting it makes
+ *                                 "randomized" the default fingerprint_profile,
+ *                                 and other profiles can't be combined with it
+ *   fingerprint_weights           Object of profile names, predefined or custom,
+ *                                 and their weights from 1 to 1000000, for the
+ *                                 "weighted" policy, e.g. {"chrome": 3,
+ *                                 "firefox": 1}. With ECH every profile must
+ *                                 offer TLS 1.3
+ *   fingerprint_state_file        File to keep the "destination" picks in across
+ *                                 restarts, shared by all handles using the
+ *                                 same file (default: picks are only kept in
+ *                                 memory). Its directory must exist
+ *
+ * Unknown fields, fields of the wrong type and invalid values are rejected
+ * with UDPTLSPIPE_ERROR_INVALID_CONFIG; udptlspipeGetLastError() then names
+ * the offending field.
+ *
+ * @param config_json The JSON configuration object
+ * @return Handle ID on success (> 0), or a negated UDPTLSPIPE_ERROR_* code on failure
+ */
+int udptlspipeStartWithConfig(const char *config_json);
+
 /**
  * Stop a running udptlspipe client.
  *
@@ -53,6 +336,67 @@ void udptlspipeStop(int handle);
  */
 int udptlspipeGetLocalPort(int handle);
 
+/**
+ * Get traffic and health statistics for a running udptlspipe client.
+ *
+ * The result is a JSON object with the following fields:
+ *   bytes_sent, bytes_received         UDP payload bytes to / from the server
+ *   datagrams_sent, datagrams_received Datagrams to / from the server
+ *   dropped_packets                    Datagrams dropped because the send queue was full or stale
+ *   dropped_control, dropped_data      Of those, the ones dropped by a session, split into
+ *                                      WireGuard handshake and cookie messages, and the rest
+ *   oversize_dropped                   Datagrams dropped for being too large: over 65535 bytes,
+ *                                      or 65531 when multiplexed without fragmentation
+ *   reassembly_failures                Fragmented datagrams from the server given up on
+ *                                      before all their fragments arrived
+ *   reconnects                         Reconnect attempts across all sessions
+ *   handshake_failures                 Failed TCP/TLS/WebSocket connection attempts
+ *   sessions                           Current number of client sessions
+ *   connections                        Current number of established WebSocket connections
+ *   last_rtt_ms                        Round-trip time of the last ping/pong (0 if unknown)
+ *   missed_pongs                       Pings that went unanswered for the pong timeout
+ *   resumption_hits                    TLS handshakes that resumed a session
+ *   resumption_misses                  Full TLS handshakes while session resumption was enabled
+ *   capsule_fallbacks                  With transport "quic", datagrams sent on the request stream
+ *                                      because they didn't fit in a QUIC datagram even unpadded,
+ *                                      or the server doesn't support HTTP datagrams
+ *   uptime_seconds                     Time since a connection was last established (0 if none)
+ *   fingerprint                        ClientHello of the latest connection, e.g. "Chrome-133"
+ *                                      (empty before the first one, and with transport "quic")
+ *   user_agent                         User-Agent sent on the latest connection
+ *   stripes                            With striping, an array with one object per stripe
+ *                                      position, summed over sessions: bytes_sent,
+ *                                      bytes_received, datagrams_sent, datagrams_received,
+ *                                      queued (datagrams waiting) and connections
+ *
+ * @param handle The handle ID returned by udptlspipeStart
+ * @return JSON string (caller should free this), or NULL if handle is invalid
+ */
+char *udptlspipeGetStats(int handle);
+
+/**
+ * Get the last error of a running udptlspipe client, if any.
+ *
+ * @param handle The handle ID returned by udptlspipeStart
+ * @return Error message string (caller should free this), or NULL if no error or invalid handle
+ */
+char *udptlspipeGetError(int handle);
+
+/**
+ * Get the code of the last error of a running udptlspipe client.
+ *
+ * @param handle The handle ID returned by udptlspipeStart
+ * @return One of UDPTLSPIPE_ERROR_*, UDPTLSPIPE_ERROR_NONE if no error or invalid handle
+ */
+int udptlspipeGetErrorCode(int handle);
+
+/**
+ * Clear the last error of a running udptlspipe client.
+ *
+ * @param handle The handle ID returned by udptlspipeStart
+ */
+void udptlspipeClearError(int handle);
+
 /**
  * Get the version string of udptlspipe.
  *
@@ -63,12 +407,14 @@ char *udptlspipeVersion(void);
 /**
  * Reset the cached randomized fingerprint pair.
  * This should be called when reconnecting to get a fresh fingerprint.
- * Only useful when using the "randomized" fingerprint profile.
+ * Only useful when using the "randomized" fingerprint profile with the
+ * "process" fingerprint policy.
  */
 void udptlspipeResetFingerprint(void);
 
 /**
- * Get the last error message, if any.
+ * Get the last error message of any handle, if any.
+ * Prefer udptlspipeGetError(), which is not overwritten by other handles.
  *
  * @return Error message string (caller should free this), or NULL if no error
  */